@@ -1,14 +1,66 @@
 #!/usr/bin/env node
 'use strict';
 
+const crypto = require('crypto');
+const dgram = require('dgram');
 const fs = require('fs');
 const fsp = fs.promises;
+const http = require('http');
+const https = require('https');
+const net = require('net');
 const os = require('os');
 const path = require('path');
-const { execFileSync } = require('child_process');
+const readline = require('readline');
+const tls = require('tls');
+const zlib = require('zlib');
+const { execFile, execFileSync, spawn } = require('child_process');
 
+const VERSION = '0.2.0';
+// IMAGE_EXTS are the file extensions scanned by default; --ext replaces them.
+const IMAGE_EXTS = ['png', 'jpg', 'jpeg', 'webp', 'gif', 'heic', 'heif', 'tiff', 'tif', 'bmp', 'avif'];
 const ERR_NOT_FOUND = 'no image found';
+const ERR_UNSUPPORTED = 'unsupported';
+const ERR_INJECTED = 'injected failure';
+const ERR_TOO_LARGE = 'too large';
+const EXIT_MISMATCH = 3;
+const EXIT_ASSERT = 4;
+const EXIT_UNDELIVERED = 5;
+const FAIL_STAGES = new Set(['clipboard', 'scan', 'copy', 'trash']);
 const CLIPBOARD_MAX_BUFFER = 50 * 1024 * 1024;
+const COMMANDS = new Set([
+  'capabilities',
+  'capture',
+  'clean',
+  'clipboard inspect',
+  'compare',
+  'daemon',
+  'daemon get',
+  'daemon poke',
+  'editor-protocol',
+  'export',
+  'get',
+  'history',
+  'history ocr-backfill',
+  'history search',
+  'init',
+  'migrate',
+  'replay save',
+  'replay start',
+  'restore',
+  'schema',
+  'schema event',
+  'schema result',
+  'secrets delete',
+  'secrets set',
+  'serve',
+  'serve-mcp',
+  'stash',
+  'stash restore',
+  'trash',
+  'trash purge',
+  'watch',
+]);
+const SCHEMA_VERSION = 1;
 
 function main() {
   let opts;
@@ -23,13 +75,75 @@ function main() {
     printUsage(process.stdout);
     return;
   }
+  if (opts.version) {
+    process.stdout.write(`screenshot-agent ${VERSION}\n`);
+    return;
+  }
+  try {
+    // init writes the config, so a broken one must not keep it from running.
+    if (opts.command[0] !== 'init') applyConfig(opts, withProfile(loadConfig(opts.configPath), opts.profile));
+    if (opts.dirsOnly && opts.dirs.length === 0) {
+      throw new Error('--dirs-only needs at least one --dir (or dirs in config)');
+    }
+  } catch (err) {
+    console.error(err.message || String(err));
+    process.exit(2);
+  }
+
+  if (opts.command.length > 0) {
+    runCommand(opts)
+      .then((code) => {
+        process.exitCode = code || 0;
+      })
+      .catch((err) => {
+        console.error(err && err.message ? err.message : String(err));
+        process.exitCode = 2;
+      });
+    return;
+  }
+
+  if (opts.launcher) {
+    runLauncher(opts)
+      .then((code) => {
+        process.exitCode = code;
+      })
+      .catch((err) => {
+        console.error(err && err.message ? err.message : String(err));
+        process.exitCode = 2;
+      });
+    return;
+  }
 
   run(opts)
-    .then((result) => {
+    .then(async (result) => {
+      if (opts.reportBacklog) {
+        const backlog = await backlogReport(opts);
+        if (result) result.backlog = backlog;
+        for (const item of backlog) {
+          process.stderr.write(
+            `${item.dir}: ${item.images} images (${item.screenshots} screenshots), ${formatBytes(item.bytes)}\n`,
+          );
+        }
+      }
       if (!result) {
-        process.exit(1);
+        process.exit(opts.outSkipped ? 0 : 1);
+      }
+      // A capture that fails its assertions is printed but never delivered.
+      const failures = await failedAssertions(opts.assertions, result);
+      let undelivered = 0;
+      if ((opts.upload || opts.deliver.length > 0) && failures.length === 0) {
+        undelivered = await deliverResult(result, opts);
+      }
+      writeResult(result, opts);
+      for (const failure of failures) {
+        process.stderr.write(`assertion failed: ${failure}\n`);
+      }
+      if (failures.length > 0) {
+        process.exit(EXIT_ASSERT);
+      }
+      if (undelivered > 0) {
+        process.exit(EXIT_UNDELIVERED);
       }
-      process.stdout.write(result.source + '\n' + result.tempPath + '\n');
     })
     .catch((err) => {
       if (err && err.code === ERR_NOT_FOUND) {
@@ -44,351 +158,7799 @@ function parseArgs(args) {
   const opts = {
     clipboardOnly: false,
     useDownloads: false,
+    dirs: [],
+    screenshotPatterns: [],
+    dirsOnly: false,
+    allSources: false,
+    learnNames: false,
+    newOnly: false,
+    extensions: IMAGE_EXTS,
     verbose: false,
     help: false,
+    version: false,
+    json: false,
+    outputVersion: 0,
+    format: '',
+    launcher: false,
+    assertions: [],
+    assertSet: false,
+    audit: '',
+    minQualitySet: false,
+    listen: '127.0.0.1:8765',
+    token: '',
+    udpPort: null,
+    configPath: '',
+    profile: '',
+    rules: [],
+    command: [],
+    clipboardBackends: [],
+    replaceClipboard: false,
+    links: false,
+    copyLinks: false,
+    upload: '',
+    urlFormat: '',
+    copyUrl: false,
+    targets: {},
+    caCert: '',
+    secretName: '',
+    deliver: [],
+    deliverSet: false,
+    ocr: false,
+    ocrEngine: '',
+    ocrLangs: [],
+    baseline: '',
+    tolerance: 0,
+    fuzz: 8,
+    jobs: null,
+    diffPath: '',
+    reportBacklog: false,
+    olderThanMs: null,
+    dryRun: false,
+    fromMs: null,
+    toMs: null,
+    dest: '',
+    context: {},
+    sidecar: false,
+    history: false,
+    query: '',
+    historySource: '',
+    replaySeconds: 10,
+    gif: false,
+    sound: null,
+    failStages: new Set(),
+    cacheMs: 0,
+    inputPath: '',
+    stdin: false,
+    sort: 'mtime',
+    groupBurst: false,
+    burstWindowMs: 5000,
+    readOnly: false,
+    offline: false,
+    softTimeoutMs: 0,
+    latencyBudgetMs: 0,
+    prefer: 'auto',
+    preferSet: false,
+    recencyMs: 30 * 1000,
+    recencySet: false,
+    waitMs: 0,
+    select: false,
+    restoreLast: false,
+    restoreList: false,
+    stash: false,
+    stashTtlMs: 7 * 24 * 60 * 60 * 1000,
+    stashTtlSet: false,
+    marker: true,
+    staleClipboard: 'warn',
+    staleClipboardMs: 60 * 60 * 1000,
+    allowStaleClipboard: false,
+    maxClipboardBytes: 0,
+    extFromContent: false,
+    cloudWaitMs: 0,
+    displayInfo: false,
+    classify: false,
+    quality: false,
+    fastDecode: false,
+    document: false,
+    trimTerminal: false,
+    bilevel: false,
+    detachClipboard: false,
+    rasterize: false,
+    rasterizeDpi: 144,
+    out: '',
+    collision: '',
+    consume: 'auto',
+    fileMode: null,
+    dirMode: null,
+    chown: '',
   };
   for (let i = 0; i < args.length; i += 1) {
     const arg = args[i];
-    if (arg === '--clipboard-only') {
+    if (arg === '--config' || arg.startsWith('--config=')) {
+      const { value, next } = flagValue(args, i);
+      opts.configPath = value;
+      i = next;
+    } else if (arg === '--profile' || arg.startsWith('--profile=')) {
+      const { value, next } = flagValue(args, i);
+      opts.profile = value;
+      i = next;
+    } else if (arg === '--cache' || arg.startsWith('--cache=')) {
+      const { value, next } = flagValue(args, i);
+      opts.cacheMs = parseDuration(value);
+      if (opts.cacheMs === null) throw new Error(`invalid --cache: ${value}`);
+      i = next;
+    } else if (arg === '--chmod' || arg.startsWith('--chmod=')) {
+      const { value, next } = flagValue(args, i);
+      opts.fileMode = parseMode(value);
+      if (opts.fileMode === null) throw new Error(`invalid --chmod: ${value} (octal, e.g. 640)`);
+      i = next;
+    } else if (arg === '--dir-mode' || arg.startsWith('--dir-mode=')) {
+      const { value, next } = flagValue(args, i);
+      opts.dirMode = parseMode(value);
+      if (opts.dirMode === null) throw new Error(`invalid --dir-mode: ${value} (octal, e.g. 750)`);
+      i = next;
+    } else if (arg === '--chown' || arg.startsWith('--chown=')) {
+      const { value, next } = flagValue(args, i);
+      opts.chown = value;
+      resolveOwner(value);
+      i = next;
+    } else if (arg === '--clipboard-backend' || arg.startsWith('--clipboard-backend=')) {
+      const { value, next } = flagValue(args, i);
+      opts.clipboardBackends = splitList(value);
+      clipboardBackendChain(opts.clipboardBackends);
+      i = next;
+    } else if (arg === '--clipboard-only') {
       opts.clipboardOnly = true;
     } else if (arg === '--downloads') {
       opts.useDownloads = true;
+    } else if (arg === '--dir' || arg.startsWith('--dir=')) {
+      const { value, next } = flagValue(args, i);
+      opts.dirs.push(value);
+      i = next;
+    } else if (arg === '--screenshot-pattern' || arg.startsWith('--screenshot-pattern=')) {
+      const { value, next } = flagValue(args, i);
+      opts.screenshotPatterns.push(parseNamePattern(value, '--screenshot-pattern'));
+      i = next;
+    } else if (arg === '--dirs-only') {
+      opts.dirsOnly = true;
+    } else if (arg === '--learn-names') {
+      opts.learnNames = true;
+    } else if (arg === '--new-only') {
+      opts.newOnly = true;
+    } else if (arg === '--offline') {
+      opts.offline = true;
+    } else if (arg === '--all-sources') {
+      opts.allSources = true;
+    } else if (arg === '--ext' || arg.startsWith('--ext=')) {
+      const { value, next } = flagValue(args, i);
+      opts.extensions = parseExtensions(splitList(value));
+      if (!opts.extensions) throw new Error(`invalid --ext: ${value}`);
+      opts.extensionsSet = true;
+      i = next;
+    } else if (arg === '--tolerance' || arg.startsWith('--tolerance=')) {
+      const { value, next } = flagValue(args, i);
+      opts.tolerance = parsePercent(value);
+      if (opts.tolerance === null) throw new Error(`invalid --tolerance: ${value}`);
+      i = next;
+    } else if (arg === '--fuzz' || arg.startsWith('--fuzz=')) {
+      const { value, next } = flagValue(args, i);
+      opts.fuzz = Number(value);
+      if (!Number.isInteger(opts.fuzz) || opts.fuzz < 0 || opts.fuzz > 255) throw new Error(`invalid --fuzz: ${value}`);
+      i = next;
+    } else if (arg === '--jobs' || arg === '-j' || arg.startsWith('--jobs=')) {
+      const { value, next } = flagValue(args, i);
+      opts.jobs = Number(value);
+      if (!Number.isInteger(opts.jobs) || opts.jobs < 1) throw new Error(`invalid --jobs: ${value}`);
+      i = next;
+    } else if (arg === '--diff' || arg.startsWith('--diff=')) {
+      const { value, next } = flagValue(args, i);
+      opts.diffPath = value;
+      i = next;
+    } else if (arg === '--report-backlog') {
+      opts.reportBacklog = true;
+    } else if (arg === '--older-than' || arg.startsWith('--older-than=')) {
+      const { value, next } = flagValue(args, i);
+      opts.olderThanMs = parseDuration(value);
+      if (opts.olderThanMs === null) throw new Error(`invalid --older-than: ${value}`);
+      i = next;
+    } else if (arg === '--from' || arg.startsWith('--from=') || arg === '--to' || arg.startsWith('--to=')) {
+      const { value, next } = flagValue(args, i);
+      const ms = parseTime(value);
+      if (ms === null) throw new Error(`invalid time: ${value}`);
+      if (arg.startsWith('--from')) {
+        opts.fromMs = ms;
+      } else {
+        opts.toMs = ms;
+      }
+      i = next;
+    } else if (arg === '--cloud-wait' || arg.startsWith('--cloud-wait=')) {
+      const { value, next } = flagValue(args, i);
+      opts.cloudWaitMs = parseDuration(value);
+      if (opts.cloudWaitMs === null) throw new Error(`invalid --cloud-wait: ${value}`);
+      i = next;
+    } else if (arg === '--consume' || arg.startsWith('--consume=')) {
+      const { value, next } = flagValue(args, i);
+      if (!CONSUME_POLICIES.includes(value)) {
+        throw new Error(`invalid --consume: ${value} (${CONSUME_POLICIES.join(', ')})`);
+      }
+      opts.consume = value;
+      opts.consumeSet = true;
+      i = next;
+    } else if (arg === '--prefer' || arg.startsWith('--prefer=')) {
+      const { value, next } = flagValue(args, i);
+      if (!PREFER_POLICIES.includes(value)) {
+        throw new Error(`invalid --prefer: ${value} (${PREFER_POLICIES.join(', ')})`);
+      }
+      opts.prefer = value;
+      opts.preferSet = true;
+      i = next;
+    } else if (arg === '--context' || arg.startsWith('--context=')) {
+      const { value, next } = flagValue(args, i);
+      const eq = value.indexOf('=');
+      if (eq <= 0) throw new Error(`--context needs KEY=VALUE: ${value}`);
+      opts.context[value.slice(0, eq)] = value.slice(eq + 1);
+      i = next;
+    } else if (arg === '--sort' || arg.startsWith('--sort=')) {
+      const { value, next } = flagValue(args, i);
+      opts.sort = sortOrder(value);
+      opts.sortSet = true;
+      i = next;
+    } else if (arg === '--group-burst') {
+      opts.groupBurst = true;
+    } else if (arg === '--burst-window' || arg.startsWith('--burst-window=')) {
+      const { value, next } = flagValue(args, i);
+      opts.burstWindowMs = parseDuration(value);
+      if (opts.burstWindowMs === null) throw new Error(`invalid --burst-window: ${value}`);
+      i = next;
+    } else if (arg === '--latency-budget' || arg.startsWith('--latency-budget=')) {
+      const { value, next } = flagValue(args, i);
+      opts.latencyBudgetMs = parseDuration(value);
+      if (!opts.latencyBudgetMs) throw new Error(`invalid --latency-budget: ${value}`);
+      i = next;
+    } else if (arg === '--max-clipboard-bytes' || arg.startsWith('--max-clipboard-bytes=')) {
+      const { value, next } = flagValue(args, i);
+      opts.maxClipboardBytes = parseSize(value);
+      if (!opts.maxClipboardBytes) throw new Error(`invalid --max-clipboard-bytes: ${value}`);
+      i = next;
+    } else if (arg === '--soft-timeout' || arg.startsWith('--soft-timeout=')) {
+      const { value, next } = flagValue(args, i);
+      opts.softTimeoutMs = parseDuration(value);
+      if (opts.softTimeoutMs === null) throw new Error(`invalid --soft-timeout: ${value}`);
+      i = next;
+    } else if (arg === '--detach-clipboard') {
+      opts.detachClipboard = true;
+    } else if (arg === '--listen' || arg.startsWith('--listen=')) {
+      const { value, next } = flagValue(args, i);
+      parseListen(value);
+      opts.listen = value;
+      i = next;
+    } else if (arg === '--udp-port' || arg.startsWith('--udp-port=')) {
+      const { value, next } = flagValue(args, i);
+      opts.udpPort = /^\d+$/.test(value) && Number(value) <= 65535 ? Number(value) : null;
+      if (opts.udpPort === null) throw new Error(`invalid --udp-port: ${value}`);
+      i = next;
+    } else if (arg === '--token' || arg.startsWith('--token=')) {
+      const { value, next } = flagValue(args, i);
+      opts.token = value;
+      i = next;
+    } else if (arg === '--assert' || arg.startsWith('--assert=')) {
+      const { value, next } = flagValue(args, i);
+      opts.assertions.push(...parseAssertions(value));
+      opts.assertSet = true;
+      i = next;
+    } else if (arg === '--audit' || arg.startsWith('--audit=')) {
+      const { value, next } = flagValue(args, i);
+      opts.audit = path.resolve(value);
+      i = next;
+    } else if (arg === '--wait' || arg.startsWith('--wait=')) {
+      // Only --wait=D takes a value, so `--wait PATH` still stages PATH.
+      opts.waitMs = arg === '--wait' ? 5 * 60 * 1000 : parseDuration(arg.slice('--wait='.length));
+      if (!opts.waitMs) throw new Error(`invalid --wait: ${arg.slice('--wait='.length)}`);
+    } else if (arg === '--select') {
+      opts.select = true;
+    } else if (arg === '--last') {
+      opts.restoreLast = true;
+    } else if (arg === '--list') {
+      opts.restoreList = true;
+    } else if (arg === '--stash') {
+      opts.stash = true;
+    } else if (arg === '--stash-ttl' || arg.startsWith('--stash-ttl=')) {
+      const { value, next } = flagValue(args, i);
+      opts.stashTtlMs = parseDuration(value);
+      if (!opts.stashTtlMs) throw new Error(`invalid --stash-ttl: ${value}`);
+      opts.stashTtlSet = true;
+      i = next;
+    } else if (arg === '--allow-stale-clipboard') {
+      opts.allowStaleClipboard = true;
+    } else if (arg === '--launcher') {
+      opts.launcher = true;
+    } else if (arg === '--format' || arg.startsWith('--format=')) {
+      const { value, next } = flagValue(args, i);
+      compileFormat(value);
+      opts.format = value;
+      i = next;
+    } else if (arg === '--trim-terminal') {
+      opts.trimTerminal = true;
+    } else if (arg === '--document') {
+      opts.document = true;
+    } else if (arg === '--bilevel') {
+      opts.document = true;
+      opts.bilevel = true;
+    } else if (arg === '--classify') {
+      opts.classify = true;
+    } else if (arg === '--quality') {
+      opts.quality = true;
+    } else if (arg === '--fast-decode') {
+      opts.fastDecode = true;
+    } else if (arg === '--min-quality' || arg.startsWith('--min-quality=')) {
+      const { value, next } = flagValue(args, i);
+      opts.assertions.push(...parseAssertions(`quality>=${value}`));
+      opts.minQualitySet = true;
+      i = next;
+    } else if (arg === '--display-info') {
+      opts.displayInfo = true;
+    } else if (arg === '--ext-from-content') {
+      opts.extFromContent = true;
+    } else if (arg === '--stdin') {
+      opts.stdin = true;
+    } else if (arg === '--sidecar') {
+      opts.sidecar = true;
+    } else if (arg === '--history') {
+      opts.history = true;
+    } else if (arg === '--dest' || arg.startsWith('--dest=')) {
+      const { value, next } = flagValue(args, i);
+      opts.dest = value;
+      i = next;
+    } else if (arg === '--seconds' || arg.startsWith('--seconds=')) {
+      const { value, next } = flagValue(args, i);
+      opts.replaySeconds = Number(value);
+      if (!(opts.replaySeconds > 0)) throw new Error(`invalid --seconds: ${value}`);
+      i = next;
+    } else if (arg === '--source' || arg.startsWith('--source=')) {
+      const { value, next } = flagValue(args, i);
+      if (value !== 'clipboard' && value !== 'file') throw new Error(`invalid --source: ${value} (clipboard, file)`);
+      opts.historySource = value;
+      i = next;
+    } else if (arg === '--sound' || arg.startsWith('--sound=')) {
+      if (arg.startsWith('--sound=')) {
+        opts.sound = arg.slice('--sound='.length);
+      } else if (i + 1 < args.length && SOUND_EXTS.has(path.extname(args[i + 1]).toLowerCase())) {
+        opts.sound = args[i + 1];
+        i += 1;
+      } else {
+        opts.sound = '';
+      }
+    } else if (arg === '--fail-stage' || arg.startsWith('--fail-stage=')) {
+      // Hidden: lets integrations exercise their error handling.
+      const { value, next } = flagValue(args, i);
+      for (const stage of splitList(value)) {
+        if (!FAIL_STAGES.has(stage)) throw new Error(`unknown stage: ${stage}`);
+        opts.failStages.add(stage);
+      }
+      i = next;
+    } else if (arg === '--gif') {
+      opts.gif = true;
+    } else if (arg === '--dry-run' || arg === '-n') {
+      opts.dryRun = true;
+    } else if (arg === '--out' || arg.startsWith('--out=')) {
+      const { value, next } = flagValue(args, i);
+      opts.out = value;
+      i = next;
+    } else if (arg === '--overwrite') {
+      opts.collision = 'overwrite';
+    } else if (arg === '--keep') {
+      opts.consume = 'keep';
+      opts.consumeSet = true;
+    } else if (arg === '--collision' || arg.startsWith('--collision=')) {
+      const { value, next } = flagValue(args, i);
+      if (!COLLISION_POLICIES.includes(value)) {
+        throw new Error(`invalid --collision: ${value} (${COLLISION_POLICIES.join(', ')})`);
+      }
+      opts.collision = value;
+      i = next;
+    } else if (arg === '--rasterize') {
+      opts.rasterize = true;
+    } else if (arg === '--rasterize-dpi' || arg.startsWith('--rasterize-dpi=')) {
+      const { value, next } = flagValue(args, i);
+      opts.rasterizeDpi = Number(value);
+      if (!Number.isFinite(opts.rasterizeDpi) || opts.rasterizeDpi <= 0) throw new Error(`invalid --rasterize-dpi: ${value}`);
+      opts.rasterizeDpiSet = true;
+      i = next;
+    } else if (arg === '--read-only') {
+      opts.readOnly = true;
+    } else if (arg === '--recency' || arg.startsWith('--recency=')) {
+      const { value, next } = flagValue(args, i);
+      opts.recencyMs = parseDuration(value);
+      if (opts.recencyMs === null) throw new Error(`invalid --recency: ${value}`);
+      opts.recencySet = true;
+      i = next;
+    } else if (arg === '--replace-clipboard' || arg === '--to-clipboard') {
+      opts.replaceClipboard = true;
+    } else if (arg === '--ocr') {
+      opts.ocr = true;
+    } else if (arg === '--links') {
+      opts.ocr = true;
+      opts.links = true;
+    } else if (arg === '--copy-links') {
+      opts.ocr = true;
+      opts.links = true;
+      opts.copyLinks = true;
+    } else if (arg === '--upload' || arg.startsWith('--upload=')) {
+      const { value, next } = flagValue(args, i);
+      opts.upload = value;
+      i = next;
+    } else if (arg === '--url-format' || arg.startsWith('--url-format=')) {
+      const { value, next } = flagValue(args, i);
+      opts.urlFormat = value;
+      i = next;
+    } else if (arg === '--ca-cert' || arg.startsWith('--ca-cert=')) {
+      const { value, next } = flagValue(args, i);
+      opts.caCert = path.resolve(value);
+      i = next;
+    } else if (arg === '--deliver' || arg.startsWith('--deliver=')) {
+      const { value, next } = flagValue(args, i);
+      opts.deliver = splitList(value);
+      opts.deliverSet = true;
+      i = next;
+    } else if (arg === '--copy-url') {
+      opts.copyUrl = true;
+    } else if (arg === '--ocr-engine' || arg.startsWith('--ocr-engine=')) {
+      const { value, next } = flagValue(args, i);
+      opts.ocrEngine = checkOcrEngine(value, '--ocr-engine');
+      i = next;
+    } else if (arg === '--ocr-lang' || arg.startsWith('--ocr-lang=')) {
+      const { value, next } = flagValue(args, i);
+      opts.ocrLangs = parseOcrLangs(value, '--ocr-lang');
+      i = next;
     } else if (arg === '--verbose' || arg === '-v') {
       opts.verbose = true;
     } else if (arg === '--help' || arg === '-h' || arg === '-help') {
       opts.help = true;
+    } else if (arg === '--version') {
+      opts.version = true;
+    } else if (arg === '--json') {
+      opts.json = true;
+    } else if (arg === '--output-version' || arg.startsWith('--output-version=')) {
+      const { value, next } = flagValue(args, i);
+      opts.outputVersion = outputVersion(value);
+      i = next;
+    } else if (!arg.startsWith('-')) {
+      opts.command.push(arg);
     } else {
       throw new Error(`unknown flag: ${arg}`);
     }
   }
+  if (opts.command[0] === 'get') {
+    // `get [PATH]` is the bare invocation spelled out.
+    if (opts.command.length > 2) {
+      throw new Error('usage: get [PATH]');
+    }
+    opts.inputPath = opts.command[1] || '';
+    opts.command = [];
+  }
+  if (opts.command[0] === 'restore') {
+    const picks = [Boolean(opts.command[1]), opts.restoreLast, opts.restoreList].filter(Boolean).length;
+    if (opts.command.length > 2 || picks > 1) {
+      throw new Error('usage: restore [--last | ID | --list]');
+    }
+    opts.restoreId = opts.command[1] || '';
+    opts.command = ['restore'];
+  }
+  if (opts.command[0] === 'stash' && opts.command[1] === 'restore') {
+    if (opts.command.length > 3 || (opts.command[2] && opts.restoreLast)) {
+      throw new Error('usage: stash restore [--last | ID]');
+    }
+    opts.restoreId = opts.command[2] || '';
+    opts.command = ['stash', 'restore'];
+  }
+  if (opts.command[0] === 'migrate') {
+    if (opts.command.length !== 3) {
+      throw new Error('usage: migrate SRC DST');
+    }
+    [opts.migrateSrc, opts.migrateDst] = opts.command.slice(1);
+    opts.command = ['migrate'];
+  }
+  if (opts.command[0] === 'history' && opts.command[1] === 'search') {
+    if (opts.command.length !== 3) {
+      throw new Error('usage: history search QUERY');
+    }
+    opts.query = opts.command[2];
+    opts.command = ['history', 'search'];
+  }
+  if (opts.command[0] === 'secrets') {
+    if (opts.command.length !== 3 || !['set', 'delete'].includes(opts.command[1])) {
+      throw new Error('usage: secrets set|delete NAME');
+    }
+    opts.secretName = opts.command[2];
+    opts.command = opts.command.slice(0, 2);
+  }
+  if (opts.command[0] === 'editor-protocol') {
+    const replaced = args.find((arg) => EDITOR_FLAGS.has(arg.split('=')[0]));
+    if (replaced) {
+      throw new Error(`editor-protocol: ${replaced.split('=')[0]} is replaced by the request; put options there`);
+    }
+    if (opts.command.length !== 1) throw new Error('usage: editor-protocol (request on stdin)');
+  }
+  if (opts.command[0] === 'compare') {
+    if (opts.command.length !== 2) {
+      throw new Error('usage: compare BASELINE');
+    }
+    opts.baseline = opts.command[1];
+    opts.command = ['compare'];
+  }
+  if (opts.command.length === 1 && ![...COMMANDS].some((command) => command.split(' ')[0] === opts.command[0])) {
+    opts.inputPath = opts.command[0];
+    opts.command = [];
+  }
+  if (opts.command.length > 0 && !COMMANDS.has(opts.command.join(' '))) {
+    throw new Error(`unknown command: ${opts.command.join(' ')}`);
+  }
+  if (opts.out && opts.groupBurst) {
+    throw new Error('--out names a single file and cannot be combined with --group-burst');
+  }
   return opts;
 }
 
+function flagValue(args, i) {
+  const arg = args[i];
+  const eq = arg.indexOf('=');
+  if (arg.startsWith('--') && eq !== -1) {
+    return { value: arg.slice(eq + 1), next: i };
+  }
+  if (i + 1 >= args.length) {
+    throw new Error(`flag needs an argument: ${arg}`);
+  }
+  return { value: args[i + 1], next: i + 1 };
+}
+
+function sortOrder(value) {
+  if (value !== 'btime' && value !== 'mtime') {
+    throw new Error(`invalid sort: ${value} (want btime or mtime)`);
+  }
+  return value;
+}
+
+function parseExtensions(list) {
+  const exts = list.map((item) => item.toLowerCase().replace(/^\./, ''));
+  if (exts.length === 0 || exts.some((ext) => !/^[a-z0-9]+$/.test(ext))) return null;
+  return exts;
+}
+
+function splitList(value) {
+  return String(value)
+    .split(',')
+    .map((item) => item.trim())
+    .filter(Boolean);
+}
+
 function printUsage(stream) {
-  stream.write('usage: screenshot-agent [options]\n\n');
-  stream.write('Print two lines: source (clipboard or original file path) and\n');
-  stream.write('the temp path of a PNG/JPG/JPEG image from Desktop or Downloads.\n');
+  stream.write('usage: screenshot-agent [get] [options] [PATH]\n');
+  stream.write('       screenshot-agent COMMAND [options]\n\n');
+  stream.write('get (the default) prints two lines: source (clipboard or original file path) and\n');
+  stream.write('the temp path of an image (PNG, JPEG, WebP, HEIC, ...) from Desktop or Downloads.\n');
   stream.write('Desktop files are copied to temp and trashed; Downloads are moved.\n');
+  stream.write('With PATH, that image is staged (copied, never consumed) instead.\n');
   stream.write('Exits 1 if nothing is found.\n\n');
+  stream.write('commands:\n');
+  stream.write('  get [PATH]           stage the newest screenshot (the default when no command is given)\n');
+  stream.write('  capture              take a new screenshot (full screen, or --select a region) and stage it\n');
+  stream.write('  clean --older-than D\n');
+  stream.write('                       trash Desktop/Downloads screenshots older than D (e.g. 30d)\n');
+  stream.write('  capabilities         report supported and available backends (--json for machine use)\n');
+  stream.write('  clipboard inspect    list every clipboard format with size and preview\n');
+  stream.write('  compare BASELINE     diff the screenshot against BASELINE; exits 3 on mismatch\n');
+  stream.write('  daemon               keep the newest Desktop (or --downloads) file staged for daemon get\n');
+  stream.write('  daemon get           take the file staged by a running daemon\n');
+  stream.write('  daemon poke          make a running daemon re-scan now (as does SIGUSR1)\n');
+  stream.write('  editor-protocol      read one JSON request on stdin, write one JSON response\n');
+  stream.write('  export --from T [--to T] --dest DIR\n');
+  stream.write('                       copy screenshots captured between two times into DIR\n');
+  stream.write('  history [search Q]   list recorded results, or those matching Q (paths, context, OCR, sha256)\n');
+  stream.write('  history ocr-backfill OCR recorded images that have no text yet (resumable)\n');
+  stream.write('  init                 detect this machine and write a starter config interactively\n');
+  stream.write('  migrate SRC DST      move screenshot-named images from SRC into DST\n');
+  stream.write('  replay start         (experimental) keep a rolling screen recording via ffmpeg\n');
+  stream.write('  replay save          stage the last --seconds of the recording (MP4, or --gif)\n');
+  stream.write('  restore [--last | ID | --list]\n');
+  stream.write('                       put back a file a run trashed or moved (default: the last one), or list them\n');
+  stream.write('  schema [result|event]\n');
+  stream.write('                       print the JSON Schema for --json output\n');
+  stream.write('  secrets set|delete NAME\n');
+  stream.write('                       store (from stdin) or remove a delivery secret in the OS keychain\n');
+  stream.write('  serve                HTTP API: GET /latest (image bytes), GET /latest/meta (JSON)\n');
+  stream.write('  serve-mcp            serve screenshot tools over the Model Context Protocol on stdio\n');
+  stream.write('  stash [restore [--last | ID]]\n');
+  stream.write('                       list files --stash set aside, or put one back (default: the last one)\n');
+  stream.write('  trash [purge --older-than D]\n');
+  stream.write('                       report (or permanently delete) trash items this tool put there\n');
+  stream.write('  watch                stage each new screenshot or clipboard image as it appears\n\n');
   stream.write('options:\n');
   stream.write('  -h, -help, --help    show this help and exit\n');
+  stream.write('  --all-sources        search Desktop and Downloads (and any --dir) together; newest wins\n');
+  stream.write('  --allow-stale-clipboard\n');
+  stream.write('                       use a long-unchanged clipboard image (see stale_clipboard_after) without warning\n');
+  stream.write('  --assert LIST        check the result, e.g. width>=800,format==png; exits 4 on failure\n');
+  stream.write('  --audit FILE         append every consume, trash, upload, and deletion to FILE as JSON lines\n');
+  stream.write('  --bilevel            --document, then reduce to black and white\n');
+  stream.write('  --burst-window D     --group-burst: max gap between shots in a burst (default 5s)\n');
+  stream.write('  --ca-cert FILE       also trust the PEM certificates in FILE for deliveries\n');
+  stream.write('  --cache DURATION     reuse the last staged result for repeated calls within DURATION\n');
+  stream.write('  --chmod MODE         mode for files written by --out, export, and migrate (e.g. 640)\n');
+  stream.write('  --chown USER[:GROUP] owner for those files and created directories, where permitted\n');
+  stream.write('  --classify           tag the image as code, terminal, browser, chart, or photo\n');
+  stream.write('  --clipboard-backend LIST\n');
+  stream.write('                       clipboard backends to try, in order (pngpaste,osascript,osascript-tiff,\n');
+  stream.write('                       osascript-vector,wl-paste,xclip,powershell; history: maccy,copyq)\n');
   stream.write('  --clipboard-only      use clipboard only (no file fallback)\n');
+  stream.write('  --copy-links         --links, and put the URLs on the clipboard as text\n');
+  stream.write('  --copy-url           --upload/--deliver: put the share link on the clipboard as text\n');
+  stream.write('  --cloud-wait D       wait up to D for online-only synced files to download\n');
+  stream.write('  --collision rename|overwrite|fail|skip\n');
+  stream.write('                       when --out, --diff, export, or migrate targets exist\n');
+  stream.write('                       (default fail for --out and --diff, else rename)\n');
+  stream.write('  --config PATH        config file (default ~/.config/screenshot-agent/config.toml)\n');
+  stream.write('  --consume auto|strict|keep\n');
+  stream.write('                       after staging a file: consume it (falling back to copy), require that, or keep it\n');
+  stream.write('  --context KEY=VALUE  attach workflow context (repeatable; filters history)\n');
+  stream.write('  --dest DIR           export: destination directory\n');
+  stream.write('  --deliver LIST       send the result to these [targets.NAME] from the config, all at once\n');
+  stream.write('  --detach-clipboard   run clipboard writers detached so one-shot runs exit at once\n');
+  stream.write('  --diff PATH          compare: where to write the diff image (default temp)\n');
+  stream.write('  --dir PATH           also search PATH for screenshots (repeatable; dirs in config)\n');
+  stream.write('  --dir-mode MODE      mode for directories those commands create (e.g. 750)\n');
+  stream.write('  --dirs-only          search only the --dir directories, not Desktop/Downloads\n');
+  stream.write('  --display-info       --json: name the display a full-screen capture came from\n');
+  stream.write('  --document           receipts/paper photos: deskew, grayscale, boost contrast\n');
   stream.write('  --downloads          search Downloads instead of Desktop\n');
+  stream.write('  -n, --dry-run        clean/migrate/export: list what would happen; init: print the config\n');
+  stream.write('  --ext LIST           file extensions to scan, replacing the default\n');
+  stream.write('                       (png,jpg,jpeg,webp,gif,heic,heif,tiff,tif,bmp,avif)\n');
+  stream.write('  --ext-from-content   name staged files after their detected format, not their extension\n');
+  stream.write('  --fast-decode        decode pixels with libvips or ImageMagick instead of the built-in PNG codec\n');
+  stream.write('  --format TEMPLATE    print fields via a Go-style template, e.g. \'{{.TempPath}}\\t{{.Source}}\'\n');
+  stream.write('  --from T, --to T     export, history: time window (RFC3339/date, or an age like 2h)\n');
+  stream.write('  --fuzz N             compare: per-channel difference to ignore, 0-255 (default 8)\n');
+  stream.write('  --gif                replay save: encode a GIF instead of MP4\n');
+  stream.write('  --group-burst        also stage earlier screenshots taken in the same burst\n');
+  stream.write('  --history            record the result in the history log\n');
+  stream.write('  -j, --jobs N         export, history ocr-backfill: items to process at once (default: CPU count)\n');
+  stream.write('  --json               emit a JSON result object instead of two lines\n');
+  stream.write('  --keep               copy the file to temp and leave the original in place (--consume keep)\n');
+  stream.write('  --older-than D       clean, trash purge: age threshold (30s, 10m, 2h, 30d, 1w)\n');
+  stream.write('  --launcher           list recent screenshots as Alfred/Raycast/Albert script-filter JSON\n');
+  stream.write('  --latency-budget D   try the usual source first; skip the rest if it answers within D\n');
+  stream.write('  --links              OCR the image and print the URLs in it after the result\n');
+  stream.write('  --learn-names        treat name patterns of files picked before as screenshot names\n');
+  stream.write('  --listen HOST:PORT   serve: address to listen on (default 127.0.0.1:8765)\n');
+  stream.write('  --max-clipboard-bytes SIZE\n');
+  stream.write('                       ignore clipboard images larger than SIZE (e.g. 20M) and use files\n');
+  stream.write('  --min-quality N      --quality, and exit 4 (like --assert) when the score is below N (0-100)\n');
+  stream.write('  --new-only           exit 1 rather than return the image the last run returned\n');
+  stream.write('  --ocr                recognize text and include it as ocrText\n');
+  stream.write('  --ocr-engine NAME    OCR with vision (macOS), windows, or tesseract (default: best available)\n');
+  stream.write('  --ocr-lang LIST      OCR languages, most likely first (e.g. de+en)\n');
+  stream.write('  --offline            no uploads, network deliveries, or cloud downloads (also offline in config)\n');
+  stream.write('  --out PATH           write the result to PATH instead of a temp file\n');
+  stream.write('  --output-version N   pin the stdout format version (1: two lines / schema v1)\n');
+  stream.write('  --overwrite          same as --collision overwrite\n');
+  stream.write('  --prefer auto|clipboard|file|newest\n');
+  stream.write('                       which source wins when both have an image (auto: a file within --recency)\n');
+  stream.write('  --profile NAME       apply the [profiles.NAME] table of the config over its top-level keys\n');
+  stream.write('  --quality            score sharpness and blankness (0-100) and include it as quality\n');
+  stream.write('  --rasterize          also consider .svg and single-page .pdf files, staged as PNG\n');
+  stream.write('  --rasterize-dpi N    --rasterize resolution (default 144)\n');
+  stream.write('  --read-only          never trash, move, or overwrite anything (also read_only in config)\n');
+  stream.write('  --recency D          how new a file must be to win over a clipboard image (default 30s)\n');
+  stream.write('  --replace-clipboard, --to-clipboard\n');
+  stream.write('                       put the staged image (and OCR text) on the clipboard\n');
+  stream.write('  --report-backlog     report how many images pile up in Desktop/Downloads\n');
+  stream.write('  --screenshot-pattern RE\n');
+  stream.write('                       also count file names matching RE as screenshots (repeatable)\n');
+  stream.write('  --select             capture: let the user pick a region or window\n');
+  stream.write('  --seconds N          replay: seconds to keep/save (default 10)\n');
+  stream.write('  --sidecar            write TEMP_PATH.json with the result metadata\n');
+  stream.write('  --source KIND        history: only clipboard or file results\n');
+  stream.write('  --sound [FILE]       play a confirmation sound when a result resolves\n');
+  stream.write('  --soft-timeout D     return the best result so far once D elapses\n');
+  stream.write('  --sort btime|mtime   order candidates by creation or modification time\n');
+  stream.write('  --stash              set consumed Desktop files aside in the state directory instead of the trash\n');
+  stream.write('  --stash-ttl D        how long stashed files are kept before they are deleted (default 7d)\n');
+  stream.write('  --stdin              read the image bytes from stdin (e.g. piped from grim or maim)\n');
+  stream.write('  --token T            serve: require this bearer token (and allow cross-origin reads)\n');
+  stream.write('  --tolerance PCT      compare: share of pixels allowed to differ (default 0%)\n');
+  stream.write('  --udp-port N         serve: also answer "resolve" datagrams on UDP port N with the JSON result\n');
+  stream.write('  --trim-terminal      crop window chrome and uniform padding from terminal shots\n');
+  stream.write('  --upload URL         PUT the staged image to URL ({key}, {name}, {sha256}, {ext} filled in)\n');
+  stream.write('  --url-format T       --upload: build the share link from T (adds {url}, the upload\'s answer)\n');
   stream.write('  -v, --verbose         verbose logging to stderr\n');
+  stream.write('  --version            print version and exit\n');
+  stream.write('  --wait[=D]           when nothing is found, wait up to D (default 5m) for one to appear\n');
 }
 
-async function run(opts) {
-  const clipboardResult = await readClipboardImage().catch((err) => err);
-  if (opts.clipboardOnly) {
-    if (clipboardResult && clipboardResult.data) {
-      log(opts, 'selected clipboard candidate (clipboard-only)');
-      return handleClipboardCandidate(clipboardResult);
+async function runCommand(opts) {
+  switch (opts.command.join(' ')) {
+    case 'capabilities':
+      return runCapabilities(opts);
+    case 'capture':
+      return runCapture(opts);
+    case 'clean':
+      return runClean(opts);
+    case 'clipboard inspect':
+      return runClipboardInspect(opts);
+    case 'compare':
+      return runCompare(opts);
+    case 'daemon':
+      return runDaemon(opts);
+    case 'editor-protocol':
+      return runEditorProtocol(opts);
+    case 'export':
+      return runExport(opts);
+    case 'daemon get':
+      return runGet(opts);
+    case 'daemon poke':
+      return runPoke(opts);
+    case 'history ocr-backfill':
+      return runOcrBackfill(opts);
+    case 'history':
+    case 'history search':
+      return runHistory(opts);
+    case 'init':
+      return runInit(opts);
+    case 'migrate':
+      return runMigrate(opts);
+    case 'replay start':
+      return runReplayStart(opts);
+    case 'replay save':
+      return runReplaySave(opts);
+    case 'stash':
+      return runStashList(opts);
+    case 'stash restore':
+      return runStashRestore(opts);
+    case 'restore':
+      return runRestore(opts);
+    case 'trash':
+      return runTrashReport(opts);
+    case 'trash purge':
+      return runTrashPurge(opts);
+    case 'schema':
+    case 'schema result':
+      process.stdout.write(JSON.stringify(RESULT_SCHEMA, null, 2) + '\n');
+      return 0;
+    case 'secrets set':
+      return runSecretsSet(opts);
+    case 'secrets delete':
+      return runSecretsDelete(opts);
+    case 'serve':
+      return runServe(opts);
+    case 'serve-mcp':
+      return runServeMcp(opts);
+    case 'watch':
+      return runWatch(opts);
+    case 'schema event':
+      process.stdout.write(JSON.stringify(EVENT_SCHEMA, null, 2) + '\n');
+      return 0;
+    default:
+      throw new Error(`unknown command: ${opts.command.join(' ')}`);
+  }
+}
+
+async function runClean(opts) {
+  if (!opts.dryRun) assertWritable(opts, 'clean');
+  if (opts.olderThanMs === null) {
+    throw new Error('clean needs --older-than DURATION');
+  }
+  const cutoff = Date.now() - opts.olderThanMs;
+  let count = 0;
+  let bytes = 0;
+  // The capture tools' own folders are where screenshots are kept, not a
+  // staging area, so clean leaves them alone.
+  for (const source of (await knownSources()).filter((item) => item.label !== 'Screenshots')) {
+    const images = await listImages(source.dir, source.label, opts).catch(() => []);
+    for (const image of images) {
+      if (!image.tagged || captureTime(image, opts.sort) > cutoff) continue;
+      if (!opts.dryRun) {
+        try {
+          await discardFile(image, opts);
+        } catch (err) {
+          process.stderr.write(`${image.path}: ${err.message || String(err)}\n`);
+          continue;
+        }
+      }
+      process.stdout.write(textPath(image.path) + '\n');
+      count += 1;
+      bytes += image.size;
     }
-    if (clipboardResult && clipboardResult.code !== ERR_NOT_FOUND) {
-      throw clipboardResult;
+  }
+  process.stderr.write(`${opts.dryRun ? 'would trash' : 'trashed'} ${count} screenshots (${formatBytes(bytes)})\n`);
+  return 0;
+}
+
+async function runExport(opts) {
+  if (opts.fromMs === null || !opts.dest) {
+    throw new Error('export needs --from TIME and --dest DIR');
+  }
+  const toMs = opts.toMs === null ? Date.now() : opts.toMs;
+  const dest = path.resolve(opts.dest);
+  const images = [];
+  for (const source of await knownSources()) {
+    for (const image of await listImages(source.dir, source.label, opts).catch(() => [])) {
+      image.timeMs = captureTime(image, opts.sort);
+      if (image.tagged && image.timeMs >= opts.fromMs && image.timeMs <= toMs) {
+        images.push(image);
+      }
     }
-    return null;
   }
+  images.sort((a, b) => a.timeMs - b.timeMs);
+  if (!opts.dryRun && images.length > 0) {
+    await makeDirs(dest, opts);
+  }
+  // Every target is chosen, in capture order, before any copy starts, so the
+  // names picked so far are reserved: two sources holding the same file name
+  // must not land on one target.
+  const reserved = new Set();
+  const copies = [];
+  for (const image of images) {
+    const name = path.join(dest, path.basename(image.path));
+    const target = await placeTarget(name, opts.collision || 'rename', opts, reserved);
+    if (!target) {
+      process.stderr.write(`skipped: ${name} already exists\n`);
+      continue;
+    }
+    copies.push({ image, target });
+  }
+  if (!opts.dryRun) {
+    await mapPool(copies, jobCount(opts), async ({ image, target }) => {
+      await copyFile(fsPathOf(image), target);
+      await fsp.utimes(target, new Date(), new Date(image.modTimeMs));
+      await applyPermissions(target, opts, false);
+    });
+  }
+  for (const { target } of copies) {
+    process.stdout.write(textPath(target) + '\n');
+  }
+  process.stderr.write(`${opts.dryRun ? 'would export' : 'exported'} ${copies.length} screenshots\n`);
+  return 0;
+}
+
+async function runMigrate(opts) {
+  if (!opts.dryRun) assertWritable(opts, 'migrate');
+  const src = path.resolve(opts.migrateSrc);
+  const dst = path.resolve(opts.migrateDst);
+  if (!(await isDir(src))) {
+    throw new Error(`not a directory: ${src}`);
+  }
+  if (!opts.dryRun) {
+    await makeDirs(dst, opts);
+  }
+  const images = await listImages(src, path.basename(src), opts);
+  images.sort((a, b) => a.modTimeMs - b.modTimeMs);
+  let count = 0;
+  for (const image of images) {
+    if (!image.tagged) continue;
+    const dest = await placeTarget(path.join(dst, path.basename(image.path)), opts.collision || 'rename', opts);
+    if (!dest) {
+      process.stderr.write(`skipped: ${path.join(dst, path.basename(image.path))} already exists\n`);
+      continue;
+    }
+    if (!opts.dryRun) {
+      try {
+        await moveFile(fsPathOf(image), dest);
+        await applyPermissions(dest, opts, false);
+      } catch (err) {
+        process.stderr.write(`${image.path}: ${err.message || String(err)}\n`);
+        continue;
+      }
+    }
+    process.stdout.write(`${textPath(image.path)} -> ${textPath(dest)}\n`);
+    count += 1;
+  }
+  process.stderr.write(`${opts.dryRun ? 'would move' : 'moved'} ${count} screenshots\n`);
+  return 0;
+}
+
+async function runHistory(opts) {
+  const query = opts.query.toLowerCase();
+  const fromMs = opts.fromMs === null ? -Infinity : opts.fromMs;
+  const toMs = opts.toMs === null ? Infinity : opts.toMs;
+  const entries = (await readHistory()).filter((entry) => {
+    if (opts.historySource && entry.source !== opts.historySource) return false;
+    const timeMs = Date.parse(entry.time);
+    if (timeMs < fromMs || timeMs > toMs) return false;
+    const context = entry.context || {};
+    for (const [key, value] of Object.entries(opts.context)) {
+      if (context[key] !== value) return false;
+    }
+    if (!query) return true;
+    const haystack = [
+      entry.originalPath || '',
+      entry.tempPath,
+      entry.ocrText || '',
+      entry.sha256 || '',
+      ...Object.entries(context).map(([k, v]) => `${k}=${v}`),
+    ];
+    return haystack.some((text) => text.toLowerCase().includes(query));
+  });
+  for (const entry of entries) {
+    if (opts.json) {
+      process.stdout.write(JSON.stringify(entry) + '\n');
+      continue;
+    }
+    const context = Object.entries(entry.context || {})
+      .map(([key, value]) => `${key}=${value}`)
+      .join(',');
+    process.stdout.write(`${entry.time}\t${entry.originalPath || 'clipboard'}\t${entry.tempPath}\t${context}\n`);
+  }
+  return entries.length > 0 ? 0 : 1;
+}
+
+// runOcrBackfill recognizes text for history entries recorded without
+// --ocr, using the staged file (or the original, if it is still there).
+// Each result is appended to ocr-index.jsonl as soon as it is known, so an
+// interrupted run resumes where it stopped; readHistory merges the index
+// into the entries. Images that fail OCR are recorded too and not retried.
+async function runOcrBackfill(opts) {
+  const done = await readOcrIndex();
+  const pending = (await readHistory()).filter((entry) => entry.ocrText === undefined && !done.has(ocrKey(entry)));
+  if (pending.length === 0) {
+    process.stderr.write('nothing to backfill\n');
+    return 0;
+  }
+  if (!opts.dryRun) {
+    ocrEngineFor(opts);
+  }
+  let recognized = 0;
+  let missing = 0;
+  let failed = 0;
+  await mapPool(pending, opts.dryRun ? 1 : jobCount(opts), async (entry, index) => {
+    const file = [entry.tempPath, entry.originalPath].find((item) => item && fs.existsSync(item));
+    const label = `[${index + 1}/${pending.length}] ${textPath(file || entry.tempPath)}`;
+    if (!file) {
+      process.stderr.write(`${label}: gone\n`);
+      missing += 1;
+      return;
+    }
+    if (opts.dryRun) {
+      process.stderr.write(`${label}\n`);
+      return;
+    }
+    const record = { key: ocrKey(entry) };
+    try {
+      record.ocrText = (await ocrImage(file, opts)).text;
+      process.stderr.write(`${label}: ${record.ocrText.length} characters\n`);
+      recognized += 1;
+    } catch (err) {
+      record.error = err.message || String(err);
+      process.stderr.write(`${label}: ${record.error}\n`);
+      failed += 1;
+    }
+    await fsp.appendFile(ocrIndexPath(), JSON.stringify(record) + '\n', { mode: 0o600 });
+  });
+  if (opts.dryRun) {
+    process.stderr.write(`would recognize ${pending.length - missing} images (${missing} gone)\n`);
+  } else {
+    process.stderr.write(`recognized ${recognized} images, ${failed} failed, ${missing} gone\n`);
+  }
+  return 0;
+}
+
+// jobCount is how many batch items run at once: --jobs, or one per CPU.
+function jobCount(opts) {
+  return opts.jobs || Math.max(1, os.cpus().length);
+}
+
+// mapPool calls fn on every item with at most jobs calls in flight and
+// returns the results in input order.
+async function mapPool(items, jobs, fn) {
+  const results = new Array(items.length);
+  let next = 0;
+  const worker = async () => {
+    while (next < items.length) {
+      const index = next;
+      next += 1;
+      results[index] = await fn(items[index], index);
+    }
+  };
+  await Promise.all(Array.from({ length: Math.min(jobs, items.length) }, worker));
+  return results;
+}
+
+function ocrIndexPath() {
+  return path.join(stateDir(), 'ocr-index.jsonl');
+}
+
+function ocrKey(entry) {
+  return `${entry.time}\0${entry.tempPath}`;
+}
+
+// readOcrIndex maps history keys to backfilled records.
+async function readOcrIndex() {
+  const index = new Map();
+  let data;
+  try {
+    data = await fsp.readFile(ocrIndexPath(), 'utf8');
+  } catch (err) {
+    if (err && err.code === 'ENOENT') return index;
+    throw err;
+  }
+  for (const line of splitLines(data)) {
+    try {
+      const record = JSON.parse(line);
+      index.set(record.key, record);
+    } catch (err) {
+      // skip torn lines
+    }
+  }
+  return index;
+}
+
+async function runCapabilities(opts) {
+  const report = capabilities();
+  if (opts.json) {
+    process.stdout.write(JSON.stringify(report, null, 2) + '\n');
+    return 0;
+  }
+  process.stdout.write(`screenshot-agent ${report.version} (${report.platform}/${report.arch}, node ${report.node})\n`);
+  for (const [name, capability] of Object.entries(report.capabilities)) {
+    const state = !capability.supported ? 'unsupported' : capability.available ? 'available' : 'missing';
+    process.stdout.write(`${name}: ${state}\n`);
+    for (const backend of capability.backends) {
+      const backendState = !backend.supported ? 'unsupported' : backend.available ? 'available' : 'missing';
+      process.stdout.write(`  ${backend.name}: ${backendState}\n`);
+    }
+  }
+  return 0;
+}
+
+function capabilities() {
+  const backendReport = (backends) =>
+    backends.map((backend) => {
+      const supported = backend.platforms.includes(process.platform);
+      return { name: backend.name, supported, available: supported && backend.available() };
+    });
+  const capability = (backends) => ({
+    supported: backends.some((backend) => backend.supported),
+    available: backends.some((backend) => backend.available),
+    backends,
+  });
+  const trashSupported = Boolean(TRASH_IMPLEMENTATIONS[process.platform]);
+  return {
+    version: VERSION,
+    platform: process.platform,
+    arch: process.arch,
+    node: process.versions.node,
+    capabilities: {
+      clipboard: capability(backendReport(CLIPBOARD_BACKENDS)),
+      trash: capability([{ name: process.platform, supported: trashSupported, available: trashSupported }]),
+      capture: capability(backendReport(CAPTURE_BACKENDS)),
+      ocr: capability(backendReport(OCR_ENGINES)),
+      replay: capability(backendReport(REPLAY_SOURCES)),
+      rasterize: capability(backendReport(RASTERIZERS)),
+      marker: capability(backendReport(MARKER_WRITERS)),
+      decode: capability(backendReport(DECODERS)),
+      secrets: capability(backendReport(SECRET_STORES)),
+    },
+  };
+}
+
+async function runCompare(opts) {
+  const baseline = await decodeImage(opts.baseline, opts);
+  // A check only looks at the screenshot, so it is copied and left in place.
+  const result = await run({ ...opts, consume: 'keep' });
+  if (!result) return 1;
+  const actual = await decodeImage(result.tempPath, opts);
+  const diff = diffImages(baseline, actual, opts.fuzz);
+  let diffPath = opts.diffPath ? path.resolve(opts.diffPath) : await tempPath('diff-XXXXXX.png');
+  if (opts.diffPath) {
+    const target = await placeTarget(diffPath, opts.collision || 'fail', opts);
+    if (!target) process.stderr.write(`skipped: ${diffPath} already exists\n`);
+    diffPath = target;
+  }
+  if (diffPath) await fsp.writeFile(diffPath, encodePng(diff.image));
+  const ratio = diff.total ? diff.different / diff.total : 1;
+  const match = diff.sameSize && ratio <= opts.tolerance;
+  const report = {
+    match,
+    baseline: path.resolve(opts.baseline),
+    tempPath: result.tempPath,
+    source: result.source,
+    differentPixels: diff.different,
+    totalPixels: diff.total,
+    sizeMismatch: !diff.sameSize,
+    diffPath,
+  };
+  if (opts.json) {
+    process.stdout.write(JSON.stringify(report) + '\n');
+  } else {
+    process.stdout.write(`${match ? 'match' : 'mismatch'}\n`);
+    if (!diff.sameSize) {
+      process.stdout.write(
+        `size: baseline ${baseline.width}x${baseline.height}, screenshot ${actual.width}x${actual.height}\n`,
+      );
+    }
+    process.stdout.write(`different: ${diff.different} of ${diff.total} pixels (${(ratio * 100).toFixed(3)}%)\n`);
+    if (diffPath) process.stdout.write(`diff: ${diffPath}\n`);
+  }
+  return match ? 0 : EXIT_MISMATCH;
+}
+
+// EDITOR_OPTIONS maps editor-protocol request options to the opts fields
+// the equivalent flags set, with the JSON type each must have.
+const EDITOR_OPTIONS = {
+  path: ['inputPath', 'string'],
+  clipboardOnly: ['clipboardOnly', 'boolean'],
+  downloads: ['useDownloads', 'boolean'],
+  allSources: ['allSources', 'boolean'],
+  readOnly: ['readOnly', 'boolean'],
+  consume: ['consume', 'string'],
+  prefer: ['prefer', 'string'],
+  out: ['out', 'string'],
+  collision: ['collision', 'string'],
+  ocr: ['ocr', 'boolean'],
+  classify: ['classify', 'boolean'],
+  quality: ['quality', 'boolean'],
+  document: ['document', 'boolean'],
+  bilevel: ['bilevel', 'boolean'],
+  trimTerminal: ['trimTerminal', 'boolean'],
+  rasterize: ['rasterize', 'boolean'],
+  history: ['history', 'boolean'],
+  newOnly: ['newOnly', 'boolean'],
+};
+
+// EDITOR_FLAGS are the flags a request stands in for: those behind
+// EDITOR_OPTIONS and the output format, which is always the JSON response.
+// The rest, such as --config, --profile, and -v, still apply.
+const EDITOR_FLAGS = new Set([
+  '--all-sources',
+  '--bilevel',
+  '--classify',
+  '--clipboard-only',
+  '--collision',
+  '--consume',
+  '--document',
+  '--downloads',
+  '--format',
+  '--history',
+  '--json',
+  '--keep',
+  '--new-only',
+  '--ocr',
+  '--out',
+  '--output-version',
+  '--overwrite',
+  '--prefer',
+  '--quality',
+  '--rasterize',
+  '--read-only',
+  '--stdin',
+  '--trim-terminal',
+]);
+
+// runEditorProtocol serves editor plugins: one request object
+// {"id"?, "options"?} on stdin, one response {"id", "ok", "result"|"error"}
+// on stdout, and nothing else there. The exit code still follows the usual
+// 0 found / 1 nothing found / 2 error convention.
+async function runEditorProtocol(opts) {
+  let id = null;
+  const respond = (code, body) => {
+    process.stdout.write(JSON.stringify({ id, ...body }) + '\n');
+    return code;
+  };
+  const fail = (code, err) =>
+    respond(code === 'not_found' ? 1 : 2, { ok: false, error: { code, message: err.message || String(err) } });
+  let request;
+  try {
+    request = JSON.parse((await readStdin()).toString('utf8'));
+    if (!request || typeof request !== 'object' || Array.isArray(request)) {
+      throw new Error('request must be a JSON object');
+    }
+    id = request.id === undefined ? null : request.id;
+    applyEditorOptions(opts, request.options || {});
+  } catch (err) {
+    return fail('invalid_request', err);
+  }
+  try {
+    const result = await run(opts);
+    if (!result) {
+      if (opts.outSkipped) return respond(0, { ok: true, skipped: true });
+      return fail('not_found', notFoundError());
+    }
+    return respond(0, { ok: true, result: resultJson(result) });
+  } catch (err) {
+    return fail(err && err.code === ERR_NOT_FOUND ? 'not_found' : 'failed', err);
+  }
+}
+
+const MCP_PROTOCOL_VERSION = '2024-11-05';
+
+// MCP_TOOLS lists the tools serve-mcp offers; both take the editor-protocol
+// options plus base64 (also return the image itself).
+const MCP_TOOLS = [
+  {
+    name: 'get_latest_screenshot',
+    description:
+      'Stage the newest screenshot (clipboard, then Desktop or Downloads) and return its metadata, ' +
+      'including tempPath.',
+  },
+  {
+    name: 'await_next_screenshot',
+    description:
+      'Wait for the next screenshot saved to Desktop (or Downloads) after the call, then stage it. ' +
+      'timeoutSeconds defaults to 60.',
+    extra: { timeoutSeconds: { type: 'number' } },
+  },
+].map(({ name, description, extra }) => ({
+  name,
+  description,
+  inputSchema: {
+    type: 'object',
+    properties: {
+      ...Object.fromEntries(Object.entries(EDITOR_OPTIONS).map(([key, [, type]]) => [key, { type }])),
+      base64: { type: 'boolean', description: 'also return the image content' },
+      ...extra,
+    },
+    additionalProperties: false,
+  },
+}));
+
+// runServeMcp speaks line-delimited JSON-RPC 2.0 on stdin/stdout until stdin
+// closes. Nothing but protocol messages goes to stdout; warnings stay on
+// stderr.
+async function runServeMcp(opts) {
+  const send = (message) => process.stdout.write(JSON.stringify({ jsonrpc: '2.0', ...message }) + '\n');
+  const pending = new Set();
+  const lines = readline.createInterface({ input: process.stdin });
+  lines.on('line', (line) => {
+    if (!line.trim()) return;
+    let message;
+    try {
+      message = JSON.parse(line);
+    } catch (err) {
+      send({ id: null, error: { code: -32700, message: 'parse error' } });
+      return;
+    }
+    const work = handleMcpMessage(message, opts)
+      .then((result) => {
+        if (message.id !== undefined && result !== undefined) send({ id: message.id, result });
+      })
+      .catch((err) => {
+        if (message.id === undefined) return;
+        send({ id: message.id, error: { code: err.rpcCode || -32603, message: err.message } });
+      })
+      .finally(() => pending.delete(work));
+    pending.add(work);
+  });
+  await new Promise((resolve) => lines.once('close', resolve));
+  await Promise.all(pending);
+  return 0;
+}
+
+async function handleMcpMessage(message, opts) {
+  switch (message.method) {
+    case 'initialize':
+      return {
+        protocolVersion: MCP_PROTOCOL_VERSION,
+        capabilities: { tools: {} },
+        serverInfo: { name: 'screenshot-agent', version: VERSION },
+      };
+    case 'ping':
+      return {};
+    case 'tools/list':
+      return { tools: MCP_TOOLS };
+    case 'tools/call': {
+      const params = message.params || {};
+      return callMcpTool(params.name || '', params.arguments || {}, opts);
+    }
+    default: {
+      if (typeof message.method === 'string' && message.method.startsWith('notifications/')) return undefined;
+      const err = new Error(`method not found: ${message.method}`);
+      err.rpcCode = -32601;
+      throw err;
+    }
+  }
+}
+
+// callMcpTool reports tool failures as isError results, as MCP expects, so
+// the agent sees the message instead of a protocol error.
+async function callMcpTool(name, args, opts) {
+  const tool = MCP_TOOLS.find((item) => item.name === name);
+  if (!tool) {
+    const err = new Error(`unknown tool: ${name}`);
+    err.rpcCode = -32602;
+    throw err;
+  }
+  const { base64, timeoutSeconds, ...options } = args;
+  const callOpts = { ...opts, context: { ...opts.context } };
+  let result;
+  try {
+    applyEditorOptions(callOpts, options);
+    result =
+      name === 'await_next_screenshot'
+        ? await awaitNextScreenshot(callOpts, (timeoutSeconds || 60) * 1000)
+        : await run(callOpts);
+  } catch (err) {
+    return { content: [{ type: 'text', text: err.message || String(err) }], isError: true };
+  }
+  if (!result) {
+    return { content: [{ type: 'text', text: ERR_NOT_FOUND }], isError: true };
+  }
+  const json = resultJson(result);
+  const content = [{ type: 'text', text: JSON.stringify(json) }];
+  if (base64) {
+    const data = await fsp.readFile(result.tempPath);
+    content.push({ type: 'image', data: data.toString('base64'), mimeType: imageMimeType(result.tempPath) });
+  }
+  return { content, structuredContent: json };
+}
+
+// awaitNextScreenshot polls the fallback directory for a file captured after
+// the call started and stages it like a normal run.
+async function awaitNextScreenshot(opts, timeoutMs) {
+  const startMs = Date.now();
+  while (Date.now() - startMs < timeoutMs) {
+    const candidate = await findFallbackImage(opts).catch((err) => {
+      if (err.code !== ERR_NOT_FOUND) throw err;
+      return null;
+    });
+    if (candidate && candidate.timeMs > startMs && !(await stillWriting(candidate))) {
+      const staged = await handleFileCandidate(candidate, opts);
+      staged.modTimeMs = candidate.modTimeMs;
+      return finishResult(staged, opts);
+    }
+    await sleep(500);
+  }
+  throw new Error(`no new screenshot within ${Math.round(timeoutMs / 1000)}s`);
+}
+
+// stillWriting reports whether a just-created file is still growing.
+async function stillWriting(candidate) {
+  await sleep(100);
+  try {
+    return (await fsp.stat(fsPathOf(candidate))).size !== candidate.size;
+  } catch (err) {
+    return true;
+  }
+}
+
+function applyEditorOptions(opts, options) {
+  if (typeof options !== 'object' || Array.isArray(options)) throw new Error('options must be an object');
+  for (const [key, value] of Object.entries(options)) {
+    const spec = EDITOR_OPTIONS[key];
+    if (!spec) throw new Error(`unknown option: ${key}`);
+    if (typeof value !== spec[1]) throw new Error(`option ${key} must be a ${spec[1]}`);
+    opts[spec[0]] = value;
+  }
+  if (opts.bilevel) opts.document = true;
+  if (opts.consume && !CONSUME_POLICIES.includes(opts.consume)) {
+    throw new Error(`invalid consume: ${opts.consume} (${CONSUME_POLICIES.join(', ')})`);
+  }
+  if (!PREFER_POLICIES.includes(opts.prefer)) {
+    throw new Error(`invalid prefer: ${opts.prefer} (${PREFER_POLICIES.join(', ')})`);
+  }
+  if (opts.collision && !COLLISION_POLICIES.includes(opts.collision)) {
+    throw new Error(`invalid collision: ${opts.collision} (${COLLISION_POLICIES.join(', ')})`);
+  }
+}
+
+// runServe answers GET /latest with the bytes of the image a run would pick
+// and GET /latest/meta with its metadata. It only peeks: nothing is staged,
+// trashed, or moved. Requests are handled one at a time since clipboard
+// helpers are process-wide. With --token, requests must carry it as a Bearer
+// header or ?token=, and browsers may read responses cross-origin; without
+// one, no CORS header is sent so web pages can't read the clipboard.
+async function runServe(opts) {
+  const { host, port } = parseListen(opts.listen);
+  if (opts.offline && !isLoopback(host)) {
+    throw new Error(`offline mode: serve listens only on loopback addresses, not ${host}`);
+  }
+  if (opts.udpPort !== null && !opts.token && !isLoopback(host)) {
+    throw new Error(`serve: --udp-port on ${host} needs --token, since a datagram triggers a consuming run`);
+  }
+  let queue = Promise.resolve();
+  const server = http.createServer((req, res) => {
+    const url = new URL(req.url, 'http://localhost');
+    const headers = { 'Cache-Control': 'no-store', ...(opts.token ? { 'Access-Control-Allow-Origin': '*' } : {}) };
+    const reply = (status, type, body) => {
+      res.writeHead(status, { ...headers, 'Content-Type': type, 'Content-Length': body.length });
+      res.end(req.method === 'HEAD' ? undefined : body);
+    };
+    const replyJson = (status, value) => reply(status, 'application/json', Buffer.from(JSON.stringify(value) + '\n'));
+    if (req.method === 'OPTIONS' && opts.token) {
+      res.writeHead(204, { ...headers, 'Access-Control-Allow-Headers': 'Authorization' });
+      res.end();
+      return;
+    }
+    if (opts.token && !tokenMatches(req, url, opts.token)) {
+      replyJson(401, { error: 'missing or wrong token' });
+      return;
+    }
+    if (req.method !== 'GET' && req.method !== 'HEAD') {
+      replyJson(405, { error: `method not allowed: ${req.method}` });
+      return;
+    }
+    if (url.pathname !== '/latest' && url.pathname !== '/latest/meta') {
+      replyJson(404, { error: `not found: ${url.pathname}` });
+      return;
+    }
+    const work = queue.then(async () => {
+      log(opts, `serve: ${req.method} ${url.pathname}`);
+      let selection;
+      try {
+        selection = await selectCandidate({ ...opts, readOnly: true });
+      } finally {
+        shutdownClipboard(opts);
+      }
+      if (!selection) {
+        replyJson(404, { error: ERR_NOT_FOUND });
+        return;
+      }
+      const data =
+        selection.type === 'clipboard' ? selection.candidate.data : await fsp.readFile(fsPathOf(selection.candidate));
+      if (url.pathname === '/latest') {
+        reply(200, contentType(selection, data), data);
+        return;
+      }
+      const file = selection.type === 'clipboard' ? null : selection.candidate;
+      const image = imageGeometry(data);
+      replyJson(200, {
+        schemaVersion: SCHEMA_VERSION,
+        source: selection.type,
+        originalPath: file ? file.path : null,
+        ...(file ? { mtime: rfc3339(new Date(file.modTimeMs)) } : {}),
+        bytes: data.length,
+        contentType: contentType(selection, data),
+        ...(image ? { image } : {}),
+      });
+    });
+    queue = work.catch((err) => {
+      if (err && err.code === ERR_NOT_FOUND) {
+        replyJson(404, { error: ERR_NOT_FOUND });
+      } else {
+        replyJson(500, { error: err && err.message ? err.message : String(err) });
+      }
+    });
+  });
+  await new Promise((resolve, reject) => {
+    server.once('error', reject);
+    server.listen(port, host, resolve);
+  });
+  const shown = host.includes(':') ? `[${host}]` : host;
+  let udp = null;
+  if (opts.udpPort !== null) {
+    udp = await serveUdp(host, opts, (work) => {
+      const next = queue.then(work);
+      queue = next.catch(() => {});
+      return next;
+    });
+    process.stderr.write(`answering resolve datagrams on udp://${shown}:${udp.address().port}\n`);
+  }
+  process.stderr.write(`serving http://${shown}:${server.address().port}/latest; Ctrl-C to stop\n`);
+  return new Promise((resolve) => {
+    const stop = () => {
+      if (udp) udp.close();
+      server.close(() => resolve(0));
+    };
+    process.once('SIGINT', stop);
+    process.once('SIGTERM', stop);
+  });
+}
+
+// UDP_MAX_REPLY is the largest UDP payload over IPv4; a result that doesn't
+// fit (long OCR text) is answered with an error instead.
+const UDP_MAX_REPLY = 65507;
+
+// serveUdp answers a "resolve" datagram (or "resolve TOKEN" with --token)
+// with one datagram holding the JSON result of a normal run, which stages
+// and consumes the screenshot, or {"error": ...}. Hotkey tools such as
+// Hammerspoon (hs.socket.udp) and AutoHotkey can send that without spawning
+// a process or speaking HTTP. Runs share the HTTP server's queue. Without
+// --token, only loopback peers are answered: source addresses are easy to
+// forge, and a run trashes or moves files.
+async function serveUdp(host, opts, serial) {
+  const socket = dgram.createSocket(host.includes(':') ? 'udp6' : 'udp4');
+  socket.on('message', (message, peer) => {
+    if (!opts.token && !isLoopback(peer.address)) {
+      log(opts, `serve: ignoring udp datagram from ${peer.address}:${peer.port} (no --token)`);
+      return;
+    }
+    const send = (value) => {
+      let body = Buffer.from(JSON.stringify(value) + '\n');
+      if (body.length > UDP_MAX_REPLY) body = Buffer.from(JSON.stringify({ error: 'result too large for UDP' }) + '\n');
+      socket.send(body, peer.port, peer.address);
+    };
+    const [verb, token = ''] = message.toString('utf8').trim().split(/\s+/);
+    if (verb !== 'resolve') {
+      send({ error: `unknown request: ${verb}` });
+      return;
+    }
+    const a = Buffer.from(token);
+    const b = Buffer.from(opts.token);
+    if (opts.token && !(a.length === b.length && crypto.timingSafeEqual(a, b))) {
+      send({ error: 'missing or wrong token' });
+      return;
+    }
+    serial(async () => {
+      log(opts, `serve: udp resolve from ${peer.address}:${peer.port}`);
+      const result = await run({ ...opts, context: { ...opts.context } });
+      send(result ? resultJson(result) : { error: ERR_NOT_FOUND });
+    }).catch((err) => send({ error: err && err.message ? err.message : String(err) }));
+  });
+  await new Promise((resolve, reject) => {
+    socket.once('error', reject);
+    socket.bind(opts.udpPort, host, resolve);
+  });
+  return socket;
+}
+
+function parseListen(value) {
+  const match = /^(?:\[([^\]]+)\]|([^:]*)):(\d+)$/.exec(value);
+  if (!match || Number(match[3]) > 65535) {
+    throw new Error(`invalid --listen: ${value} (want HOST:PORT)`);
+  }
+  return { host: match[1] || match[2] || '127.0.0.1', port: Number(match[3]) };
+}
+
+function isLoopback(host) {
+  return host === 'localhost' || host === '::1' || /^(::ffff:)?127\.\d+\.\d+\.\d+$/.test(host);
+}
+
+function tokenMatches(req, url, token) {
+  const header = req.headers.authorization || '';
+  const given = header.startsWith('Bearer ') ? header.slice(7) : url.searchParams.get('token') || '';
+  const a = Buffer.from(given);
+  const b = Buffer.from(token);
+  return a.length === b.length && crypto.timingSafeEqual(a, b);
+}
+
+function contentType(selection, data) {
+  const type = sniffImageType(data);
+  if (type) return `image/${type}`;
+  const ext = selection.type === 'clipboard' ? '' : path.extname(selection.candidate.path).toLowerCase();
+  if (ext === '.svg') return 'image/svg+xml';
+  if (ext === '.pdf') return 'application/pdf';
+  return 'application/octet-stream';
+}
+
+const LAUNCHER_ITEMS = 20;
+
+// runLauncher prints the Alfred script filter JSON format (which Raycast and
+// Albert script extensions also read) for the newest images in Desktop and
+// Downloads, without staging or consuming anything. Enter opens the file;
+// cmd copies its path, alt copies the image. The chosen action is passed on
+// as the `action` variable for workflows that dispatch on it.
+async function runLauncher(opts) {
+  const candidates = [];
+  for (const { label, dir } of await knownSources()) {
+    candidates.push(...(await listImages(dir, label, opts)));
+  }
+  for (const candidate of candidates) {
+    candidate.timeMs = captureTime(candidate, opts.sort);
+  }
+  candidates.sort((a, b) => b.timeMs - a.timeMs);
+  const now = Date.now();
+  const items = candidates.slice(0, LAUNCHER_ITEMS).map((candidate) => {
+    const file = candidate.path;
+    return {
+      uid: file,
+      type: 'file',
+      title: path.basename(file),
+      subtitle: `${candidate.dir} · ${formatAge(now - candidate.timeMs)} ago · ${formatBytes(candidate.size)}`,
+      arg: file,
+      icon: { path: file },
+      quicklookurl: file,
+      variables: { action: 'open' },
+      text: { copy: file, largetype: file },
+      mods: {
+        cmd: { arg: file, subtitle: 'Copy path', variables: { action: 'copy-path' } },
+        alt: { arg: file, subtitle: 'Copy image', variables: { action: 'copy-image' } },
+      },
+    };
+  });
+  if (items.length === 0) {
+    items.push({ title: 'No screenshots on Desktop or in Downloads', valid: false });
+  }
+  process.stdout.write(JSON.stringify({ items }) + '\n');
+  return 0;
+}
+
+function formatAge(ms) {
+  for (const [unit, size] of [
+    ['d', 86400000],
+    ['h', 3600000],
+    ['m', 60000],
+  ]) {
+    if (ms >= size) return `${Math.floor(ms / size)}${unit}`;
+  }
+  if (ms > 0 && ms < 1000) return `${Math.round(ms)}ms`;
+  return `${Math.max(0, Math.floor(ms / 1000))}s`;
+}
+
+async function runClipboardInspect(opts) {
+  const report = inspectClipboard(opts);
+  if (!report) {
+    throw new Error('no clipboard backend available (need osascript, wl-paste, or xclip)');
+  }
+  process.stdout.write(`backend: ${report.backend}\n`);
+  if (report.formats.length === 0) {
+    process.stdout.write('clipboard is empty\n');
+    return 1;
+  }
+  const width = Math.max(...report.formats.map((format) => format.type.length));
+  for (const format of report.formats) {
+    const size = format.size === null ? '?' : String(format.size);
+    process.stdout.write(`${format.type.padEnd(width)}  ${size.padStart(10)}  ${format.preview}\n`);
+  }
+  return 0;
+}
+
+// OUTPUT_VERSIONS maps each --output-version to its stdout formatters. Older
+// versions stay here unchanged so scripts pinned to them keep working.
+const OUTPUT_VERSIONS = {
+  1: {
+    text: (result) =>
+      [...(result.group || []), result].map((item) => textPath(item.source) + '\n' + item.tempPath + '\n').join(''),
+    json: (result) => JSON.stringify(resultJson(result)) + '\n',
+  },
+};
+
+function outputVersion(value) {
+  const version = Number(value);
+  if (!OUTPUT_VERSIONS[version]) {
+    throw new Error(`unsupported output version: ${value} (supported: ${Object.keys(OUTPUT_VERSIONS).join(', ')})`);
+  }
+  return version;
+}
+
+// compileFormat turns a --format template into a function of a --json
+// result. It supports the subset of Go text/template scripts use: {{.Field}}
+// and {{.Field.Sub}} with result fields in Go's capitalized spelling
+// (TempPath, OriginalPath, Image.Width), plus \t, \n and \\ escapes. Unknown
+// fields are rejected up front; absent optional ones print as empty.
+function compileFormat(template) {
+  const parts = [];
+  const pattern = /\{\{-?\s*\.([A-Za-z][\w.]*)\s*-?\}\}/g;
+  let last = 0;
+  for (const match of template.matchAll(pattern)) {
+    parts.push(unescapeFormat(template.slice(last, match.index)));
+    const keys = match[1].split('.').map((key) => key[0].toLowerCase() + key.slice(1));
+    if (!RESULT_SCHEMA.properties[keys[0]]) {
+      throw new Error(`unknown --format field: .${match[1]}`);
+    }
+    parts.push(keys);
+    last = match.index + match[0].length;
+  }
+  const rest = template.slice(last);
+  if (rest.includes('{{')) {
+    throw new Error(`unsupported --format action near: ${rest.slice(rest.indexOf('{{'))}`);
+  }
+  parts.push(unescapeFormat(rest));
+  return (json) =>
+    parts
+      .map((part) => {
+        if (typeof part === 'string') return part;
+        const value = part.reduce((node, key) => (node && typeof node === 'object' ? node[key] : undefined), json);
+        if (value === undefined || value === null) return '';
+        return typeof value === 'object' ? JSON.stringify(value) : String(value);
+      })
+      .join('');
+}
+
+function unescapeFormat(text) {
+  return text.replace(/\\([tn\\])/g, (_, c) => (c === 't' ? '\t' : c === 'n' ? '\n' : '\\'));
+}
+
+// textPath keeps line-oriented output parseable: a path containing newlines
+// or other control characters is printed as a JSON string literal instead.
+function textPath(value) {
+  return /[\x00-\x1f\x7f]/.test(value) ? JSON.stringify(value) : value;
+}
+
+function writeResult(result, opts) {
+  if (opts.format) {
+    process.stdout.write(compileFormat(opts.format)(resultJson(result)) + '\n');
+    return;
+  }
+  const formats = OUTPUT_VERSIONS[opts.outputVersion || SCHEMA_VERSION];
+  process.stdout.write(opts.json ? formats.json(result) : formats.text(result));
+  if (!opts.json && result.links) {
+    for (const link of result.links) process.stdout.write(textPath(link) + '\n');
+  }
+  if (!opts.json && result.url) {
+    process.stdout.write(textPath(result.url) + '\n');
+  }
+}
+
+function resultJson(result) {
+  const kind = result.kind || (result.source === 'clipboard' ? 'clipboard' : 'file');
+  return {
+    schemaVersion: SCHEMA_VERSION,
+    source: kind,
+    originalPath: kind === 'file' ? result.source : null,
+    ...(kind === 'file' && result.sourceBytes ? { originalPathBytes: result.sourceBytes.toString('base64') } : {}),
+    tempPath: result.tempPath,
+    ...(kind === 'file' && result.modTimeMs ? { mtime: rfc3339(new Date(result.modTimeMs)) } : {}),
+    ...(result.bytes !== undefined ? { bytes: result.bytes } : {}),
+    ...(result.ocrText !== undefined ? { ocrText: result.ocrText } : {}),
+    ...(result.ocrLines ? { ocrLines: result.ocrLines } : {}),
+    ...(result.links ? { links: result.links } : {}),
+    ...(result.url ? { url: result.url } : {}),
+    ...(result.deliveries ? { deliveries: result.deliveries } : {}),
+    ...(result.tag ? { tag: result.tag } : {}),
+    ...(result.quality ? { quality: result.quality } : {}),
+    ...(result.context && Object.keys(result.context).length > 0 ? { context: result.context } : {}),
+    ...(result.group ? { group: [...result.group, result].map(groupMemberJson) } : {}),
+    ...(result.image ? { image: result.image } : {}),
+    ...(result.display ? { display: result.display } : {}),
+    ...(result.skippedSources ? { skippedSources: result.skippedSources } : {}),
+    ...(result.backlog ? { backlog: result.backlog } : {}),
+  };
+}
+
+const CLASSIFY_TAGS = ['code', 'terminal', 'browser', 'chart', 'photo'];
+
+// extractLinks finds the URLs in OCR text, in order and without repeats.
+// Trailing sentence punctuation, and a closing bracket without an opening
+// one in the URL, are dropped; bare www. hosts get https://.
+function extractLinks(text) {
+  const links = [];
+  for (const match of text.matchAll(/\b(?:https?:\/\/|www\.)[^\s<>"'`]+/gi)) {
+    let link = match[0].replace(/[.,;:!?'"]+$/, '');
+    for (const [open, close] of ['()', '[]', '{}']) {
+      const unbalanced = () => link.endsWith(close) && link.split(open).length < link.split(close).length;
+      while (unbalanced()) link = link.slice(0, -1).replace(/[.,;:!?'"]+$/, '');
+    }
+    if (/^www\./i.test(link)) link = `https://${link}`;
+    if (!links.includes(link)) links.push(link);
+  }
+  return links;
+}
+
+// classifyStaged tags the staged image, or returns undefined (with a
+// warning) when it can't be decoded.
+async function classifyStaged(file, ocrText, opts) {
+  let image;
+  try {
+    image = await decodeImage(file, opts);
+  } catch (err) {
+    process.stderr.write(`warning: cannot classify ${file}: ${err.message}\n`);
+    return undefined;
+  }
+  const tag = classifyImage(image, ocrText);
+  log(opts, `classified as ${tag}`);
+  return tag;
+}
+
+// classifyImage is a cheap heuristic over a sampled color histogram, not a
+// model: photos have no dominant background, terminals are dark and mostly
+// monochrome, charts are large saturated blocks, browsers have a toolbar
+// band that differs from the page. OCR text, when present, settles the
+// text-heavy cases first.
+function classifyImage(image, ocrText) {
+  const sample = samplePixels(image, 0, image.height, 160);
+  if (sample.dominantShare < 0.3 && sample.colors > 200) return 'photo';
+  if (ocrText) {
+    if (/^\s*(\S*[$#%>❯]|PS [A-Z]:\\\S*>)\s/m.test(ocrText)) return 'terminal';
+    if ((ocrText.match(/[{};]|=>|\b(function|def|const|import|return|class)\b/g) || []).length >= 3) return 'code';
+    if (/https?:\/\/|www\./.test(ocrText)) return 'browser';
+  }
+  const luminance = 0.299 * sample.dominant[0] + 0.587 * sample.dominant[1] + 0.114 * sample.dominant[2];
+  if (luminance < 80) {
+    return sample.colorfulShare < 0.15 ? 'terminal' : 'code';
+  }
+  if (sample.colorfulShare > 0.4) return 'chart';
+  const bandRows = Math.max(1, Math.round(image.height * 0.08));
+  const band = samplePixels(image, 0, bandRows, 160);
+  if (band.dominantShare > 0.6 && colorDistance(band.dominant, sample.dominant) > 24) return 'browser';
+  return sample.colorfulShare > 0.05 ? 'code' : 'browser';
+}
+
+// samplePixels summarizes rows [top, bottom) on a grid of at most
+// limit x limit points: the dominant color and its share, how many colors
+// cover 95% of the points, and the share of saturated points outside the
+// dominant color.
+function samplePixels(image, top, bottom, limit) {
+  const stepX = Math.max(1, Math.floor(image.width / limit));
+  const stepY = Math.max(1, Math.floor((bottom - top) / limit));
+  const counts = new Map();
+  const points = [];
+  for (let y = top; y < bottom; y += stepY) {
+    for (let x = 0; x < image.width; x += stepX) {
+      const i = (y * image.width + x) * 4;
+      const rgb = [image.pixels[i], image.pixels[i + 1], image.pixels[i + 2]];
+      const bin = ((rgb[0] >> 4) << 8) | ((rgb[1] >> 4) << 4) | (rgb[2] >> 4);
+      counts.set(bin, (counts.get(bin) || 0) + 1);
+      points.push([bin, rgb]);
+    }
+  }
+  const ranked = [...counts.entries()].sort((a, b) => b[1] - a[1]);
+  const [dominantBin, dominantCount] = ranked[0];
+  let covered = 0;
+  let colors = 0;
+  while (covered < points.length * 0.95) {
+    covered += ranked[colors][1];
+    colors += 1;
+  }
+  let colorful = 0;
+  for (const [bin, rgb] of points) {
+    if (bin !== dominantBin && Math.max(...rgb) - Math.min(...rgb) > 60) colorful += 1;
+  }
+  const rest = points.length - dominantCount;
+  return {
+    dominant: [((dominantBin >> 8) << 4) + 8, (((dominantBin >> 4) & 15) << 4) + 8, ((dominantBin & 15) << 4) + 8],
+    dominantShare: dominantCount / points.length,
+    colors,
+    colorfulShare: rest ? colorful / rest : 0,
+  };
+}
+
+const QUALITY_SAMPLES = 1000000;
+
+// qualityStaged scores the staged image, or returns undefined (with a
+// warning) when it can't be decoded.
+async function qualityStaged(file, opts) {
+  let image;
+  try {
+    image = await decodeImage(file, opts);
+  } catch (err) {
+    process.stderr.write(`warning: cannot score ${file}: ${err.message}\n`);
+    return undefined;
+  }
+  const quality = imageQuality(image);
+  log(opts, `quality ${quality.score} (sharpness ${quality.sharpness}${quality.blank ? ', blank' : ''})`);
+  return quality;
+}
+
+// imageQuality estimates legibility from the luminance: the variance of its
+// Laplacian is high where edges are crisp (text, UI) and collapses when the
+// image is blurred or downscaled, and a tiny luminance spread means a blank
+// capture (black window, wrong display). Large images are sampled on a grid,
+// with the Laplacian still taken from adjacent pixels. The score maps the
+// variance onto 0-100 on a log scale (1000 and up is 100); blank is 0.
+function imageQuality(image) {
+  const { width, height, pixels } = image;
+  const luma = (x, y) => {
+    const i = (y * width + x) * 4;
+    return 0.299 * pixels[i] + 0.587 * pixels[i + 1] + 0.114 * pixels[i + 2];
+  };
+  const step = Math.max(1, Math.floor(Math.sqrt((width * height) / QUALITY_SAMPLES)));
+  let count = 0;
+  let sum = 0;
+  let sumSq = 0;
+  let lapSum = 0;
+  let lapSumSq = 0;
+  for (let y = 1; y < height - 1; y += step) {
+    for (let x = 1; x < width - 1; x += step) {
+      const center = luma(x, y);
+      const lap = 4 * center - luma(x - 1, y) - luma(x + 1, y) - luma(x, y - 1) - luma(x, y + 1);
+      count += 1;
+      sum += center;
+      sumSq += center * center;
+      lapSum += lap;
+      lapSumSq += lap * lap;
+    }
+  }
+  if (count === 0) return { score: 0, sharpness: 0, blank: true };
+  const spread = Math.sqrt(Math.max(0, sumSq / count - (sum / count) ** 2));
+  const sharpness = Math.max(0, lapSumSq / count - (lapSum / count) ** 2);
+  const blank = spread < 2;
+  const score = blank ? 0 : Math.round(100 * Math.min(1, Math.log10(1 + sharpness) / 3));
+  return { score, sharpness: Math.round(sharpness * 10) / 10, blank };
+}
+
+function colorDistance(a, b) {
+  return Math.max(Math.abs(a[0] - b[0]), Math.abs(a[1] - b[1]), Math.abs(a[2] - b[2]));
+}
+
+// OCR_BOX_SCHEMA and OCR_WORD_SCHEMA are the shared shapes of OCR results.
+const OCR_BOX_SCHEMA = {
+  x: { type: 'integer' },
+  y: { type: 'integer' },
+  width: { type: 'integer' },
+  height: { type: 'integer' },
+};
+
+const OCR_WORD_SCHEMA = { text: { type: 'string' }, ...OCR_BOX_SCHEMA };
+
+// RESULT_SCHEMA describes one --json result; EVENT_SCHEMA describes the
+// line-delimited events long-running modes emit. Bump SCHEMA_VERSION on any
+// incompatible change.
+const RESULT_SCHEMA = {
+  $schema: 'https://json-schema.org/draft/2020-12/schema',
+  $id: `urn:screenshot-agent:result:v${SCHEMA_VERSION}`,
+  title: 'screenshot-agent result',
+  type: 'object',
+  required: ['schemaVersion', 'source', 'originalPath', 'tempPath'],
+  properties: {
+    schemaVersion: { const: SCHEMA_VERSION },
+    source: { enum: ['capture', 'clipboard', 'file', 'replay', 'stdin'] },
+    originalPath: { type: ['string', 'null'], description: 'file the image came from; null otherwise' },
+    originalPathBytes: {
+      type: 'string',
+      contentEncoding: 'base64',
+      description: 'exact bytes of originalPath when the name is not valid UTF-8',
+    },
+    tempPath: { type: 'string', description: 'absolute path of the staged copy' },
+    mtime: { type: 'string', format: 'date-time', description: 'modification time of originalPath' },
+    bytes: { type: 'integer', description: 'size of the staged copy in bytes' },
+    ocrText: { type: 'string', description: 'recognized text, present with --ocr' },
+    links: {
+      type: 'array',
+      items: { type: 'string' },
+      description: 'URLs found in ocrText, present with --links',
+    },
+    url: { type: 'string', description: 'share link of the uploaded image, present with --upload or --deliver' },
+    deliveries: {
+      type: 'array',
+      description: 'one entry per --upload/--deliver target, in order',
+      items: {
+        type: 'object',
+        required: ['target', 'type', 'ok'],
+        properties: {
+          target: { type: 'string' },
+          type: { type: 'string', enum: ['archive', 'put', 's3', 'webhook'] },
+          ok: { type: 'boolean' },
+          attempts: { type: 'integer', description: 'requests made, counting retries' },
+          url: { type: 'string', description: 'share link (put, s3)' },
+          path: { type: 'string', description: 'archived copy (archive)' },
+          error: { type: 'string', description: 'why the delivery failed' },
+        },
+      },
+    },
+    ocrLines: {
+      type: 'array',
+      description: 'recognized lines with pixel boxes (origin top left), present with --ocr --json',
+      items: {
+        type: 'object',
+        required: ['text', 'x', 'y', 'width', 'height'],
+        properties: {
+          text: { type: 'string' },
+          ...OCR_BOX_SCHEMA,
+          words: {
+            type: 'array',
+            description: 'the words of the line, when the engine reports them',
+            items: { type: 'object', required: ['text', 'x', 'y', 'width', 'height'], properties: OCR_WORD_SCHEMA },
+          },
+        },
+      },
+    },
+    tag: {
+      enum: CLASSIFY_TAGS,
+      description: 'what the image looks like, present with --classify',
+    },
+    quality: {
+      type: 'object',
+      description: 'legibility estimate, present with --quality',
+      required: ['score', 'sharpness', 'blank'],
+      properties: {
+        score: { type: 'integer', minimum: 0, maximum: 100 },
+        sharpness: { type: 'number', description: 'variance of the Laplacian of the luminance' },
+        blank: { type: 'boolean', description: 'the image is (nearly) one flat color' },
+      },
+    },
+    context: {
+      type: 'object',
+      description: 'KEY=VALUE pairs from --context',
+      additionalProperties: { type: 'string' },
+    },
+    image: {
+      type: 'object',
+      description: 'pixel dimensions, plus DPI when the file records it',
+      required: ['width', 'height'],
+      properties: { width: { type: 'integer' }, height: { type: 'integer' }, dpi: { type: 'number' } },
+    },
+    display: {
+      type: 'object',
+      description: 'display whose native resolution matches a full-screen capture, present with --display-info',
+      required: ['name', 'width', 'height'],
+      properties: {
+        name: { type: 'string' },
+        width: { type: 'integer' },
+        height: { type: 'integer' },
+        scale: { type: 'number' },
+      },
+    },
+    skippedSources: {
+      type: 'array',
+      description: 'sources still pending when --soft-timeout elapsed',
+      items: { type: 'string' },
+    },
+    group: {
+      type: 'array',
+      description: 'burst members, oldest first, present with --group-burst',
+      items: {
+        type: 'object',
+        required: ['originalPath', 'tempPath'],
+        properties: {
+          originalPath: { type: 'string' },
+          tempPath: { type: 'string' },
+          bytes: { type: 'integer' },
+          image: { $ref: '#/properties/image' },
+        },
+      },
+    },
+    backlog: {
+      type: 'array',
+      description: 'present with --report-backlog',
+      items: {
+        type: 'object',
+        properties: {
+          dir: { type: 'string' },
+          path: { type: 'string' },
+          images: { type: 'integer' },
+          screenshots: { type: 'integer' },
+          bytes: { type: 'integer' },
+        },
+      },
+    },
+  },
+  additionalProperties: true,
+};
+
+const EVENT_SCHEMA = {
+  $schema: 'https://json-schema.org/draft/2020-12/schema',
+  $id: `urn:screenshot-agent:event:v${SCHEMA_VERSION}`,
+  title: 'screenshot-agent event',
+  type: 'object',
+  required: ['schemaVersion', 'type', 'time'],
+  properties: {
+    schemaVersion: { const: SCHEMA_VERSION },
+    type: { enum: ['result', 'error'] },
+    time: { type: 'string', format: 'date-time' },
+    result: { $ref: RESULT_SCHEMA.$id },
+    error: {
+      type: 'object',
+      required: ['message'],
+      properties: { code: { type: 'string' }, message: { type: 'string' } },
+    },
+  },
+  additionalProperties: true,
+};
+
+async function run(opts) {
+  const existingOut = opts.out && opts.collision === 'skip' ? await existingTarget(path.resolve(opts.out)) : '';
+  if (existingOut) {
+    process.stderr.write(`skipped: ${existingOut} already exists\n`);
+    opts.outSkipped = true;
+    return null;
+  }
+  const selection = await selectWaiting(opts);
+  if (!selection) return null;
+  const cacheKey = opts.cacheMs && !opts.out ? await selectionKey(selection) : '';
+  // Hash before staging: consuming a file takes it away.
+  const returnedKey = opts.newOnly && tracksReturned(selection) ? await selectionKey(selection) : '';
+  if (cacheKey) {
+    const cached = await lookupCache(selection, cacheKey, opts);
+    if (cached) return cached;
+  }
+  let staged;
+  if (selection.type === 'clipboard') {
+    staged = await handleClipboardCandidate(selection.candidate, opts);
+  } else if (selection.type === 'stdin') {
+    injectFailure(opts, 'copy');
+    staged = { source: 'stdin', kind: 'stdin', tempPath: await writeDataToTemp(selection.candidate.data, 'stdin', opts) };
+  } else if (selection.type === 'path') {
+    staged = await handlePathCandidate(selection.candidate, opts);
+  } else {
+    staged = await handleFileCandidate(selection.candidate, opts);
+    if (selection.candidate.burst && selection.candidate.burst.length > 0) {
+      staged.group = [];
+      for (const member of selection.candidate.burst) {
+        staged.group.push(await finishMember(member, opts));
+      }
+    }
+  }
+  if (selection.skipped && selection.skipped.length > 0) {
+    staged.skippedSources = selection.skipped;
+  }
+  if (selection.candidate.fsPath) {
+    staged.sourceBytes = selection.candidate.fsPath;
+  }
+  if (selection.candidate.modTimeMs) {
+    staged.modTimeMs = selection.candidate.modTimeMs;
+  }
+  const result = await finishResult(staged, opts);
+  if (selection.type === 'clipboard' || selection.type === 'file') {
+    await recordSource(selection.type).catch(() => {});
+  }
+  if (selection.type === 'file' && opts.learnNames) {
+    await recordNamePattern(path.basename(selection.candidate.path)).catch(() => {});
+  }
+  if (cacheKey) {
+    await storeCache(selection, cacheKey, result);
+  }
+  if (returnedKey) {
+    await recordReturned(selection, returnedKey).catch(() => {});
+  }
+  return result;
+}
+
+// finishMember stages an earlier --group-burst member and runs the same
+// post-staging steps as the newest one, minus those that act once per run
+// (the sound and clipboard writes).
+async function finishMember(member, opts) {
+  const staged = await handleFileCandidate(member, opts);
+  if (member.fsPath) {
+    staged.sourceBytes = member.fsPath;
+  }
+  staged.modTimeMs = member.modTimeMs;
+  return finishResult(staged, { ...opts, sound: null, replaceClipboard: false, copyLinks: false });
+}
+
+// finishResult runs the post-staging steps on the temp copy, in order.
+async function finishResult(result, opts) {
+  if (opts.rasterize && isVectorExt(path.extname(result.tempPath))) {
+    result.tempPath = await rasterizeStaged(result.tempPath, opts);
+    if (opts.out) {
+      const out = await outputPath(opts);
+      await moveFile(result.tempPath, out);
+      result.tempPath = out;
+    }
+  }
+  await applyOrientation(result.tempPath, opts);
+  if (opts.trimTerminal) {
+    await trimTerminal(result.tempPath, opts);
+  }
+  if (opts.document) {
+    await applyDocument(result.tempPath, opts);
+  }
+  if (opts.out) {
+    await applyPermissions(result.tempPath, opts, false);
+  }
+  const data = await fsp.readFile(result.tempPath);
+  result.bytes = data.length;
+  result.image = imageGeometry(data);
+  await recordStaged(result.tempPath, data.length).catch(() => {});
+  await audit(opts, 'consume', { source: result.source, tempPath: result.tempPath, size: data.length }, data);
+  if (opts.marker) {
+    await writeMarker(result, opts);
+  }
+  if (opts.displayInfo && result.image) {
+    result.display = matchDisplay(result.image, opts);
+  }
+  if (opts.ocr) {
+    const ocr = await ocrImage(result.tempPath, opts, opts.json);
+    result.ocrText = ocr.text;
+    if (opts.json && ocr.lines) result.ocrLines = ocr.lines;
+  }
+  if (opts.classify) {
+    result.tag = await classifyStaged(result.tempPath, result.ocrText, opts);
+  }
+  if (opts.quality || opts.assertions.some((assertion) => assertion.field === 'quality')) {
+    result.quality = await qualityStaged(result.tempPath, opts);
+  }
+  if (opts.replaceClipboard && !readOnlyBlocks(opts, 'overwriting the clipboard')) {
+    await writeClipboardImage(result.tempPath, opts, result.ocrText);
+  }
+  if (opts.links) {
+    result.links = extractLinks(result.ocrText || '');
+    log(opts, `found ${result.links.length} links`);
+  }
+  if (opts.copyLinks && result.links.length > 0 && !readOnlyBlocks(opts, 'overwriting the clipboard')) {
+    await writeClipboardText(result.links.join('\n'), opts);
+  }
+  result.context = { ...opts.context };
+  result.time = new Date();
+  if (opts.sidecar) {
+    await fsp.writeFile(`${result.tempPath}.json`, JSON.stringify(resultJson(result), null, 2) + '\n');
+  }
+  if (opts.history) {
+    await appendHistory(result, data);
+  }
+  if (opts.sound !== null) {
+    playSound(opts.sound, opts);
+  }
+  return result;
+}
+
+const WAIT_POLL_MS = 500;
+
+// selectWaiting is selectCandidate, retried every WAIT_POLL_MS for up to
+// --wait while nothing is found, so scripts needn't poll in a shell loop.
+async function selectWaiting(opts) {
+  const deadline = Date.now() + opts.waitMs;
+  for (let attempt = 0; ; attempt += 1) {
+    let selection = null;
+    try {
+      selection = await selectCandidate(opts);
+    } catch (err) {
+      if (!opts.waitMs || err.code !== ERR_NOT_FOUND) throw err;
+    } finally {
+      shutdownClipboard(opts);
+    }
+    if (selection && opts.newOnly && (await alreadyReturned(selection, opts))) selection = null;
+    if (selection || !opts.waitMs || opts.stdin || opts.inputPath || Date.now() >= deadline) return selection;
+    if (attempt === 0) log(opts, `nothing yet; waiting up to ${formatAge(opts.waitMs)}`);
+    await sleep(Math.min(WAIT_POLL_MS, deadline - Date.now()));
+  }
+}
+
+// selectCandidate decides between the clipboard and the newest file without
+// touching either, so callers can inspect or cache before staging.
+async function selectCandidate(opts) {
+  if (opts.inputPath) {
+    return { type: 'path', candidate: await pathCandidate(opts.inputPath) };
+  }
+  if (opts.stdin) {
+    const data = await readStdin();
+    if (data.length === 0) return null;
+    if (!sniffImageType(data)) {
+      throw new Error('stdin is not a recognized image');
+    }
+    return { type: 'stdin', candidate: { data, size: data.length } };
+  }
+  if (opts.latencyBudgetMs && !opts.clipboardOnly) {
+    const fast = await fastPathCandidate(opts);
+    if (fast) return fast;
+  }
+  const skipped = [];
+  const deadline = opts.softTimeoutMs ? Date.now() + opts.softTimeoutMs : 0;
+  const clipboardAbort = new AbortController();
+  const clipboardPromise = readClipboardImage(opts, clipboardAbort.signal)
+    .then((candidate) => filterClipboardCandidate(candidate, opts))
+    .catch((err) => err);
+  const filePromise = opts.clipboardOnly ? null : findFallbackImage(opts).catch((err) => err);
+
+  const clipboardResult = await withDeadline(clipboardPromise, deadline, () => {
+    clipboardAbort.abort();
+    skipped.push('clipboard');
+  });
+  if (clipboardResult && clipboardResult.code === ERR_INJECTED) {
+    throw clipboardResult;
+  }
+  if (clipboardResult && clipboardResult.data) {
+    clipboardResult.ageMs = await clipboardAgeMs(clipboardResult.data, opts);
+  }
+  if (opts.clipboardOnly) {
+    if (clipboardResult && clipboardResult.data) {
+      if (!staleClipboardOk(clipboardResult, opts)) return null;
+      log(opts, 'selected clipboard candidate (clipboard-only)');
+      return { type: 'clipboard', candidate: clipboardResult, skipped };
+    }
+    if (clipboardResult && clipboardResult.code !== ERR_NOT_FOUND) {
+      throw clipboardResult;
+    }
+    return null;
+  }
+
+  const fileResult = await withDeadline(filePromise, deadline, () => {
+    skipped.push(opts.allSources ? 'files' : opts.useDownloads ? 'Downloads' : 'Desktop');
+  });
+  if (fileResult && fileResult.code === ERR_INJECTED) {
+    throw fileResult;
+  }
+  if (skipped.length > 0) {
+    log(opts, `soft timeout: skipped ${skipped.join(', ')}`);
+  }
+  const now = Date.now();
+
+  if (clipboardResult && clipboardResult.data && fileResult && fileResult.path) {
+    if (fileWins(fileResult, clipboardResult, now, opts)) {
+      log(opts, `selected file candidate: ${fileResult.path}`);
+      return { type: 'file', candidate: fileResult, skipped };
+    }
+    log(opts, 'selected clipboard candidate');
+    return { type: 'clipboard', candidate: clipboardResult, skipped };
+  }
+
+  if (clipboardResult && clipboardResult.data) {
+    if (!staleClipboardOk(clipboardResult, opts)) return null;
+    log(opts, 'selected clipboard candidate (file missing)');
+    return { type: 'clipboard', candidate: clipboardResult, skipped };
+  }
+
+  if (fileResult && fileResult.path) {
+    log(opts, `selected file candidate (clipboard missing): ${fileResult.path}`);
+    return { type: 'file', candidate: fileResult, skipped };
+  }
+
+  if (fileResult && fileResult.code && fileResult.code !== ERR_NOT_FOUND) {
+    throw fileResult;
+  }
+  if (clipboardResult && clipboardResult.code && clipboardResult.code !== ERR_NOT_FOUND) {
+    throw clipboardResult;
+  }
+  return null;
+}
+
+// fastPathCandidate asks only the source recent runs almost always used,
+// and returns its answer if it is confident (clipboard image present, or a
+// file fresh enough to beat the clipboard anyway) within --latency-budget.
+// Otherwise the caller falls back to checking every source.
+async function fastPathCandidate(opts) {
+  const likely = likelySource(await readRecentSources());
+  if (!likely) return null;
+  const deadline = Date.now() + opts.latencyBudgetMs;
+  if (likely === 'clipboard') {
+    const abort = new AbortController();
+    const clipboard = readClipboardImage(opts, abort.signal)
+      .then((candidate) => filterClipboardCandidate(candidate, opts))
+      .catch((err) => err);
+    const result = await withDeadline(clipboard, deadline, () => abort.abort());
+    if (result && result.code === ERR_INJECTED) throw result;
+    // Under --prefer file a clipboard image is only a fallback.
+    if (result && result.data && opts.prefer !== 'file') {
+      result.ageMs = await clipboardAgeMs(result.data, opts);
+      if (!staleClipboardOk(result, opts)) return null;
+      log(opts, 'fast path: clipboard');
+      return { type: 'clipboard', candidate: result, skipped: [] };
+    }
+  } else {
+    const result = await withDeadline(findFallbackImage(opts).catch((err) => err), deadline, () => {});
+    if (result && result.code === ERR_INJECTED) throw result;
+    if (result && result.path && fileWins(result, null, Date.now(), opts)) {
+      log(opts, `fast path: file ${result.path}`);
+      return { type: 'file', candidate: result, skipped: [] };
+    }
+  }
+  log(opts, `fast path: no confident ${likely} match within budget`);
+  return null;
+}
+
+// clipboardAgeMs reports how long the clipboard has held these exact bytes,
+// as far as runs have seen: 0 the first time, since nothing tracks the
+// clipboard between runs. --read-only only reads the record, so new bytes
+// then count as fresh without being tracked.
+async function clipboardAgeMs(data, opts) {
+  const hash = crypto.createHash('sha256').update(data).digest('hex');
+  const file = path.join(stateDir(), 'clipboard-seen.json');
+  try {
+    const seen = JSON.parse(await fsp.readFile(file, 'utf8'));
+    if (seen.hash === hash) return Math.max(0, Date.now() - seen.firstSeenMs);
+  } catch (err) {
+    // First run, or unreadable state: start tracking these bytes now.
+  }
+  if (opts.readOnly) return 0;
+  await fsp.mkdir(stateDir(), { recursive: true, mode: 0o700 });
+  await fsp.writeFile(file, JSON.stringify({ hash, firstSeenMs: Date.now() }) + '\n', { mode: 0o600 });
+  return 0;
+}
+
+// staleClipboardOk warns when the only candidate is a clipboard image that
+// hasn't changed for staleClipboardMs, and rejects it when stale_clipboard
+// is "refuse" unless --allow-stale-clipboard.
+function staleClipboardOk(candidate, opts) {
+  if (!candidate.ageMs || candidate.ageMs < opts.staleClipboardMs) return true;
+  const age = formatAge(candidate.ageMs);
+  if (opts.staleClipboard === 'refuse' && !opts.allowStaleClipboard) {
+    process.stderr.write(
+      `warning: clipboard image unchanged for ${age}; ignoring it (pass --allow-stale-clipboard to use it)\n`,
+    );
+    return false;
+  }
+  if (!opts.allowStaleClipboard) {
+    process.stderr.write(`warning: clipboard image unchanged for ${age}; it may not be the one you meant\n`);
+  }
+  return true;
+}
+
+const RECENT_SOURCES_KEPT = 20;
+
+const STAGED_KEPT = 200;
+
+// A learned name pattern counts as a screenshot name once this many picked
+// files had it; at most NAME_PATTERNS_KEPT patterns are remembered.
+const NAME_PATTERN_MIN = 3;
+const NAME_PATTERNS_KEPT = 50;
+
+function stagedRegistryPath() {
+  return path.join(stateDir(), 'staged.json');
+}
+
+// readStagedRegistry returns the files recent runs wrote (temp results and
+// --out targets) as path/size keys, so scans can tell them from captures.
+async function readStagedRegistry() {
+  try {
+    const staged = JSON.parse(await fsp.readFile(stagedRegistryPath(), 'utf8'));
+    return Array.isArray(staged) ? staged : [];
+  } catch (err) {
+    return [];
+  }
+}
+
+async function recordStaged(filePath, size) {
+  // Scans see real directories (macOS $TMPDIR is a symlink), so record the
+  // resolved path.
+  const dir = await fsp.realpath(path.dirname(path.resolve(filePath)));
+  const entry = { path: path.join(dir, path.basename(filePath)), size };
+  const staged = (await readStagedRegistry()).filter((item) => item.path !== entry.path);
+  staged.push(entry);
+  await fsp.mkdir(stateDir(), { recursive: true, mode: 0o700 });
+  await fsp.writeFile(stagedRegistryPath(), JSON.stringify(staged.slice(-STAGED_KEPT)) + '\n', { mode: 0o600 });
+}
+
+// withoutStaged drops candidates a run staged itself. A --dir pointed at a
+// broad location (the temp dir, an --out folder) would otherwise pick up
+// the previous result and stage it again, in a loop. A file replaced since
+// (different size) counts as a capture again.
+async function withoutStaged(candidates, opts) {
+  const staged = new Set((await readStagedRegistry()).map((item) => `${item.path}\0${item.size}`));
+  if (staged.size === 0) return candidates;
+  return candidates.filter((candidate) => {
+    if (!staged.has(`${candidate.path}\0${candidate.size}`)) return true;
+    log(opts, `skipping a file screenshot-agent staged: ${candidate.path}`);
+    return false;
+  });
+}
+
+function namePatternsPath() {
+  return path.join(stateDir(), 'name-patterns.json');
+}
+
+// namePattern reduces a file name to its shape: lowercase, extension
+// dropped, digit runs replaced by #, so every capture a tool names
+// "Shot_2024-05-01_101233.png" shares "shot_#-#-#_#".
+function namePattern(name) {
+  return path
+    .basename(name, path.extname(name))
+    .normalize('NFC')
+    .toLowerCase()
+    .replace(/\d+/g, '#');
+}
+
+async function readNamePatterns() {
+  try {
+    const patterns = JSON.parse(await fsp.readFile(namePatternsPath(), 'utf8'));
+    return patterns && typeof patterns === 'object' && !Array.isArray(patterns) ? patterns : {};
+  } catch (err) {
+    return {};
+  }
+}
+
+async function recordNamePattern(name) {
+  const patterns = await readNamePatterns();
+  const pattern = namePattern(name);
+  patterns[pattern] = (patterns[pattern] || 0) + 1;
+  const kept = Object.entries(patterns)
+    .sort((a, b) => b[1] - a[1])
+    .slice(0, NAME_PATTERNS_KEPT);
+  await fsp.mkdir(stateDir(), { recursive: true, mode: 0o700 });
+  await fsp.writeFile(namePatternsPath(), JSON.stringify(Object.fromEntries(kept)) + '\n', { mode: 0o600 });
+}
+
+// tagLearnedNames marks candidates whose name pattern was picked often
+// enough before as screenshot-named, so tools and locales the built-in
+// table misses still win over other images.
+async function tagLearnedNames(candidates, opts) {
+  const patterns = await readNamePatterns();
+  for (const candidate of candidates) {
+    if (candidate.tagged) continue;
+    const pattern = namePattern(candidate.path);
+    if ((patterns[pattern] || 0) < NAME_PATTERN_MIN) continue;
+    log(opts, `learned screenshot name "${pattern}": ${candidate.path}`);
+    candidate.tagged = true;
+  }
+}
+
+// agentOwnedDir reports whether dir is, or is inside, a directory this tool
+// keeps its own files in (state, stash, cache).
+function agentOwnedDir(dir) {
+  return [stateDir(), cacheDir()].some((owned) => {
+    const relative = path.relative(path.resolve(owned), dir);
+    return relative === '' || (!relative.startsWith('..') && !path.isAbsolute(relative));
+  });
+}
+
+function recentSourcesPath() {
+  return path.join(stateDir(), 'recent-sources.json');
+}
+
+async function readRecentSources() {
+  try {
+    const recent = JSON.parse(await fsp.readFile(recentSourcesPath(), 'utf8'));
+    return Array.isArray(recent) ? recent : [];
+  } catch (err) {
+    return [];
+  }
+}
+
+async function recordSource(kind) {
+  const recent = [...(await readRecentSources()), kind].slice(-RECENT_SOURCES_KEPT);
+  await fsp.mkdir(stateDir(), { recursive: true, mode: 0o700 });
+  await fsp.writeFile(recentSourcesPath(), JSON.stringify(recent) + '\n', { mode: 0o600 });
+}
+
+function lastReturnedPath() {
+  return path.join(stateDir(), 'last-returned.json');
+}
+
+// tracksReturned is whether --new-only applies: a PATH or stdin input is
+// what the caller asked for, new or not.
+function tracksReturned(selection) {
+  return selection.type === 'clipboard' || selection.type === 'file';
+}
+
+// alreadyReturned reports whether the last --new-only run returned this
+// candidate: the same bytes and, for a file, the same modification time, so
+// a new capture that happens to look identical still counts as new.
+async function alreadyReturned(selection, opts) {
+  if (!tracksReturned(selection)) return false;
+  let last;
+  try {
+    last = JSON.parse(await fsp.readFile(lastReturnedPath(), 'utf8'));
+  } catch (err) {
+    return false;
+  }
+  if (!last || last.modTimeMs !== (selection.candidate.modTimeMs || null)) return false;
+  if ((await selectionKey(selection)) !== last.key) return false;
+  log(opts, `already returned ${selection.type === 'file' ? selection.candidate.path : 'this clipboard image'}`);
+  return true;
+}
+
+async function recordReturned(selection, key) {
+  const entry = { key, modTimeMs: selection.candidate.modTimeMs || null, time: rfc3339(new Date()) };
+  await fsp.mkdir(stateDir(), { recursive: true, mode: 0o700 });
+  await fsp.writeFile(lastReturnedPath(), JSON.stringify(entry) + '\n', { mode: 0o600 });
+}
+
+// likelySource is the clipboard or file source when it produced at least 80%
+// of five or more recent results.
+function likelySource(recent) {
+  if (recent.length < 5) return '';
+  for (const kind of ['clipboard', 'file']) {
+    if (recent.filter((item) => item === kind).length / recent.length >= 0.8) return kind;
+  }
+  return '';
+}
+
+// withDeadline settles with the promise, or with a not-found error once the
+// soft deadline passes (calling onTimeout so the caller can note the skip).
+async function withDeadline(promise, deadline, onTimeout) {
+  if (!deadline) return promise;
+  let timer;
+  const timeout = new Promise((resolve) => {
+    timer = setTimeout(() => {
+      onTimeout();
+      resolve(notFoundError());
+    }, Math.max(0, deadline - Date.now()));
+  });
+  try {
+    return await Promise.race([promise, timeout]);
+  } finally {
+    clearTimeout(timer);
+  }
+}
+
+function readOnlyBlocks(opts, action) {
+  if (!opts.readOnly) return false;
+  process.stderr.write(`warning: read-only mode: skipped ${action}\n`);
+  return true;
+}
+
+function offlineBlocks(opts, action) {
+  if (!opts.offline) return false;
+  process.stderr.write(`warning: offline mode: skipped ${action}\n`);
+  return true;
+}
+
+function assertWritable(opts, command) {
+  if (opts.readOnly) {
+    throw new Error(`read-only mode: ${command} is disabled`);
+  }
+}
+
+function injectFailure(opts, stage) {
+  if (!opts.failStages || !opts.failStages.has(stage)) return;
+  const err = new Error(`${ERR_INJECTED} at stage ${stage}`);
+  err.code = ERR_INJECTED;
+  throw err;
+}
+
+function log(opts, message) {
+  if (!opts.verbose) return;
+  process.stderr.write(message + '\n');
+}
+
+// fileWins applies --prefer to a file and a clipboard image (null when the
+// clipboard wasn't read). Clipboard bytes no run has seen before have no
+// known time, so newest falls back to the --recency rule for them.
+function fileWins(file, clipboard, nowMs, opts) {
+  if (opts.prefer === 'file') return true;
+  if (opts.prefer === 'clipboard') return false;
+  if (opts.prefer === 'newest' && clipboard && clipboard.ageMs) {
+    return (file.timeMs || file.modTimeMs) > nowMs - clipboard.ageMs;
+  }
+  return preferFileCandidate(file, nowMs, opts);
+}
+
+function preferFileCandidate(candidate, nowMs, opts) {
+  const timeMs = candidate ? candidate.timeMs || candidate.modTimeMs : 0;
+  if (!timeMs) return false;
+  if (timeMs > nowMs) return true;
+  return nowMs - timeMs <= opts.recencyMs;
+}
+
+async function handleClipboardCandidate(candidate, opts) {
+  injectFailure(opts, 'copy');
+  const tempPath = await writeDataToTemp(candidate.data, 'clipboard', opts);
+  return { source: 'clipboard', tempPath };
+}
+
+async function pathCandidate(filePath) {
+  const absPath = path.resolve(filePath);
+  let info;
+  try {
+    info = await fsp.stat(absPath);
+  } catch (err) {
+    throw new Error(`${filePath}: ${err.code === 'ENOENT' ? 'no such file' : err.message}`);
+  }
+  if (!info.isFile()) {
+    throw new Error(`${filePath}: not a regular file`);
+  }
+  return { path: absPath, modTimeMs: info.mtimeMs, size: info.size };
+}
+
+async function handlePathCandidate(candidate, opts) {
+  injectFailure(opts, 'copy');
+  log(opts, `copying ${candidate.path} to temp`);
+  return { source: candidate.path, tempPath: await copyImageToTemp(fsPathOf(candidate), opts) };
+}
+
+async function handleFileCandidate(candidate, opts) {
+  const source = candidate.path;
+  injectFailure(opts, 'copy');
+  if (opts.readOnly || opts.consume === 'keep') {
+    log(opts, `${opts.readOnly ? 'read-only' : 'keep'}: copying ${candidate.path} to temp and leaving it in place`);
+    return { source, tempPath: await copyImageToTemp(fsPathOf(candidate), opts) };
+  }
+  if (candidate.dir === 'Screenshots') {
+    log(opts, `copying from the screenshots folder and leaving it in place: ${candidate.path}`);
+    return { source, tempPath: await copyImageToTemp(fsPathOf(candidate), opts) };
+  }
+  if (candidate.cloud && (await stillSyncing(candidate))) {
+    process.stderr.write(`warning: ${candidate.cloud} is still syncing ${candidate.path}; leaving it in place\n`);
+    return { source, tempPath: await copyImageToTemp(fsPathOf(candidate), opts) };
+  }
+  if (!(await dirWritable(path.dirname(candidate.path)))) {
+    return keepReadOnlySource(candidate, opts, null);
+  }
+  if (candidate.dir === 'Downloads') {
+    log(opts, `moving Downloads file to temp: ${candidate.path}`);
+    try {
+      const tempPath = await moveImageToTemp(fsPathOf(candidate), opts);
+      await journal('move', candidate, { path: tempPath });
+      await audit(opts, 'move', { original: candidate.path, location: tempPath, size: candidate.size }, tempPath);
+      return { source, tempPath };
+    } catch (err) {
+      if (!isReadOnlyError(err)) throw err;
+      return keepReadOnlySource(candidate, opts, err);
+    }
+  }
+  log(opts, `copying Desktop file to temp and ${opts.stash ? 'stashing' : 'trashing'}: ${candidate.path}`);
+  const tempPath = await copyImageToTemp(fsPathOf(candidate), opts);
+  try {
+    injectFailure(opts, 'trash');
+    await discardFile(candidate, opts);
+  } catch (err) {
+    if (err && err.code === ERR_UNSUPPORTED) {
+      process.stderr.write(`warning: ${err.message}; leaving ${candidate.path} in place\n`);
+      return { source, tempPath };
+    }
+    if (isReadOnlyError(err) && opts.consume !== 'strict') {
+      process.stderr.write(`warning: cannot trash ${candidate.path} (${err.code}); leaving it in place\n`);
+      return { source, tempPath };
+    }
+    await safeUnlink(tempPath);
+    throw err;
+  }
+  return { source, tempPath };
+}
+
+// keepReadOnlySource stages a copy of a file the run can't consume (mounted
+// DMG, protected folder) instead of failing, unless --consume strict.
+async function keepReadOnlySource(candidate, opts, err) {
+  const reason = err ? err.code : 'read-only location';
+  if (opts.consume === 'strict') {
+    throw new Error(`cannot consume ${candidate.path} (${reason}) and --consume is strict`);
+  }
+  process.stderr.write(`warning: cannot consume ${candidate.path} (${reason}); copying and leaving it in place\n`);
+  return { source: candidate.path, tempPath: await copyImageToTemp(fsPathOf(candidate), opts) };
+}
+
+function isReadOnlyError(err) {
+  return Boolean(err) && (err.code === 'EROFS' || err.code === 'EACCES' || err.code === 'EPERM');
+}
+
+async function dirWritable(dir) {
+  try {
+    await fsp.access(dir, fs.constants.W_OK);
+    return true;
+  } catch (err) {
+    return false;
+  }
+}
+
+const UNIX_DESKTOPS = ['linux', 'freebsd', 'openbsd', 'netbsd'];
+
+const CLIPBOARD_BACKENDS = [
+  {
+    name: 'pngpaste',
+    platforms: ['darwin'],
+    available: () => commandExists('pngpaste'),
+    read: (signal, maxBytes) => readClipboardPngpaste(signal, maxBytes),
+  },
+  {
+    name: 'osascript',
+    platforms: ['darwin'],
+    available: () => commandExists('osascript'),
+    read: (signal, maxBytes) => readClipboardOsascript('«class PNGf»', signal, maxBytes),
+  },
+  {
+    name: 'osascript-tiff',
+    platforms: ['darwin'],
+    available: () => commandExists('osascript') && commandExists('sips'),
+    read: (signal, maxBytes) => readClipboardOsascriptTiff(signal, maxBytes),
+  },
+  {
+    name: 'osascript-vector',
+    platforms: ['darwin'],
+    available: () => commandExists('osascript') && commandExists('sips'),
+    read: (signal, maxBytes, opts) => readClipboardVector(signal, maxBytes, opts),
+  },
+  {
+    name: 'wl-paste',
+    platforms: UNIX_DESKTOPS,
+    available: () => commandExists('wl-paste'),
+    read: (signal, maxBytes) => readClipboardStdout('wl-paste', ['--type', 'image/png'], signal, maxBytes),
+  },
+  {
+    name: 'xclip',
+    platforms: UNIX_DESKTOPS,
+    available: () => commandExists('xclip'),
+    read: (signal, maxBytes) =>
+      readClipboardStdout('xclip', ['-selection', 'clipboard', '-t', 'image/png', '-o'], signal, maxBytes),
+  },
+  {
+    name: 'powershell',
+    platforms: ['win32'],
+    available: () => commandExists('powershell'),
+    read: (signal, maxBytes) => readClipboardPowershell(signal, maxBytes),
+  },
+  // Clipboard managers hand back the newest image in their history, which
+  // may be old, so they only run when named in --clipboard-backend, after
+  // the live clipboard: --clipboard-backend osascript,maccy.
+  {
+    name: 'maccy',
+    platforms: ['darwin'],
+    history: true,
+    available: () => commandExists('sqlite3') && fs.existsSync(maccyDatabase()),
+    read: (signal, maxBytes) => readClipboardMaccy(signal, maxBytes),
+  },
+  {
+    name: 'copyq',
+    platforms: ['darwin', 'linux', 'win32', 'freebsd', 'openbsd', 'netbsd'],
+    history: true,
+    available: () => commandExists('copyq'),
+    read: (signal, maxBytes) => readClipboardStdout('copyq', ['eval', COPYQ_LATEST_IMAGE], signal, maxBytes),
+  },
+];
+
+function maccyDatabase() {
+  return path.join(
+    os.homedir(),
+    'Library/Containers/org.p0deje.Maccy/Data/Library/Application Support/Maccy/Storage.sqlite',
+  );
+}
+
+// readClipboardMaccy reads the newest PNG or TIFF item from Maccy's Core
+// Data store (read-only, so Maccy keeps running undisturbed).
+async function readClipboardMaccy(signal, maxBytes) {
+  const query = [
+    'SELECT c.ZTYPE, hex(c.ZVALUE) FROM ZHISTORYITEMCONTENT c JOIN ZHISTORYITEM i ON c.ZITEM = i.Z_PK',
+    "WHERE c.ZTYPE IN ('public.png', 'public.tiff')",
+    "ORDER BY i.ZLASTCOPIEDAT DESC, c.ZTYPE = 'public.png' DESC LIMIT 1;",
+  ].join(' ');
+  // hex() doubles the size.
+  const limit = (maxBytes || CLIPBOARD_MAX_BUFFER) * 2 + 64;
+  const args = ['-readonly', '-separator', '\t', maccyDatabase(), query];
+  const out = (await readClipboardStdout('sqlite3', args, signal, limit).catch((err) => {
+    throw err && err.code === ERR_TOO_LARGE ? tooLargeError(null, maxBytes || CLIPBOARD_MAX_BUFFER) : err;
+  }))
+    .toString('latin1')
+    .trim();
+  if (!out) return null;
+  const [type, hex] = out.split('\t');
+  const data = Buffer.from(hex || '', 'hex');
+  if (maxBytes && data.length > maxBytes) throw tooLargeError(data.length, maxBytes);
+  return type === 'public.tiff' ? tiffToPng(data, signal, maxBytes) : data;
+}
+
+// COPYQ_LATEST_IMAGE prints the newest PNG among the first 50 items of
+// CopyQ's current tab.
+const COPYQ_LATEST_IMAGE = [
+  'for (var i = 0; i < Math.min(size(), 50); ++i) {',
+  "  var data = read('image/png', i);",
+  '  if (data.length) { print(data); break; }',
+  '}',
+].join('\n');
+
+function clipboardBackendChain(names) {
+  if (!names || names.length === 0) {
+    return CLIPBOARD_BACKENDS.filter((backend) => !backend.history);
+  }
+  return names.map((name) => {
+    const backend = CLIPBOARD_BACKENDS.find((item) => item.name === name);
+    if (!backend) {
+      throw new Error(
+        `unknown clipboard backend: ${name} (known: ${CLIPBOARD_BACKENDS.map((item) => item.name).join(', ')})`,
+      );
+    }
+    return backend;
+  });
+}
+
+async function readClipboardImage(opts, signal) {
+  injectFailure(opts, 'clipboard');
+  const chain = clipboardBackendChain(opts.clipboardBackends);
+  if (!chain.some((backend) => backend.platforms.includes(process.platform))) {
+    throw unsupportedError('clipboard', CLIPBOARD_BACKENDS.flatMap((backend) => backend.platforms));
+  }
+  for (const backend of chain) {
+    if (!backend.platforms.includes(process.platform)) {
+      log(opts, `clipboard backend ${backend.name}: not supported on ${process.platform}`);
+      continue;
+    }
+    if (!backend.available()) {
+      log(opts, `clipboard backend ${backend.name}: not available`);
+      continue;
+    }
+    if (signal && signal.aborted) break;
+    try {
+      const data = await backend.read(signal, opts.maxClipboardBytes, opts);
+      if (data && data.length > 0) {
+        log(opts, `clipboard backend ${backend.name}: read ${data.length} bytes`);
+        return { data, backend: backend.name };
+      }
+      log(opts, `clipboard backend ${backend.name}: no image`);
+    } catch (err) {
+      if (err && err.code === ERR_TOO_LARGE) {
+        // Every backend sees the same pasteboard, so stop here and let the
+        // file candidates win.
+        process.stderr.write(`warning: ${err.message}; ignoring clipboard\n`);
+        break;
+      }
+      log(opts, `clipboard backend ${backend.name}: ${err.message || String(err)}`);
+    }
+  }
+  throw notFoundError();
+}
+
+async function readClipboardPngpaste(signal, maxBytes) {
+  const tmp = await tempPath('clipboard-XXXXXX.png');
+  try {
+    await runProcess('pngpaste', [tmp], { signal });
+    return await readClipboardFile(tmp, maxBytes);
+  } finally {
+    await safeUnlink(tmp);
+  }
+}
+
+async function readClipboardOsascript(flavor, signal, maxBytes, pattern = 'clipboard-XXXXXX.png') {
+  const tmp = await tempPath(pattern);
+  try {
+    const safeTmp = tmp.replace(/"/g, '\\"');
+    const script = [
+      `set theData to (the clipboard as ${flavor})`,
+      `set theFile to POSIX file "${safeTmp}"`,
+      'set theFileRef to open for access theFile with write permission',
+      'set eof of theFileRef to 0',
+      'write theData to theFileRef',
+      'close access theFileRef',
+    ];
+    const args = [];
+    for (const line of script) {
+      args.push('-e', line);
+    }
+    await runProcess('osascript', args, { signal });
+    return await readClipboardFile(tmp, maxBytes);
+  } finally {
+    await safeUnlink(tmp);
+  }
+}
+
+// Some apps only put TIFF on the pasteboard; sips converts it without any
+// compiled helper.
+async function readClipboardOsascriptTiff(signal, maxBytes) {
+  const tiff = await readClipboardOsascript('«class TIFF»', signal, maxBytes, 'clipboard-XXXXXX.tiff');
+  if (!tiff) return null;
+  return tiffToPng(tiff, signal, maxBytes);
+}
+
+async function tiffToPng(tiff, signal, maxBytes) {
+  const src = await tempPath('clipboard-XXXXXX.tiff');
+  const dst = await tempPath('clipboard-XXXXXX.png');
+  try {
+    await fsp.writeFile(src, tiff);
+    await runProcess('sips', ['-s', 'format', 'png', src, '--out', dst], { signal });
+    return await readClipboardFile(dst, maxBytes);
+  } finally {
+    await safeUnlink(src);
+    await safeUnlink(dst);
+  }
+}
+
+// Windows apps put a "PNG" format on the clipboard when they can (it keeps
+// alpha); otherwise the CF_DIB bitmap behind Clipboard.GetImage is saved as
+// PNG. Windows PowerShell runs STA by default, which the clipboard needs.
+async function readClipboardPowershell(signal, maxBytes) {
+  const tmp = await tempPath('clipboard-XXXXXX.png');
+  try {
+    const safeTmp = tmp.replace(/'/g, "''");
+    const script = [
+      'Add-Type -AssemblyName System.Windows.Forms, System.Drawing',
+      "$png = [Windows.Forms.Clipboard]::GetData('PNG')",
+      'if ($png -is [IO.MemoryStream]) {',
+      `  [IO.File]::WriteAllBytes('${safeTmp}', $png.ToArray())`,
+      '} else {',
+      '  $image = [Windows.Forms.Clipboard]::GetImage()',
+      "  if ($image) { $image.Save('" + safeTmp + "', [Drawing.Imaging.ImageFormat]::Png) }",
+      '}',
+    ].join('\n');
+    await runProcess('powershell', ['-NoProfile', '-NonInteractive', '-STA', '-Command', script], { signal });
+    return await readClipboardFile(tmp, maxBytes);
+  } finally {
+    await safeUnlink(tmp);
+  }
+}
+
+// Design tools (Sketch, Preview, Illustrator) often put only PDF or SVG on
+// the pasteboard. AppleScript has no class for those, so JXA asks
+// NSPasteboard for the raw data and the rasterizers turn it into PNG.
+const PASTEBOARD_VECTOR_TYPES = [
+  { uti: 'com.adobe.pdf', ext: '.pdf' },
+  { uti: 'public.svg-image', ext: '.svg' },
+];
+
+async function readClipboardVector(signal, maxBytes, opts) {
+  const script = [
+    'function run(argv) {',
+    "  ObjC.import('AppKit');",
+    '  const data = $.NSPasteboard.generalPasteboard.dataForType(argv[0]);',
+    "  if (!data || data.isNil()) return 'none';",
+    '  data.writeToFileAtomically(argv[1], true);',
+    "  return 'ok';",
+    '}',
+  ].join('\n');
+  for (const { uti, ext } of PASTEBOARD_VECTOR_TYPES) {
+    const tmp = await tempPath(`clipboard-XXXXXX${ext}`);
+    let png = '';
+    try {
+      await runProcess('osascript', ['-l', 'JavaScript', '-e', script, uti, tmp], { signal });
+      if (!(await readClipboardFile(tmp, maxBytes))) continue;
+      png = await rasterizeStaged(tmp, opts);
+      return await readClipboardFile(png, maxBytes);
+    } finally {
+      await safeUnlink(tmp);
+      if (png) await safeUnlink(png);
+    }
+  }
+  return null;
+}
+
+// readClipboardFile returns the bytes a backend wrote, or null when it wrote
+// nothing; payloads over maxBytes are refused before they are read.
+async function readClipboardFile(file, maxBytes) {
+  if (!(await fileHasContent(file))) return null;
+  if (maxBytes) {
+    const info = await fsp.stat(file);
+    if (info.size > maxBytes) throw tooLargeError(info.size, maxBytes);
+  }
+  return fsp.readFile(file);
+}
+
+async function readClipboardStdout(cmd, args, signal, maxBytes) {
+  try {
+    return await runProcess(cmd, args, { signal, maxBuffer: maxBytes });
+  } catch (err) {
+    if (maxBytes && err && err.code === 'ERR_CHILD_PROCESS_STDIO_MAXBUFFER') {
+      throw tooLargeError(null, maxBytes);
+    }
+    throw err;
+  }
+}
+
+function tooLargeError(size, maxBytes) {
+  const actual = size === null ? 'more than' : `${formatBytes(size)} >`;
+  const err = new Error(`clipboard image too large (${actual} --max-clipboard-bytes ${formatBytes(maxBytes)})`);
+  err.code = ERR_TOO_LARGE;
+  return err;
+}
+
+// runProcess runs cmd without blocking the event loop, so timers (soft
+// timeouts) keep firing; an aborted signal kills the child.
+function runProcess(cmd, args, options = {}) {
+  return new Promise((resolve, reject) => {
+    const child = execFile(
+      cmd,
+      args,
+      { encoding: 'buffer', maxBuffer: options.maxBuffer || CLIPBOARD_MAX_BUFFER, signal: options.signal },
+      (err, stdout) => {
+        helperChildren.delete(child);
+        if (err) {
+          reject(err);
+          return;
+        }
+        resolve(stdout);
+      },
+    );
+    helperChildren.add(child);
+  });
+}
+
+// helperChildren holds clipboard helpers still running. A reader left behind
+// (a losing backend, a soft timeout) keeps an X11 connection open and can
+// stall clipboard managers, so shutdownClipboard ends them once a source is
+// chosen.
+const helperChildren = new Set();
+
+function shutdownClipboard(opts) {
+  for (const child of helperChildren) {
+    log(opts, `stopping clipboard helper ${child.spawnfile} (pid ${child.pid})`);
+    child.kill();
+    helperChildren.delete(child);
+  }
+}
+
+// spawnDetached starts a clipboard writer in its own session with no ties
+// to this process, so a one-shot run exits at once while the writer keeps
+// serving the selection (and survives the caller's process group ending).
+function spawnDetached(cmd, args, input) {
+  const child = spawn(cmd, args, { detached: true, stdio: [input ? 'pipe' : 'ignore', 'ignore', 'ignore'] });
+  child.on('error', () => {});
+  if (input) {
+    child.stdin.on('error', () => {});
+    child.stdin.end(input);
+  }
+  child.unref();
+}
+
+const CLIPBOARD_WRITERS = [
+  {
+    name: 'osascript',
+    platforms: ['darwin'],
+    available: () => commandExists('osascript'),
+    write: (file, mime, text) => {
+      if (text) {
+        // JXA can put several flavors on the pasteboard in one go.
+        const script = [
+          "ObjC.import('AppKit');",
+          'const pb = $.NSPasteboard.generalPasteboard;',
+          'pb.clearContents;',
+          `pb.setDataForType($.NSData.dataWithContentsOfFile(${JSON.stringify(file)}), ${
+            mime === 'image/jpeg' ? "'public.jpeg'" : '$.NSPasteboardTypePNG'
+          });`,
+          `pb.setStringForType(${JSON.stringify(text)}, $.NSPasteboardTypeString);`,
+        ].join('\n');
+        execFileSync('osascript', ['-l', 'JavaScript', '-e', script], { stdio: 'ignore' });
+        return true;
+      }
+      const flavor = mime === 'image/jpeg' ? '«class JPEG»' : '«class PNGf»';
+      const safeFile = file.replace(/"/g, '\\"');
+      execFileSync('osascript', ['-e', `set the clipboard to (read (POSIX file "${safeFile}") as ${flavor})`], {
+        stdio: 'ignore',
+      });
+      return false;
+    },
+    writeText: (text) => execFileSync('pbcopy', [], { input: text, stdio: ['pipe', 'ignore', 'ignore'] }),
+  },
+  {
+    name: 'wl-copy',
+    platforms: UNIX_DESKTOPS,
+    available: () => commandExists('wl-copy') && Boolean(process.env.WAYLAND_DISPLAY),
+    write: (file, mime, text, detach) => {
+      if (detach) {
+        spawnDetached('wl-copy', ['--type', mime], fs.readFileSync(file));
+        return false;
+      }
+      execFileSync('wl-copy', ['--type', mime], { input: fs.readFileSync(file), stdio: ['pipe', 'ignore', 'ignore'] });
+      return false;
+    },
+    writeText: (text) => spawnDetached('wl-copy', ['--type', 'text/plain;charset=utf-8'], Buffer.from(text)),
+  },
+  {
+    name: 'xclip',
+    platforms: UNIX_DESKTOPS,
+    available: () => commandExists('xclip'),
+    write: (file, mime, text, detach) => {
+      if (detach) {
+        spawnDetached('xclip', ['-selection', 'clipboard', '-t', mime, '-i', file], null);
+        return false;
+      }
+      execFileSync('xclip', ['-selection', 'clipboard', '-t', mime, '-i', file], { stdio: 'ignore' });
+      return false;
+    },
+    writeText: (text) => spawnDetached('xclip', ['-selection', 'clipboard', '-t', 'UTF8_STRING'], Buffer.from(text)),
+  },
+];
+
+// writeClipboardText replaces the clipboard with plain text.
+async function writeClipboardText(text, opts) {
+  const writers = CLIPBOARD_WRITERS.filter((writer) => writer.platforms.includes(process.platform));
+  if (writers.length === 0) {
+    throw unsupportedError('clipboard write', CLIPBOARD_WRITERS.flatMap((writer) => writer.platforms));
+  }
+  for (const writer of writers) {
+    if (!writer.available()) continue;
+    try {
+      writer.writeText(text);
+      log(opts, `wrote text to clipboard via ${writer.name}`);
+      return;
+    } catch (err) {
+      log(opts, `clipboard writer ${writer.name}: ${err.message || String(err)}`);
+    }
+  }
+  throw new Error('unable to write clipboard (need osascript, wl-copy, or xclip)');
+}
+
+// writeClipboardImage puts the image on the clipboard, plus text as a second
+// flavor where the writer supports it (only macOS can hold both at once).
+async function writeClipboardImage(file, opts, text = '') {
+  const mime = imageMimeType(file);
+  const writers = CLIPBOARD_WRITERS.filter((writer) => writer.platforms.includes(process.platform));
+  if (writers.length === 0) {
+    throw unsupportedError('clipboard write', CLIPBOARD_WRITERS.flatMap((writer) => writer.platforms));
+  }
+  for (const writer of writers) {
+    if (!writer.available()) continue;
+    try {
+      const wroteText = writer.write(file, mime, text, opts.detachClipboard);
+      log(opts, `wrote ${file} to clipboard via ${writer.name}`);
+      if (text && !wroteText) {
+        log(opts, `clipboard writer ${writer.name} holds one flavor; OCR text not added`);
+      }
+      return;
+    } catch (err) {
+      log(opts, `clipboard writer ${writer.name}: ${err.message || String(err)}`);
+    }
+  }
+  throw new Error('unable to write clipboard (need osascript, wl-copy, or xclip)');
+}
+
+function imageMimeType(file) {
+  switch (path.extname(file).toLowerCase()) {
+    case '.jpg':
+    case '.jpeg':
+      return 'image/jpeg';
+    case '.tif':
+      return 'image/tiff';
+    case '.webp':
+    case '.gif':
+    case '.heic':
+    case '.heif':
+    case '.tiff':
+    case '.bmp':
+    case '.avif':
+      return `image/${path.extname(file).slice(1).toLowerCase()}`;
+    default:
+      return 'image/png';
+  }
+}
+
+const DELIVERY_RETRIES = 2;
+const DELIVERY_BACKOFF_MS = 1000;
+const DELIVERY_TIMEOUT_MS = 60 * 1000;
+// Network errors worth another attempt; anything else (a refused
+// credential, a bad URL) would only fail the same way again.
+const RETRYABLE_CODES = new Set([
+  'EAI_AGAIN',
+  'ECONNABORTED',
+  'ECONNREFUSED',
+  'ECONNRESET',
+  'EHOSTUNREACH',
+  'ENETUNREACH',
+  'EPIPE',
+  'ETIMEDOUT',
+]);
+
+// DELIVERY_TYPES are the kinds of [targets.NAME] table, each with the keys
+// it needs. deliver sends the staged image and returns where it went: the
+// archived path, or the share url. --offline skips the network ones.
+const DELIVERY_TYPES = [
+  { name: 'archive', required: ['dir'], deliver: deliverArchive },
+  { name: 'put', required: ['url'], deliver: deliverPut, network: true },
+  { name: 's3', required: ['bucket'], deliver: deliverS3, network: true },
+  { name: 'webhook', required: ['url'], deliver: deliverWebhook, network: true },
+];
+
+// checkTarget validates one [targets.NAME] table from the config.
+function checkTarget(name, spec) {
+  const where = `config: targets.${name}`;
+  if (typeof spec !== 'object' || Array.isArray(spec)) throw new Error(`${where} must be a table`);
+  const type = DELIVERY_TYPES.find((item) => item.name === spec.type);
+  if (!type) {
+    throw new Error(`${where}: invalid type: ${spec.type} (${DELIVERY_TYPES.map((item) => item.name).join(', ')})`);
+  }
+  for (const key of type.required) {
+    if (typeof spec[key] !== 'string' || !spec[key]) throw new Error(`${where}: missing ${key}`);
+  }
+  const headers = spec.headers === undefined ? {} : spec.headers;
+  if (typeof headers !== 'object' || Array.isArray(headers)) throw new Error(`${where}: headers must be a table`);
+  for (const [key, value] of Object.entries(headers)) {
+    if (typeof value !== 'string') throw new Error(`${where}: header ${key} must be a string`);
+  }
+  if (spec.secret !== undefined && (typeof spec.secret !== 'string' || !spec.secret)) {
+    throw new Error(`${where}: invalid secret: ${spec.secret}`);
+  }
+  for (const [key, value] of Object.entries(headers)) {
+    if (value.includes('{secret}') && !spec.secret) {
+      throw new Error(`${where}: header ${key} uses {secret} but no secret is set`);
+    }
+  }
+  const retries = spec.retries === undefined ? DELIVERY_RETRIES : spec.retries;
+  if (!Number.isInteger(retries) || retries < 0) throw new Error(`${where}: invalid retries: ${spec.retries}`);
+  const backoffMs = spec.backoff === undefined ? DELIVERY_BACKOFF_MS : parseDuration(String(spec.backoff));
+  if (backoffMs === null) throw new Error(`${where}: invalid backoff: ${spec.backoff}`);
+  const timeoutMs = spec.timeout === undefined ? DELIVERY_TIMEOUT_MS : parseDuration(String(spec.timeout));
+  if (!timeoutMs) throw new Error(`${where}: invalid timeout: ${spec.timeout}`);
+  return { ...spec, name, headers, retries, backoffMs, timeoutMs };
+}
+
+// deliveryTargets lists the targets a run sends to: --upload as a put
+// target named upload, then the --deliver (or deliver) targets.
+function deliveryTargets(opts) {
+  const targets = [];
+  if (opts.upload) {
+    targets.push(checkTarget('upload', { type: 'put', url: opts.upload, url_format: opts.urlFormat }));
+  }
+  for (const name of opts.deliver) targets.push(opts.targets[name]);
+  return targets;
+}
+
+// deliverResult sends the staged image to every target at once. Each one
+// gets an entry in result.deliveries, and result.url is the first share
+// link among them (read back from the server, or built from url_format).
+// A failed target never undoes the others or the staged result; it
+// returns how many failed.
+async function deliverResult(result, opts) {
+  const targets = deliveryTargets(opts).filter((target) => {
+    const type = DELIVERY_TYPES.find((item) => item.name === target.type);
+    return !(type.network && offlineBlocks(opts, `delivery to ${target.name}`));
+  });
+  if (targets.length === 0) return 0;
+  const data = await fsp.readFile(result.tempPath);
+  const sha256 = crypto.createHash('sha256').update(data).digest('hex');
+  const ext = path.extname(result.tempPath).slice(1).toLowerCase();
+  let ca = '';
+  if (opts.caCert) {
+    try {
+      ca = await fsp.readFile(opts.caCert, 'utf8');
+    } catch (err) {
+      throw new Error(`--ca-cert: ${err.message}`);
+    }
+  }
+  const ctx = {
+    result,
+    data,
+    sha256,
+    ca,
+    mime: imageMimeType(result.tempPath),
+    vars: {
+      key: `${sha256.slice(0, 16)}${ext ? `.${ext}` : ''}`,
+      name: path.basename(result.tempPath),
+      sha256,
+      ext,
+      date: rfc3339(new Date()).slice(0, 10),
+    },
+  };
+  result.deliveries = await Promise.all(
+    targets.map(async (target) => {
+      const type = DELIVERY_TYPES.find((item) => item.name === target.type);
+      log(opts, `delivering ${result.tempPath} to ${target.name} (${target.type})`);
+      let attempts = 0;
+      try {
+        const where = await withRetries(target, opts, () => {
+          attempts += 1;
+          return type.deliver(target, ctx, opts);
+        });
+        const event = target.type === 'archive' ? 'archive' : 'upload';
+        await audit(opts, event, { target: target.name, tempPath: result.tempPath, ...where, size: data.length }, data);
+        return { target: target.name, type: target.type, ok: true, attempts, ...where };
+      } catch (err) {
+        const message = err.message || String(err);
+        const tries = attempts > 1 ? ` after ${attempts} attempts` : '';
+        process.stderr.write(`delivery to ${target.name} failed${tries}: ${message}\n`);
+        return { target: target.name, type: target.type, ok: false, attempts, error: message };
+      }
+    }),
+  );
+  const failed = result.deliveries.filter((item) => !item.ok);
+  if (failed.length > 0) {
+    const total = result.deliveries.length;
+    const names = failed.map((item) => item.target).join(', ');
+    process.stderr.write(`delivered to ${total - failed.length} of ${total} targets (failed: ${names}); result kept\n`);
+  }
+  const linked = result.deliveries.find((item) => item.ok && item.url);
+  if (linked) result.url = linked.url;
+  if (opts.copyUrl && result.url && !readOnlyBlocks(opts, 'overwriting the clipboard')) {
+    await writeClipboardText(result.url, opts);
+  }
+  return failed.length;
+}
+
+// withRetries runs one delivery, trying again up to target.retries times
+// after a network error, a 5xx, or a 429, waiting backoff and then twice as
+// long each time.
+async function withRetries(target, opts, fn) {
+  for (let attempt = 0; ; attempt += 1) {
+    try {
+      return await fn();
+    } catch (err) {
+      if (attempt >= target.retries || !(err.retryable || RETRYABLE_CODES.has(err.code))) throw err;
+      const waitMs = target.backoffMs * 2 ** attempt;
+      log(opts, `${target.name}: ${err.message || String(err)}; retrying in ${formatAge(waitMs)}`);
+      await sleep(waitMs);
+    }
+  }
+}
+
+// deliverArchive copies the image into dir under name (default {key}, so
+// the archive is content-addressed and the same image is kept once).
+async function deliverArchive(target, ctx, opts) {
+  const name = fillTemplate(target.name_format || '{key}', ctx.vars, (value) => value.replace(/[\\/]/g, '_'));
+  let dest = path.join(expandHome(target.dir), name);
+  const existing = await fsp.readFile(dest).catch(() => null);
+  if (existing && crypto.createHash('sha256').update(existing).digest('hex') === ctx.sha256) return { path: dest };
+  await makeDirs(path.dirname(dest), opts);
+  dest = await placeTarget(dest, 'rename', opts);
+  await copyFile(ctx.result.tempPath, dest);
+  await applyPermissions(dest, opts, false);
+  return { path: dest };
+}
+
+// deliverPut PUTs the image to url. The share link is url_format filled
+// in, else the link the server answered with (a Location header, a url or
+// link field in JSON, or a bare URL in the body), else url itself.
+async function deliverPut(target, ctx) {
+  const url = fillTemplate(target.url, ctx.vars, encodeURIComponent);
+  const res = await httpRequest(url, {
+    method: 'PUT',
+    headers: { 'Content-Type': ctx.mime, 'Content-Length': ctx.data.length, ...targetHeaders(target) },
+    body: ctx.data,
+    timeoutMs: target.timeoutMs,
+    ca: ctx.ca,
+  });
+  checkStatus(res, url);
+  return { url: shareLink(target, ctx.vars, answeredUrl(res) || url) };
+}
+
+// deliverS3 PUTs the image as bucket/KEY (key_format, default {key}),
+// signed with AWS Signature Version 4. The keys come from the target's
+// secret (ACCESS_KEY_ID:SECRET_ACCESS_KEY[:SESSION_TOKEN]), else the usual
+// AWS_* environment variables. endpoint points it at an S3-compatible
+// store (path-style).
+async function deliverS3(target, ctx) {
+  let creds = {
+    accessKey: process.env.AWS_ACCESS_KEY_ID || '',
+    secretKey: process.env.AWS_SECRET_ACCESS_KEY || '',
+    sessionToken: process.env.AWS_SESSION_TOKEN || '',
+  };
+  if (target.secret) {
+    const [accessKey = '', secretKey = '', sessionToken = ''] = readSecret(target.secret).split(':');
+    creds = { accessKey, secretKey, sessionToken };
+    if (!accessKey || !secretKey) throw new Error(`secret ${target.secret} is not ACCESS_KEY_ID:SECRET_ACCESS_KEY`);
+  }
+  if (!creds.accessKey || !creds.secretKey) throw new Error('AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are not set');
+  const region = target.region || process.env.AWS_REGION || 'us-east-1';
+  const key = fillTemplate(target.key_format || '{key}', ctx.vars, (value) => value);
+  const base = target.endpoint
+    ? `${target.endpoint.replace(/\/+$/, '')}/${target.bucket}`
+    : `https://${target.bucket}.s3.${region}.amazonaws.com`;
+  const url = `${base}/${key.split('/').map(s3Escape).join('/')}`;
+  const headers = { 'Content-Type': ctx.mime, 'Content-Length': ctx.data.length, ...targetHeaders(target) };
+  signS3('PUT', new URL(url), headers, ctx.sha256, region, creds, new Date());
+  const res = await httpRequest(url, {
+    method: 'PUT',
+    headers,
+    body: ctx.data,
+    timeoutMs: target.timeoutMs,
+    ca: ctx.ca,
+  });
+  checkStatus(res, url);
+  return { url: shareLink(target, ctx.vars, url) };
+}
+
+// s3Escape is encodeURIComponent plus the characters SigV4 also requires
+// to be escaped.
+function s3Escape(value) {
+  return encodeURIComponent(value).replace(/[!'()*]/g, (ch) => `%${ch.charCodeAt(0).toString(16).toUpperCase()}`);
+}
+
+// signS3 adds the SigV4 headers (x-amz-*, Authorization) to headers,
+// signing every header given.
+function signS3(method, url, headers, payloadHash, region, creds, date) {
+  const amzDate = date.toISOString().replace(/[-:]/g, '').replace(/\.\d{3}/, '');
+  const day = amzDate.slice(0, 8);
+  headers.host = url.host;
+  headers['x-amz-date'] = amzDate;
+  headers['x-amz-content-sha256'] = payloadHash;
+  if (creds.sessionToken) headers['x-amz-security-token'] = creds.sessionToken;
+  const entries = Object.entries(headers)
+    .map(([key, value]) => [key.toLowerCase(), String(value).trim()])
+    .sort((a, b) => (a[0] < b[0] ? -1 : 1));
+  const signed = entries.map(([key]) => key).join(';');
+  const canonical = [
+    method,
+    url.pathname,
+    url.search.slice(1),
+    entries.map(([key, value]) => `${key}:${value}\n`).join(''),
+    signed,
+    payloadHash,
+  ].join('\n');
+  const scope = `${day}/${region}/s3/aws4_request`;
+  const toSign = ['AWS4-HMAC-SHA256', amzDate, scope, crypto.createHash('sha256').update(canonical).digest('hex')];
+  let key = `AWS4${creds.secretKey}`;
+  for (const part of [day, region, 's3', 'aws4_request']) key = crypto.createHmac('sha256', key).update(part).digest();
+  const signature = crypto.createHmac('sha256', key).update(toSign.join('\n')).digest('hex');
+  headers.authorization =
+    `AWS4-HMAC-SHA256 Credential=${creds.accessKey}/${scope}, SignedHeaders=${signed}, Signature=${signature}`;
+}
+
+// deliverWebhook POSTs the result JSON (not the image) to url, to tell
+// another service a capture is ready.
+async function deliverWebhook(target, ctx) {
+  const body = Buffer.from(JSON.stringify(resultJson(ctx.result)));
+  const res = await httpRequest(target.url, {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json', 'Content-Length': body.length, ...targetHeaders(target) },
+    body,
+    timeoutMs: target.timeoutMs,
+    ca: ctx.ca,
+  });
+  checkStatus(res, target.url);
+  return {};
+}
+
+// targetHeaders returns the target's extra headers with {secret} replaced
+// by its secret, so a token needn't sit in the config file.
+function targetHeaders(target) {
+  const headers = {};
+  for (const [key, value] of Object.entries(target.headers)) {
+    headers[key] = value.includes('{secret}') ? value.split('{secret}').join(readSecret(target.secret)) : value;
+  }
+  return headers;
+}
+
+// shareLink fills in a target's url_format, where {url} is the link the
+// upload itself produced; without one that link is the share link.
+function shareLink(target, vars, url) {
+  return target.url_format ? fillTemplate(target.url_format, { ...vars, url }, encodeURIComponent) : url;
+}
+
+function checkStatus(res, url) {
+  if (res.status >= 200 && res.status < 300) return;
+  const err = new Error(`${url}: HTTP ${res.status}${res.body ? `: ${res.body.slice(0, 200)}` : ''}`);
+  err.retryable = res.status >= 500 || res.status === 429;
+  throw err;
+}
+
+// fillTemplate replaces {name} placeholders with vars, passing each value
+// through escape; {url} is inserted as is, being a URL already.
+function fillTemplate(template, vars, escape) {
+  return template.replace(/\{(\w+)\}/g, (match, key) => {
+    if (!Object.prototype.hasOwnProperty.call(vars, key)) {
+      throw new Error(`unknown placeholder ${match} in ${template}`);
+    }
+    return key === 'url' ? vars[key] : escape(vars[key]);
+  });
+}
+
+function answeredUrl(res) {
+  if (res.headers.location) return new URL(res.headers.location, res.url).href;
+  const body = res.body.trim();
+  if (/^https?:\/\/\S+$/.test(body)) return body;
+  try {
+    const json = JSON.parse(body);
+    const node = json && typeof json.data === 'object' && json.data ? json.data : json;
+    for (const key of ['url', 'link']) {
+      if (node && typeof node[key] === 'string') return node[key];
+    }
+  } catch (err) {
+    // not JSON
+  }
+  return '';
+}
+
+// httpRequest sends one request with an in-memory body and resolves with
+// the status, headers, and the response body as text. It goes through the
+// proxy named by http_proxy/https_proxy (or their upper-case forms) unless
+// NO_PROXY exempts the host, and ca (PEM) is trusted besides the system's
+// roots.
+async function httpRequest(url, { method = 'GET', headers = {}, body = null, timeoutMs = 0, ca = '' } = {}) {
+  let parsed;
+  try {
+    parsed = new URL(url);
+  } catch (err) {
+    throw new Error(`invalid URL: ${url}`);
+  }
+  if (parsed.protocol !== 'http:' && parsed.protocol !== 'https:') {
+    throw new Error(`unsupported URL scheme: ${parsed.protocol}`);
+  }
+  const secure = parsed.protocol === 'https:';
+  const trust = ca ? { ca: [...tls.rootCertificates, ca] } : {};
+  const proxy = proxyFor(parsed);
+  if (!proxy) {
+    const options = { method, headers, ...(secure ? trust : {}) };
+    return sendRequest(url, secure ? https : http, parsed, options, body, timeoutMs);
+  }
+  if (proxy.protocol !== 'http:') throw new Error(`unsupported proxy scheme: ${proxy.protocol}`);
+  if (!secure) {
+    // A plain-HTTP proxy takes the whole URL as the request target.
+    const options = { method, path: parsed.href, headers: { ...headers, Host: parsed.host, ...proxyAuth(proxy) } };
+    return sendRequest(url, http, proxy, options, body, timeoutMs, parsed.host);
+  }
+  const socket = await connectTunnel(proxy, parsed, timeoutMs);
+  const hostname = parsed.hostname.replace(/^\[|\]$/g, '');
+  const secured = tls.connect({ socket, servername: net.isIP(hostname) ? undefined : hostname, ...trust });
+  return sendRequest(url, https, parsed, { method, headers, createConnection: () => secured }, body, timeoutMs);
+}
+
+function sendRequest(url, client, endpoint, options, body, timeoutMs, label = endpoint.host) {
+  return new Promise((resolve, reject) => {
+    const req = client.request(endpoint, options, (res) => {
+      const chunks = [];
+      res.on('data', (chunk) => chunks.push(chunk));
+      res.on('end', () =>
+        resolve({ url, status: res.statusCode, headers: res.headers, body: Buffer.concat(chunks).toString('utf8') }),
+      );
+      res.on('error', reject);
+    });
+    if (timeoutMs) {
+      req.setTimeout(timeoutMs, () => {
+        const err = new Error(`${label}: timed out after ${formatAge(timeoutMs)}`);
+        err.code = 'ETIMEDOUT';
+        req.destroy(err);
+      });
+    }
+    req.on('error', reject);
+    req.end(body || undefined);
+  });
+}
+
+// proxyFor returns the proxy URL for a request, or null to connect
+// directly. NO_PROXY entries match a host and its subdomains (a leading
+// dot or *. is optional), optionally with :PORT; * matches every host.
+function proxyFor(url) {
+  const env = process.env;
+  const value = url.protocol === 'https:' ? env.https_proxy || env.HTTPS_PROXY : env.http_proxy || env.HTTP_PROXY;
+  if (!value) return null;
+  const host = url.hostname.replace(/^\[|\]$/g, '').toLowerCase();
+  const port = url.port || (url.protocol === 'https:' ? '443' : '80');
+  for (const entry of (env.no_proxy || env.NO_PROXY || '').toLowerCase().split(/[\s,]+/)) {
+    if (!entry) continue;
+    if (entry === '*') return null;
+    const match = /^(.*?)(?::(\d+))?$/.exec(entry.replace(/^\[|\](?=:|$)/g, ''));
+    if (match[2] && match[2] !== port) continue;
+    const name = match[1].replace(/^\*?\./, '');
+    if (host === name || host.endsWith(`.${name}`)) return null;
+  }
+  try {
+    return new URL(value.includes('://') ? value : `http://${value}`);
+  } catch (err) {
+    throw new Error(`invalid proxy: ${value}`);
+  }
+}
+
+function proxyAuth(proxy) {
+  if (!proxy.username) return {};
+  const credentials = `${decodeURIComponent(proxy.username)}:${decodeURIComponent(proxy.password)}`;
+  return { 'Proxy-Authorization': `Basic ${Buffer.from(credentials).toString('base64')}` };
+}
+
+// connectTunnel asks an HTTP proxy to CONNECT to the target and resolves
+// with the raw socket, over which TLS then runs end to end.
+function connectTunnel(proxy, target, timeoutMs) {
+  const address = `${target.hostname}:${target.port || 443}`;
+  return new Promise((resolve, reject) => {
+    const req = http.request({
+      host: proxy.hostname.replace(/^\[|\]$/g, ''),
+      port: proxy.port || 80,
+      method: 'CONNECT',
+      path: address,
+      headers: { Host: address, ...proxyAuth(proxy) },
+    });
+    req.on('connect', (res, socket) => {
+      if (res.statusCode === 200) {
+        resolve(socket);
+        return;
+      }
+      socket.destroy();
+      const err = new Error(`proxy ${proxy.host}: CONNECT ${address}: HTTP ${res.statusCode}`);
+      err.retryable = res.statusCode >= 500;
+      reject(err);
+    });
+    if (timeoutMs) {
+      req.setTimeout(timeoutMs, () => {
+        const err = new Error(`proxy ${proxy.host}: timed out after ${formatAge(timeoutMs)}`);
+        err.code = 'ETIMEDOUT';
+        req.destroy(err);
+      });
+    }
+    req.on('error', reject);
+    req.end();
+  });
+}
+
+const SECRET_SERVICE = 'screenshot-agent';
+
+// SECRET_STORES keep delivery secrets in the OS keychain under the service
+// (or target) name screenshot-agent, one item per NAME. Values travel on
+// stdin, never in argv, where other users could read them.
+const SECRET_STORES = [
+  {
+    name: 'keychain',
+    platforms: ['darwin'],
+    tool: 'security',
+    available: () => commandExists('security'),
+    get: (name) =>
+      execFileSync('security', ['find-generic-password', '-s', SECRET_SERVICE, '-a', name, '-w'], {
+        stdio: ['ignore', 'pipe', 'ignore'],
+      }),
+    // security -i reads commands from stdin; its parser takes double-quoted
+    // words with backslash escapes.
+    set: (name, value) => {
+      const quote = (word) => `"${word.replace(/[\\"]/g, '\\$&')}"`;
+      const words = ['-s', SECRET_SERVICE, '-a', name, '-w', value].map(quote);
+      execFileSync('security', ['-i'], {
+        input: `add-generic-password -U ${words.join(' ')}\n`,
+        stdio: ['pipe', 'ignore', 'pipe'],
+      });
+    },
+    delete: (name) =>
+      execFileSync('security', ['delete-generic-password', '-s', SECRET_SERVICE, '-a', name], { stdio: 'ignore' }),
+  },
+  {
+    name: 'libsecret',
+    platforms: ['linux', 'freebsd', 'openbsd'],
+    tool: 'secret-tool',
+    available: () => commandExists('secret-tool'),
+    get: (name) =>
+      execFileSync('secret-tool', ['lookup', 'service', SECRET_SERVICE, 'account', name], {
+        stdio: ['ignore', 'pipe', 'ignore'],
+      }),
+    set: (name, value) =>
+      execFileSync(
+        'secret-tool',
+        ['store', `--label=${SECRET_SERVICE} ${name}`, 'service', SECRET_SERVICE, 'account', name],
+        { input: value, stdio: ['pipe', 'ignore', 'pipe'] },
+      ),
+    delete: (name) =>
+      execFileSync('secret-tool', ['clear', 'service', SECRET_SERVICE, 'account', name], { stdio: 'ignore' }),
+  },
+  {
+    name: 'credential-manager',
+    platforms: ['win32'],
+    tool: 'powershell',
+    available: () => commandExists('powershell'),
+    get: (name) => windowsCredential('Get', name, null),
+    set: (name, value) => windowsCredential('Set', name, value),
+    delete: (name) => windowsCredential('Delete', name, null),
+  },
+];
+
+// WINDOWS_CREDENTIAL wraps the Credential Manager API (advapi32), which
+// PowerShell has no cmdlet for. Items are generic credentials named
+// screenshot-agent:NAME.
+const WINDOWS_CREDENTIAL = `
+using System;
+using System.Runtime.InteropServices;
+using System.Text;
+public static class ScreenshotAgentCred {
+  [StructLayout(LayoutKind.Sequential, CharSet = CharSet.Unicode)]
+  struct CREDENTIAL {
+    public int Flags; public int Type; public string TargetName; public string Comment;
+    public System.Runtime.InteropServices.ComTypes.FILETIME LastWritten;
+    public int CredentialBlobSize; public IntPtr CredentialBlob; public int Persist;
+    public int AttributeCount; public IntPtr Attributes; public string TargetAlias; public string UserName;
+  }
+  [DllImport("advapi32.dll", CharSet = CharSet.Unicode, SetLastError = true)]
+  static extern bool CredWrite(ref CREDENTIAL credential, int flags);
+  [DllImport("advapi32.dll", CharSet = CharSet.Unicode, SetLastError = true)]
+  static extern bool CredRead(string target, int type, int flags, out IntPtr credential);
+  [DllImport("advapi32.dll", CharSet = CharSet.Unicode, SetLastError = true)]
+  static extern bool CredDelete(string target, int type, int flags);
+  [DllImport("advapi32.dll")]
+  static extern void CredFree(IntPtr credential);
+  public static void Set(string target, string secret) {
+    byte[] blob = Encoding.Unicode.GetBytes(secret);
+    CREDENTIAL credential = new CREDENTIAL();
+    credential.Type = 1;
+    credential.TargetName = target;
+    credential.UserName = "${SECRET_SERVICE}";
+    credential.Persist = 2;
+    credential.CredentialBlobSize = blob.Length;
+    credential.CredentialBlob = Marshal.AllocHGlobal(blob.Length);
+    try {
+      Marshal.Copy(blob, 0, credential.CredentialBlob, blob.Length);
+      if (!CredWrite(ref credential, 0)) throw new System.ComponentModel.Win32Exception();
+    } finally {
+      Marshal.FreeHGlobal(credential.CredentialBlob);
+    }
+  }
+  public static string Get(string target) {
+    IntPtr pointer;
+    if (!CredRead(target, 1, 0, out pointer)) throw new System.ComponentModel.Win32Exception();
+    try {
+      CREDENTIAL credential = (CREDENTIAL)Marshal.PtrToStructure(pointer, typeof(CREDENTIAL));
+      return Marshal.PtrToStringUni(credential.CredentialBlob, credential.CredentialBlobSize / 2);
+    } finally {
+      CredFree(pointer);
+    }
+  }
+  public static void Delete(string target) {
+    if (!CredDelete(target, 1, 0)) throw new System.ComponentModel.Win32Exception();
+  }
+}
+`;
+
+function windowsCredential(action, name, value) {
+  const target = `${SECRET_SERVICE}:${name}`.replace(/'/g, "''");
+  const call =
+    action === 'Get'
+      ? `[Console]::Out.Write([ScreenshotAgentCred]::Get('${target}'))`
+      : action === 'Set'
+        ? `[ScreenshotAgentCred]::Set('${target}', [Console]::In.ReadToEnd())`
+        : `[ScreenshotAgentCred]::Delete('${target}')`;
+  const script = [`Add-Type -TypeDefinition @'${WINDOWS_CREDENTIAL}'@`, call].join('\n');
+  return execFileSync('powershell', ['-NoProfile', '-NonInteractive', '-Command', script], {
+    input: value === null ? '' : value,
+    stdio: ['pipe', 'pipe', 'ignore'],
+  });
+}
+
+function secretStore() {
+  return SECRET_STORES.find((store) => store.platforms.includes(process.platform) && store.available()) || null;
+}
+
+function requireSecretStore() {
+  const store = secretStore();
+  if (store) return store;
+  const native = SECRET_STORES.find((item) => item.platforms.includes(process.platform));
+  if (!native) throw unsupportedError('secret store', SECRET_STORES.flatMap((item) => item.platforms));
+  throw new Error(`no secret store available (${native.name} needs ${native.tool})`);
+}
+
+// secretEnv names the variable that stands in for secret NAME where there
+// is no keychain, as in CI: SCREENSHOT_AGENT_SECRET_ plus NAME in upper
+// case with anything but letters and digits as _.
+function secretEnv(name) {
+  return `SCREENSHOT_AGENT_SECRET_${name.toUpperCase().replace(/[^A-Z0-9]/g, '_')}`;
+}
+
+// readSecret returns secret NAME: from its environment variable when that
+// is set, else from the keychain.
+function readSecret(name) {
+  const env = process.env[secretEnv(name)];
+  if (env) return env;
+  const store = secretStore();
+  if (store) {
+    try {
+      const value = store.get(name).toString('utf8').replace(/\r?\n$/, '');
+      if (value) return value;
+    } catch (err) {
+      // not stored; fall through
+    }
+  }
+  throw new Error(`no secret ${name} (run: screenshot-agent secrets set ${name}, or set ${secretEnv(name)})`);
+}
+
+async function runSecretsSet(opts) {
+  const store = requireSecretStore();
+  const value = await readSecretInput(`secret for ${opts.secretName}: `);
+  if (!value) throw new Error('empty secret; nothing stored');
+  try {
+    store.set(opts.secretName, value);
+  } catch (err) {
+    const detail = err.stderr && err.stderr.length > 0 ? err.stderr.toString().trim() : err.message;
+    throw new Error(`${store.name}: cannot store ${opts.secretName}: ${detail}`);
+  }
+  process.stderr.write(`stored ${opts.secretName} in ${store.name}\n`);
+  return 0;
+}
+
+async function runSecretsDelete(opts) {
+  const store = requireSecretStore();
+  try {
+    store.delete(opts.secretName);
+  } catch (err) {
+    throw new Error(`${store.name}: no secret ${opts.secretName}`);
+  }
+  process.stderr.write(`deleted ${opts.secretName} from ${store.name}\n`);
+  return 0;
+}
+
+// readSecretInput reads the secret from stdin: one line typed without echo
+// at a terminal, or everything piped in, minus the final newline.
+function readSecretInput(prompt) {
+  const input = process.stdin;
+  if (!input.isTTY) {
+    return new Promise((resolve, reject) => {
+      const chunks = [];
+      input.on('data', (chunk) => chunks.push(chunk));
+      input.on('end', () => resolve(Buffer.concat(chunks).toString('utf8').replace(/\r?\n$/, '')));
+      input.on('error', reject);
+    });
+  }
+  process.stderr.write(prompt);
+  return new Promise((resolve) => {
+    let value = '';
+    input.setRawMode(true);
+    input.setEncoding('utf8');
+    const onData = (chunk) => {
+      for (const ch of chunk) {
+        if (ch === '\r' || ch === '\n' || ch === '\u0004') {
+          input.setRawMode(false);
+          input.pause();
+          input.removeListener('data', onData);
+          process.stderr.write('\n');
+          resolve(value);
+          return;
+        }
+        if (ch === '\u0003') {
+          input.setRawMode(false);
+          process.stderr.write('\n');
+          process.exit(130);
+        }
+        value = ch === '\u007f' ? value.slice(0, -1) : value + ch;
+      }
+    };
+    input.on('data', onData);
+    input.resume();
+  });
+}
+
+const MARKER_ATTR = 'user.screenshot-agent.origin';
+
+// MARKER_WRITERS set the origin marker on a staged file. Node has no xattr
+// API, so the platform tools do it; on Windows the marker is an NTFS
+// alternate data stream of the same name.
+const MARKER_WRITERS = [
+  {
+    name: 'xattr',
+    platforms: ['darwin'],
+    available: () => commandExists('xattr'),
+    write: (file, value) => runProcess('xattr', ['-w', MARKER_ATTR, value, file]),
+  },
+  {
+    name: 'setfattr',
+    platforms: UNIX_DESKTOPS,
+    available: () => commandExists('setfattr'),
+    write: (file, value) => runProcess('setfattr', ['-n', MARKER_ATTR, '-v', value, file]),
+  },
+  {
+    name: 'ads',
+    platforms: ['win32'],
+    available: () => true,
+    write: (file, value) => fsp.writeFile(`${file}:${MARKER_ATTR}`, value),
+  },
+];
+
+// writeMarker records where a staged file came from in its
+// user.screenshot-agent.origin attribute ({"source", "originalPath",
+// "time"} as JSON), so other tools can trace it without a sidecar. It is
+// best effort: filesystems without user xattrs (some tmpfs, FAT, network
+// mounts) just don't get one.
+async function writeMarker(result, opts) {
+  const writer = MARKER_WRITERS.find((item) => item.platforms.includes(process.platform) && item.available());
+  if (!writer) {
+    log(opts, 'marker: no xattr tool available');
+    return;
+  }
+  const json = resultJson(result);
+  const value = JSON.stringify({
+    source: json.source,
+    originalPath: json.originalPath,
+    time: rfc3339(new Date()),
+  });
+  try {
+    await writer.write(result.tempPath, value);
+  } catch (err) {
+    log(opts, `marker: cannot set ${MARKER_ATTR} on ${result.tempPath}: ${err.message || String(err)}`);
+  }
+}
+
+// OCR_ENGINES recognize the text in an image file, best first: the
+// platform's own recognizer where there is one, then Tesseract.
+const OCR_ENGINES = [
+  {
+    name: 'vision',
+    platforms: ['darwin'],
+    available: () => commandExists('osascript'),
+    recognize: recognizeVision,
+  },
+  {
+    name: 'windows',
+    platforms: ['win32'],
+    available: () => commandExists('powershell'),
+    recognize: recognizeWindows,
+  },
+  {
+    name: 'tesseract',
+    platforms: ['darwin', 'linux', 'win32', 'freebsd', 'openbsd', 'netbsd'],
+    available: () => commandExists('tesseract'),
+    recognize: recognizeTesseract,
+  },
+];
+
+// OCR_LANGS maps the two-letter codes --ocr-lang takes to Tesseract's
+// traineddata names; Vision and Windows OCR take the two-letter form.
+// Codes not listed pass through to every engine as given.
+const OCR_LANGS = {
+  ar: 'ara',
+  cs: 'ces',
+  da: 'dan',
+  de: 'deu',
+  el: 'ell',
+  en: 'eng',
+  es: 'spa',
+  fi: 'fin',
+  fr: 'fra',
+  he: 'heb',
+  hu: 'hun',
+  it: 'ita',
+  ja: 'jpn',
+  ko: 'kor',
+  nb: 'nor',
+  nl: 'nld',
+  pl: 'pol',
+  pt: 'por',
+  ro: 'ron',
+  ru: 'rus',
+  sv: 'swe',
+  th: 'tha',
+  tr: 'tur',
+  uk: 'ukr',
+  vi: 'vie',
+  'zh-Hans': 'chi_sim',
+  'zh-Hant': 'chi_tra',
+};
+
+// parseOcrLangs splits "de+en" (or "de,en") into language codes, most
+// important first. Tesseract codes (deu) are accepted too.
+function parseOcrLangs(value, what) {
+  const langs = String(value)
+    .split(/[+,]/)
+    .map((item) => item.trim())
+    .filter(Boolean);
+  if (langs.length === 0 || langs.some((item) => !/^[A-Za-z]{2,3}(?:[-_][A-Za-z0-9]+)*$/.test(item))) {
+    throw new Error(`${what}: invalid language list ${value}`);
+  }
+  const short = Object.fromEntries(Object.entries(OCR_LANGS).map(([code, tesseract]) => [tesseract, code]));
+  return langs.map((item) => short[item] || item);
+}
+
+// recognizeTesseract reads plain text, or with boxes the TSV report,
+// whose word rows (level 5) carry their line's block/paragraph/line ids.
+async function recognizeTesseract(file, opts, boxes) {
+  const args = [file, 'stdout'];
+  if (opts.ocrLangs.length > 0) {
+    args.push('-l', opts.ocrLangs.map((item) => OCR_LANGS[item] || item).join('+'));
+  }
+  if (!boxes) return { text: (await runProcess('tesseract', args)).toString('utf8') };
+  const rows = splitLines((await runProcess('tesseract', [...args, 'tsv'])).toString('utf8'))
+    .slice(1)
+    .map((line) => line.split('\t'));
+  const byLine = new Map();
+  for (const row of rows) {
+    if (row[0] !== '5' || !(row[11] || '').trim()) continue;
+    const key = row.slice(2, 5).join('.');
+    if (!byLine.has(key)) byLine.set(key, []);
+    byLine.get(key).push({ text: row[11], ...pixelBox(...row.slice(6, 10).map(Number)) });
+  }
+  const lines = [...byLine.values()].map((words) => ({
+    text: words.map((word) => word.text).join(' '),
+    ...unionBox(words),
+    words,
+  }));
+  return { text: lines.map((line) => line.text).join('\n'), lines };
+}
+
+// recognizeVision runs Vision's accurate text recognizer through JXA, one
+// line per observation.
+async function recognizeVision(file, opts) {
+  const script = [
+    'function run(argv) {',
+    "  ObjC.import('Vision');",
+    '  const url = $.NSURL.fileURLWithPath(argv[0]);',
+    '  const handler = $.VNImageRequestHandler.alloc.initWithURLOptions(url, $({}));',
+    '  const request = $.VNRecognizeTextRequest.alloc.init;',
+    '  request.recognitionLevel = 0; // accurate',
+    '  request.usesLanguageCorrection = true;',
+    "  if (argv[1]) request.recognitionLanguages = $(argv[1].split(','));",
+    '  const error = $();',
+    '  if (!handler.performRequestsError($([request]), error)) throw new Error(error.localizedDescription.js);',
+    '  const lines = [];',
+    '  const results = request.results;',
+    '  for (let i = 0; i < results.count; i += 1) {',
+    '    const observation = results.objectAtIndex(i);',
+    '    const candidates = observation.topCandidates(1);',
+    '    if (candidates.count === 0) continue;',
+    '    const box = observation.boundingBox;',
+    '    lines.push({',
+    '      text: candidates.objectAtIndex(0).string.js,',
+    '      box: [box.origin.x, box.origin.y, box.size.width, box.size.height],',
+    '    });',
+    '  }',
+    '  return JSON.stringify(lines);',
+    '}',
+  ].join('\n');
+  const langs = opts.ocrLangs.join(',');
+  const out = (await runProcess('osascript', ['-l', 'JavaScript', '-e', script, file, langs])).toString('utf8');
+  // Vision boxes are fractions of the image with the origin at the bottom
+  // left; convert them to pixels from the top left like the other engines.
+  const { width, height } = imageGeometry(await fsp.readFile(file)) || { width: 0, height: 0 };
+  const lines = JSON.parse(out).map(({ text, box: [x, y, w, h] }) => ({
+    text,
+    ...pixelBox(x * width, (1 - y - h) * height, w * width, h * height),
+  }));
+  return { text: lines.map((line) => line.text).join('\n'), lines };
+}
+
+function pixelBox(x, y, width, height) {
+  return { x: Math.round(x), y: Math.round(y), width: Math.round(width), height: Math.round(height) };
+}
+
+// recognizeWindows uses the Windows.Media.Ocr engine for the user's
+// profile languages, awaiting the WinRT calls through AsTask.
+async function recognizeWindows(file, opts) {
+  const target = String(file).replace(/'/g, "''");
+  // Windows OCR reads one language at a time; the first one is used.
+  const lang = (opts.ocrLangs[0] || '').replace(/'/g, "''");
+  const language = `[Windows.Globalization.Language]::new('${lang}')`;
+  const script = [
+    'Add-Type -AssemblyName System.Runtime.WindowsRuntime',
+    '$null = [Windows.Storage.StorageFile, Windows.Storage, ContentType = WindowsRuntime]',
+    '$null = [Windows.Media.Ocr.OcrEngine, Windows.Foundation, ContentType = WindowsRuntime]',
+    '$null = [Windows.Graphics.Imaging.BitmapDecoder, Windows.Foundation, ContentType = WindowsRuntime]',
+    '$asTask = ([System.WindowsRuntimeSystemExtensions].GetMethods() | Where-Object {',
+    "  $_.Name -eq 'AsTask' -and $_.GetParameters().Count -eq 1 -and",
+    "  $_.GetParameters()[0].ParameterType.Name -eq 'IAsyncOperation`1' })[0]",
+    'function Await($op, $type) {',
+    '  $task = $asTask.MakeGenericMethod($type).Invoke($null, @($op))',
+    '  $null = $task.Wait(-1)',
+    '  $task.Result',
+    '}',
+    `$file = Await ([Windows.Storage.StorageFile]::GetFileFromPathAsync('${target}')) ([Windows.Storage.StorageFile])`,
+    '$stream = Await ($file.OpenAsync([Windows.Storage.FileAccessMode]::Read)) ' +
+      '([Windows.Storage.Streams.IRandomAccessStream])',
+    '$decoder = Await ([Windows.Graphics.Imaging.BitmapDecoder]::CreateAsync($stream)) ' +
+      '([Windows.Graphics.Imaging.BitmapDecoder])',
+    '$bitmap = Await ($decoder.GetSoftwareBitmapAsync()) ([Windows.Graphics.Imaging.SoftwareBitmap])',
+    '$null = [Windows.Globalization.Language, Windows.Globalization, ContentType = WindowsRuntime]',
+    lang
+      ? `$engine = [Windows.Media.Ocr.OcrEngine]::TryCreateFromLanguage(${language})`
+      : '$engine = [Windows.Media.Ocr.OcrEngine]::TryCreateFromUserProfileLanguages()',
+    `if (-not $engine) { throw 'no OCR language pack is installed${lang ? ` for ${lang}` : ''}' }`,
+    '$result = Await ($engine.RecognizeAsync($bitmap)) ([Windows.Media.Ocr.OcrResult])',
+    '[Console]::OutputEncoding = [Text.Encoding]::UTF8',
+    '$lines = @($result.Lines | ForEach-Object {',
+    '  $words = @($_.Words | ForEach-Object {',
+    '    $r = $_.BoundingRect',
+    '    @{ text = $_.Text; x = $r.X; y = $r.Y; width = $r.Width; height = $r.Height }',
+    '  })',
+    '  @{ text = $_.Text; words = $words }',
+    '})',
+    'ConvertTo-Json -InputObject $lines -Depth 4 -Compress',
+  ].join('\n');
+  const out = (await runProcess('powershell', ['-NoProfile', '-NonInteractive', '-Command', script])).toString('utf8');
+  const lines = (JSON.parse(out.trim() || '[]') || []).map((line) => {
+    const words = line.words.map((word) => ({ text: word.text, ...pixelBox(word.x, word.y, word.width, word.height) }));
+    return { text: line.text, ...unionBox(words), words };
+  });
+  return { text: lines.map((line) => line.text).join('\n'), lines };
+}
+
+// unionBox is the smallest box around all of boxes.
+function unionBox(boxes) {
+  if (boxes.length === 0) return pixelBox(0, 0, 0, 0);
+  const left = Math.min(...boxes.map((box) => box.x));
+  const top = Math.min(...boxes.map((box) => box.y));
+  const right = Math.max(...boxes.map((box) => box.x + box.width));
+  const bottom = Math.max(...boxes.map((box) => box.y + box.height));
+  return pixelBox(left, top, right - left, bottom - top);
+}
+
+function checkOcrEngine(name, what) {
+  if (name === 'auto') return '';
+  if (!OCR_ENGINES.some((engine) => engine.name === name)) {
+    throw new Error(`${what}: unknown OCR engine ${name} (known: ${OCR_ENGINES.map((item) => item.name).join(', ')})`);
+  }
+  return name;
+}
+
+// ocrEngineFor is the --ocr-engine engine, or the best one available here.
+function ocrEngineFor(opts) {
+  const usable = (engine) => engine.platforms.includes(process.platform) && engine.available();
+  if (opts.ocrEngine) {
+    const engine = OCR_ENGINES.find((item) => item.name === opts.ocrEngine);
+    if (!usable(engine)) throw new Error(`OCR engine ${engine.name} is not available on this system`);
+    return engine;
+  }
+  const engine = OCR_ENGINES.find(usable);
+  if (!engine) throw new Error('OCR needs tesseract on PATH');
+  return engine;
+}
+
+// ocrImage returns the recognized text and, from engines that report them
+// (always for Vision and Windows OCR, on request for Tesseract), the line
+// and word boxes in pixels from the top left.
+async function ocrImage(file, opts, boxes = false) {
+  const engine = ocrEngineFor(opts);
+  const { text, lines } = await engine.recognize(file, opts, boxes);
+  log(opts, `ocr (${engine.name}): ${text.length} characters`);
+  return { text: text.trim(), lines };
+}
+
+// RASTERIZERS turn SVG and (first-page) PDF exports into PNG at a chosen
+// DPI, in order of preference.
+const RASTERIZERS = [
+  {
+    name: 'rsvg-convert',
+    platforms: ['darwin', 'linux', 'win32', 'freebsd', 'openbsd', 'netbsd'],
+    formats: ['.svg'],
+    available: () => commandExists('rsvg-convert'),
+    run: (src, out, dpi) =>
+      execFileSync('rsvg-convert', ['-d', String(dpi), '-p', String(dpi), '-f', 'png', '-o', out, src], { stdio: 'ignore' }),
+  },
+  {
+    name: 'pdftoppm',
+    platforms: ['darwin', 'linux', 'win32', 'freebsd', 'openbsd', 'netbsd'],
+    formats: ['.pdf'],
+    available: () => commandExists('pdftoppm'),
+    run: (src, out, dpi) =>
+      execFileSync('pdftoppm', ['-png', '-r', String(dpi), '-f', '1', '-l', '1', '-singlefile', src, out.slice(0, -4)], {
+        stdio: 'ignore',
+      }),
+  },
+  {
+    name: 'sips',
+    platforms: ['darwin'],
+    formats: ['.pdf'],
+    available: () => commandExists('sips'),
+    run: (src, out) => execFileSync('sips', ['-s', 'format', 'png', src, '--out', out], { stdio: 'ignore' }),
+  },
+  {
+    name: 'magick',
+    platforms: ['darwin', 'linux', 'win32', 'freebsd', 'openbsd', 'netbsd'],
+    formats: ['.svg', '.pdf'],
+    available: () => commandExists('magick'),
+    run: (src, out, dpi) => execFileSync('magick', ['-density', String(dpi), `${src}[0]`, `png:${out}`], { stdio: 'ignore' }),
+  },
+];
+
+// DECODERS turn an image straight into RGBA pixels with a native library,
+// which is many times faster than the built-in PNG codec on large Retina
+// captures. They are opt-in (--fast-decode) so results never depend on
+// what happens to be installed.
+const DECODERS = [
+  {
+    name: 'vips',
+    platforms: ['darwin', 'linux', 'win32', 'freebsd', 'openbsd', 'netbsd'],
+    available: () => commandExists('vips') && commandExists('vipsheader'),
+    decode: decodeWithVips,
+  },
+  {
+    name: 'magick',
+    platforms: ['darwin', 'linux', 'win32', 'freebsd', 'openbsd', 'netbsd'],
+    available: () => commandExists('magick'),
+    decode: decodeWithMagick,
+  },
+];
+
+async function decodeWithVips(file) {
+  const image = await tempPath('decode-XXXXXX.v');
+  const raw = `${image.slice(0, -2)}.raw`;
+  try {
+    // colourspace leaves 8-bit sRGB whatever the input was, keeping alpha.
+    await runProcess('vips', ['colourspace', `${file}[n=1]`, image, 'srgb']);
+    const header = async (field) => Number(String(await runProcess('vipsheader', ['-f', field, image])).trim());
+    const width = await header('width');
+    const height = await header('height');
+    const bands = await header('bands');
+    await runProcess('vips', ['rawsave', image, raw]);
+    return rgbaFromRaw(await fsp.readFile(raw), width, height, bands);
+  } finally {
+    await safeUnlink(image);
+    await safeUnlink(raw);
+  }
+}
+
+async function decodeWithMagick(file) {
+  const size = String(await runProcess('magick', ['identify', '-format', '%w %h', `${file}[0]`])).trim().split(' ');
+  const width = Number(size[0]);
+  const height = Number(size[1]);
+  const raw = await runProcess('magick', [`${file}[0]`, '-depth', '8', 'rgba:-'], {
+    maxBuffer: width * height * 4 + 1024,
+  });
+  return rgbaFromRaw(raw, width, height, 4);
+}
+
+// rgbaFromRaw widens interleaved 8-bit samples (gray, gray+alpha, RGB or
+// RGBA) to the RGBA layout decodePng returns.
+function rgbaFromRaw(raw, width, height, bands) {
+  if (!(width > 0 && height > 0) || ![1, 2, 3, 4].includes(bands) || raw.length < width * height * bands) {
+    throw new Error('decoder returned no pixels');
+  }
+  if (bands === 4) return { width, height, pixels: raw.subarray(0, width * height * 4) };
+  const pixels = Buffer.alloc(width * height * 4);
+  for (let i = 0; i < width * height; i += 1) {
+    const from = i * bands;
+    const to = i * 4;
+    const color = bands >= 3;
+    pixels[to] = raw[from];
+    pixels[to + 1] = color ? raw[from + 1] : raw[from];
+    pixels[to + 2] = color ? raw[from + 2] : raw[from];
+    pixels[to + 3] = bands === 2 ? raw[from + 1] : 255;
+  }
+  return { width, height, pixels };
+}
+
+// decodeImage returns the RGBA pixels of any image. With --fast-decode it
+// tries the first available native decoder and falls back to the built-in
+// codec when there is none or it fails.
+async function decodeImage(file, opts) {
+  if (opts.fastDecode) {
+    const decoder = DECODERS.find((item) => item.platforms.includes(process.platform) && item.available());
+    if (!decoder) {
+      if (!opts.fastDecodeWarned) {
+        process.stderr.write('warning: --fast-decode: no vips or magick found; using the built-in decoder\n');
+        opts.fastDecodeWarned = true;
+      }
+    } else {
+      try {
+        const image = await decoder.decode(file);
+        log(opts, `decoded ${file} with ${decoder.name}`);
+        return image;
+      } catch (err) {
+        log(opts, `${decoder.name} could not decode ${file} (${err.message}); using the built-in decoder`);
+      }
+    }
+  }
+  return decodePng(await readImageAsPng(file));
+}
+
+async function rasterizeStaged(file, opts) {
+  const ext = path.extname(file).toLowerCase();
+  const rasterizer = RASTERIZERS.find(
+    (item) => item.formats.includes(ext) && item.platforms.includes(process.platform) && item.available(),
+  );
+  if (!rasterizer) {
+    const names = RASTERIZERS.filter((item) => item.formats.includes(ext)).map((item) => item.name);
+    throw new Error(`--rasterize: ${ext.slice(1).toUpperCase()} needs one of ${names.join(', ')}`);
+  }
+  const out = `${file.slice(0, -ext.length)}.png`;
+  log(opts, `rasterizing ${file} at ${opts.rasterizeDpi} dpi with ${rasterizer.name}`);
+  rasterizer.run(file, out, opts.rasterizeDpi);
+  if (!(await fileHasContent(out))) {
+    throw new Error(`${rasterizer.name} produced no image for ${file}`);
+  }
+  await safeUnlink(file);
+  return out;
+}
+
+// pdfPageCount counts page objects without a PDF parser; compressed object
+// streams can hide them, in which case the file is treated as one page.
+async function pdfPageCount(file) {
+  const text = (await fsp.readFile(file)).toString('latin1');
+  return (text.match(/\/Type\s*\/Page(?![s\w])/g) || []).length;
+}
+
+// Replay keeps a rolling buffer of short MPEG-TS segments written by ffmpeg;
+// segment_wrap overwrites the oldest, so disk use stays bounded.
+const REPLAY_SEGMENT_SECONDS = 2;
+
+const REPLAY_SOURCES = [
+  {
+    name: 'avfoundation',
+    platforms: ['darwin'],
+    available: () => commandExists('ffmpeg'),
+    input: () => ['-f', 'avfoundation', '-capture_cursor', '1', '-i', 'Capture screen 0:none'],
+  },
+  {
+    name: 'x11grab',
+    platforms: UNIX_DESKTOPS,
+    available: () => commandExists('ffmpeg') && Boolean(process.env.DISPLAY) && !process.env.WAYLAND_DISPLAY,
+    input: () => ['-f', 'x11grab', '-i', process.env.DISPLAY],
+  },
+  {
+    name: 'gdigrab',
+    platforms: ['win32'],
+    available: () => commandExists('ffmpeg'),
+    input: () => ['-f', 'gdigrab', '-i', 'desktop'],
+  },
+];
+
+function daemonSocketPath() {
+  return path.join(stateDir(), 'daemon.sock');
+}
+
+const DAEMON_POLL_MS = 2000;
+
+// runDaemon keeps a temp copy of the newest file candidate in a ready slot so
+// `get` only has to hand over its path. A newer capture is copied in full
+// before the slot is swapped to it, so a client never sees a partial file.
+// Scans, swaps, and hand-overs run one at a time.
+async function runDaemon(opts) {
+  if (opts.out) {
+    throw new Error('daemon cannot be combined with --out');
+  }
+  const socketPath = daemonSocketPath();
+  await fsp.mkdir(path.dirname(socketPath), { recursive: true, mode: 0o700 });
+  if (await daemonRunning(socketPath)) {
+    throw new Error(`daemon already running on ${socketPath}`);
+  }
+  await safeUnlink(socketPath);
+
+  let slot = null;
+  let queue = Promise.resolve();
+  let refreshQueued = false;
+  const serial = (fn) => {
+    const next = queue.then(fn);
+    queue = next.catch(() => {});
+    return next;
+  };
+  const refresh = async () => {
+    refreshQueued = false;
+    let candidate = null;
+    try {
+      candidate = await findFallbackImage(opts);
+    } catch (err) {
+      if (err.code !== ERR_NOT_FOUND) process.stderr.write(`warning: ${err.message}\n`);
+    }
+    const key = candidate ? slotKey(candidate) : '';
+    if ((slot ? slot.key : '') === key) return;
+    const next = candidate ? { key, candidate, tempPath: await copyImageToTemp(fsPathOf(candidate), opts) } : null;
+    const old = slot;
+    slot = next;
+    if (old) await safeUnlink(old.tempPath);
+    log(opts, next ? `daemon: staged ${candidate.path}` : 'daemon: slot empty');
+  };
+  const schedule = () => {
+    if (refreshQueued) return;
+    refreshQueued = true;
+    serial(refresh).catch((err) => process.stderr.write(`warning: ${err.message}\n`));
+  };
+  const poke = async () => {
+    await refresh();
+    return { staged: slot ? slot.candidate.path : null };
+  };
+  const handOver = async () => {
+    if (slot && !(await slotCurrent(slot))) {
+      await refresh();
+    }
+    if (!slot) {
+      return { error: { code: ERR_NOT_FOUND, message: ERR_NOT_FOUND } };
+    }
+    const taken = slot;
+    slot = null;
+    await consumePrefetched(taken.candidate, taken.tempPath, opts);
+    schedule();
+    log(opts, `daemon: handed over ${taken.candidate.path}`);
+    return { source: taken.candidate.path, tempPath: taken.tempPath, modTimeMs: taken.candidate.modTimeMs };
+  };
+
+  const server = net.createServer((conn) => {
+    let buffered = '';
+    conn.setEncoding('utf8');
+    conn.on('error', () => {});
+    conn.on('data', (chunk) => {
+      buffered += chunk;
+      const newline = buffered.indexOf('\n');
+      if (newline < 0) return;
+      const line = buffered.slice(0, newline);
+      buffered = '';
+      let request = {};
+      try {
+        request = JSON.parse(line);
+      } catch (err) {
+        // Answered as an unknown request below.
+      }
+      let reply = Promise.resolve({ error: { message: `unknown request: ${line}` } });
+      if (request.op === 'get') reply = serial(handOver);
+      if (request.op === 'poke') reply = serial(poke);
+      reply
+        .catch((err) => ({ error: { code: err.code, message: err.message || String(err) } }))
+        .then((body) => conn.end(JSON.stringify(body) + '\n'));
+    });
+  });
+  await new Promise((resolve, reject) => {
+    server.once('error', reject);
+    server.listen(socketPath, resolve);
+  });
+  await fsp.chmod(socketPath, 0o600);
+
+  const dirs = (await searchDirs(opts)).map((item) => item.dir);
+  const watchers = [];
+  for (const dir of dirs) {
+    try {
+      watchers.push(fs.watch(dir, () => schedule()));
+    } catch (err) {
+      log(opts, `daemon: cannot watch ${dir} (${err.code}); polling only`);
+    }
+  }
+  const timer = setInterval(schedule, DAEMON_POLL_MS);
+  schedule();
+  // Capture hooks (Hammerspoon, shell scripts) can `kill -USR1` the daemon
+  // to have a new file staged without waiting for fs.watch or the poll.
+  const onPoke = () => {
+    log(opts, 'daemon: SIGUSR1, re-scanning');
+    schedule();
+  };
+  if (process.platform !== 'win32') process.on('SIGUSR1', onPoke);
+  process.stderr.write(`staging the newest file from ${dirs.join(', ')}\n`);
+  process.stderr.write(`listening on ${socketPath} (pid ${process.pid}); Ctrl-C to stop\n`);
+  return new Promise((resolve) => {
+    const stop = () => {
+      clearInterval(timer);
+      process.removeListener('SIGUSR1', onPoke);
+      for (const watcher of watchers) watcher.close();
+      server.close();
+      serial(async () => {
+        if (slot) await safeUnlink(slot.tempPath);
+        slot = null;
+        await safeUnlink(socketPath);
+      }).then(() => resolve(0));
+    };
+    process.once('SIGINT', stop);
+    process.once('SIGTERM', stop);
+  });
+}
+
+function slotKey(candidate) {
+  return `${candidate.path}\0${candidate.modTimeMs}\0${candidate.size}`;
+}
+
+// slotCurrent reports whether the slot's source is still on disk unchanged,
+// so a file edited or removed since it was staged is not handed over.
+async function slotCurrent(slot) {
+  try {
+    const info = await fsp.stat(fsPathOf(slot.candidate));
+    return info.mtimeMs === slot.candidate.modTimeMs && info.size === slot.candidate.size;
+  } catch (err) {
+    return false;
+  }
+}
+
+// consumePrefetched removes the source of a slot that was already copied,
+// following the same keep, read-only, and syncing rules as a normal run.
+async function consumePrefetched(candidate, tempPath, opts) {
+  if (opts.readOnly || opts.consume === 'keep' || candidate.dir === 'Screenshots') return;
+  if (candidate.cloud && (await stillSyncing(candidate))) {
+    process.stderr.write(`warning: ${candidate.cloud} is still syncing ${candidate.path}; leaving it in place\n`);
+    return;
+  }
+  try {
+    if (candidate.dir === 'Downloads') {
+      await fsp.unlink(fsPathOf(candidate));
+      await journal('move', candidate, { path: tempPath });
+      await audit(opts, 'move', { original: candidate.path, location: tempPath, size: candidate.size }, tempPath);
+    } else {
+      await discardFile(candidate, opts);
+    }
+  } catch (err) {
+    if (err && (err.code === ERR_UNSUPPORTED || isReadOnlyError(err)) && opts.consume !== 'strict') {
+      process.stderr.write(`warning: cannot consume ${candidate.path} (${err.code}); leaving it in place\n`);
+      return;
+    }
+    throw err;
+  }
+}
+
+function daemonRunning(socketPath) {
+  return new Promise((resolve) => {
+    const conn = net.createConnection(socketPath);
+    conn.on('connect', () => {
+      conn.destroy();
+      resolve(true);
+    });
+    conn.on('error', () => resolve(false));
+  });
+}
+
+function daemonRequest(socketPath, request) {
+  return new Promise((resolve, reject) => {
+    const conn = net.createConnection(socketPath);
+    let buffered = '';
+    conn.setEncoding('utf8');
+    conn.on('connect', () => conn.write(JSON.stringify(request) + '\n'));
+    conn.on('data', (chunk) => {
+      buffered += chunk;
+    });
+    conn.on('end', () => {
+      try {
+        resolve(JSON.parse(buffered));
+      } catch (err) {
+        reject(new Error('daemon: malformed reply'));
+      }
+    });
+    conn.on('error', reject);
+  });
+}
+
+// runGet takes the daemon's ready slot and runs the usual post-staging steps
+// (--out, --ocr, --json, history) on it in this process.
+async function runGet(opts) {
+  const existingOut = opts.out && opts.collision === 'skip' ? await existingTarget(path.resolve(opts.out)) : '';
+  if (existingOut) {
+    process.stderr.write(`skipped: ${existingOut} already exists\n`);
+    return 0;
+  }
+  const socketPath = daemonSocketPath();
+  let reply;
+  try {
+    reply = await daemonRequest(socketPath, { op: 'get' });
+  } catch (err) {
+    if (err.code === 'ENOENT' || err.code === 'ECONNREFUSED') {
+      throw new Error(`no daemon listening on ${socketPath}; start one with \`screenshot-agent daemon\``);
+    }
+    throw err;
+  }
+  if (reply.error) {
+    if (reply.error.code === ERR_NOT_FOUND) return 1;
+    throw new Error(`daemon: ${reply.error.message}`);
+  }
+  const staged = { source: reply.source, tempPath: reply.tempPath, modTimeMs: reply.modTimeMs };
+  if (opts.out) {
+    const out = await outputPath(opts);
+    await moveFile(staged.tempPath, out);
+    staged.tempPath = out;
+  }
+  writeResult(await finishResult(staged, opts), opts);
+  return 0;
+}
+
+// runPoke asks a running daemon to re-scan and waits until it has, so a
+// `daemon get` right after it sees the file that prompted the poke.
+async function runPoke(opts) {
+  const socketPath = daemonSocketPath();
+  let reply;
+  try {
+    reply = await daemonRequest(socketPath, { op: 'poke' });
+  } catch (err) {
+    if (err.code === 'ENOENT' || err.code === 'ECONNREFUSED') {
+      throw new Error(`no daemon listening on ${socketPath}; start one with \`screenshot-agent daemon\``);
+    }
+    throw err;
+  }
+  if (reply.error) throw new Error(`daemon: ${reply.error.message}`);
+  log(opts, reply.staged ? `daemon staged ${reply.staged}` : 'daemon slot empty');
+  return 0;
+}
+
+// CAPTURE_BACKENDS take a new screenshot into file, in order of preference
+// per platform; select asks the user for a region or window first.
+const CAPTURE_BACKENDS = [
+  {
+    name: 'screencapture',
+    platforms: ['darwin'],
+    available: () => commandExists('screencapture'),
+    capture: (file, select) => runProcess('screencapture', ['-x', ...(select ? ['-i'] : []), file]),
+  },
+  {
+    name: 'grim',
+    platforms: UNIX_DESKTOPS,
+    available: () => Boolean(process.env.WAYLAND_DISPLAY) && commandExists('grim') && commandExists('slurp'),
+    capture: async (file, select) => {
+      const region = select ? (await runProcess('slurp', [])).toString().trim() : '';
+      return runProcess('grim', [...(region ? ['-g', region] : []), file]);
+    },
+  },
+  {
+    name: 'gnome-screenshot',
+    platforms: UNIX_DESKTOPS,
+    available: () => commandExists('gnome-screenshot'),
+    capture: (file, select) => runProcess('gnome-screenshot', [...(select ? ['-a'] : []), '-f', file]),
+  },
+  {
+    name: 'spectacle',
+    platforms: UNIX_DESKTOPS,
+    available: () => commandExists('spectacle'),
+    capture: (file, select) => runProcess('spectacle', ['-b', '-n', select ? '-r' : '-f', '-o', file]),
+  },
+  {
+    name: 'maim',
+    platforms: UNIX_DESKTOPS,
+    available: () => Boolean(process.env.DISPLAY) && commandExists('maim'),
+    capture: (file, select) => runProcess('maim', [...(select ? ['-s'] : []), file]),
+  },
+  {
+    name: 'scrot',
+    platforms: UNIX_DESKTOPS,
+    available: () => Boolean(process.env.DISPLAY) && commandExists('scrot'),
+    capture: (file, select) => runProcess('scrot', [...(select ? ['-s'] : []), '-o', file]),
+  },
+  {
+    name: 'import',
+    platforms: UNIX_DESKTOPS,
+    available: () => Boolean(process.env.DISPLAY) && commandExists('import'),
+    capture: (file, select) => runProcess('import', [...(select ? [] : ['-window', 'root']), file]),
+  },
+];
+
+// runCapture takes a screenshot with the first available backend and runs
+// it through the same post-staging steps as a found one. A cancelled
+// selection leaves no file and exits 1.
+async function runCapture(opts) {
+  const supported = CAPTURE_BACKENDS.filter((backend) => backend.platforms.includes(process.platform));
+  if (supported.length === 0) {
+    throw unsupportedError('capture', CAPTURE_BACKENDS.flatMap((backend) => backend.platforms));
+  }
+  const backend = supported.find((item) => item.available());
+  if (!backend) {
+    throw new Error(`capture needs one of: ${supported.map((item) => item.name).join(', ')}`);
+  }
+  const file = await stagePath('capture-*.png', opts);
+  log(opts, `capture backend ${backend.name}${opts.select ? ' (select)' : ''}`);
+  try {
+    await backend.capture(file, opts.select);
+  } catch (err) {
+    await safeUnlink(file);
+    if (opts.select) return 1;
+    throw err;
+  }
+  const info = await fsp.stat(file).catch(() => null);
+  if (!info || info.size === 0) {
+    await safeUnlink(file);
+    return 1;
+  }
+  writeResult(await finishResult({ source: 'capture', kind: 'capture', tempPath: path.resolve(file) }, opts), opts);
+  return 0;
+}
+
+function journalPath() {
+  return path.join(stateDir(), 'journal.jsonl');
+}
+
+// journal records a file a run trashed or moved so `restore` can put it
+// back: where it was, and where it went (the trash entry, or the staged
+// copy for moved Downloads files).
+async function journal(action, candidate, location) {
+  const entry = {
+    id: crypto.randomBytes(4).toString('hex'),
+    time: rfc3339(new Date()),
+    action,
+    original: candidate.path,
+    ...(candidate.fsPath ? { originalBytes: candidate.fsPath.toString('base64') } : {}),
+    location: location.path,
+    ...(location.info ? { info: location.info } : {}),
+    size: candidate.size,
+  };
+  try {
+    await fsp.mkdir(stateDir(), { recursive: true, mode: 0o700 });
+    await fsp.appendFile(journalPath(), JSON.stringify(entry) + '\n', { mode: 0o600 });
+  } catch (err) {
+    // The file is already gone from its place; losing the record must not
+    // turn that into a failed run.
+    process.stderr.write(`warning: cannot record ${candidate.path} in the journal: ${err.message}\n`);
+  }
+}
+
+// readJournal returns the recorded operations oldest first, minus those
+// already restored or purged.
+async function readJournal() {
+  let text = '';
+  try {
+    text = await fsp.readFile(journalPath(), 'utf8');
+  } catch (err) {
+    if (err.code === 'ENOENT') return [];
+    throw err;
+  }
+  const entries = [];
+  const restored = new Set();
+  for (const line of splitLines(text)) {
+    let entry;
+    try {
+      entry = JSON.parse(line);
+    } catch (err) {
+      continue;
+    }
+    if (entry.action === 'restored' || entry.action === 'purged') restored.add(entry.id);
+    else entries.push(entry);
+  }
+  return entries.filter((entry) => !restored.has(entry.id));
+}
+
+// trashedByUs lists journal entries whose file is still in the trash, so
+// trash commands never touch anything else the user deleted.
+async function trashedByUs() {
+  const items = [];
+  for (const entry of await readJournal()) {
+    if (entry.action !== 'trash') continue;
+    const info = await fsp.lstat(entry.location).catch(() => null);
+    if (info) items.push({ ...entry, bytes: info.size });
+  }
+  return items;
+}
+
+async function runTrashReport(opts) {
+  const items = await trashedByUs();
+  const bytes = items.reduce((sum, item) => sum + item.bytes, 0);
+  if (opts.json) {
+    const list = items.map((item) => ({
+      id: item.id,
+      time: item.time,
+      original: item.original,
+      location: item.location,
+      bytes: item.bytes,
+    }));
+    process.stdout.write(JSON.stringify({ items: list, count: items.length, bytes }) + '\n');
+    return 0;
+  }
+  if (opts.verbose) {
+    for (const item of items) {
+      const size = formatBytes(item.bytes).padStart(9);
+      process.stdout.write(`${item.id}  ${item.time}  ${size}  ${textPath(item.original)}\n`);
+    }
+  }
+  process.stdout.write(`${items.length} items trashed by screenshot-agent, ${formatBytes(bytes)}\n`);
+  return 0;
+}
+
+async function runTrashPurge(opts) {
+  if (!opts.dryRun) assertWritable(opts, 'trash purge');
+  if (opts.olderThanMs === null) {
+    throw new Error('trash purge needs --older-than DURATION');
+  }
+  const cutoff = Date.now() - opts.olderThanMs;
+  let count = 0;
+  let bytes = 0;
+  for (const item of await trashedByUs()) {
+    if (Date.parse(item.time) > cutoff) continue;
+    if (!opts.dryRun) {
+      try {
+        const data = opts.audit ? await fsp.readFile(item.location).catch(() => null) : null;
+        await fsp.rm(item.location, { recursive: true, force: true });
+        await audit(opts, 'delete', { original: item.original, location: item.location, size: item.bytes }, data);
+        if (item.info) await safeUnlink(item.info);
+        const purged = { id: item.id, time: rfc3339(new Date()), action: 'purged' };
+        await fsp.appendFile(journalPath(), JSON.stringify(purged) + '\n');
+      } catch (err) {
+        process.stderr.write(`${item.location}: ${err.message || String(err)}\n`);
+        continue;
+      }
+    }
+    process.stdout.write(textPath(item.original) + '\n');
+    count += 1;
+    bytes += item.bytes;
+  }
+  process.stderr.write(`${opts.dryRun ? 'would purge' : 'purged'} ${count} items (${formatBytes(bytes)})\n`);
+  return 0;
+}
+
+async function runRestore(opts) {
+  if (opts.restoreList) return runRestoreList(opts);
+  assertWritable(opts, 'restore');
+  const entries = await readJournal();
+  const entry = opts.restoreId ? entries.find((item) => item.id === opts.restoreId) : entries[entries.length - 1];
+  if (!entry) {
+    throw new Error(opts.restoreId ? `no restorable operation ${opts.restoreId}` : 'nothing to restore');
+  }
+  if (!entry.location) {
+    throw new Error(`cannot restore ${entry.original}: restore it from the Recycle Bin`);
+  }
+  if (!fs.existsSync(entry.location)) {
+    throw new Error(`cannot restore ${entry.original}: ${entry.location} is gone`);
+  }
+  let target = entry.original;
+  if (entry.originalBytes) {
+    // Names that aren't valid UTF-8 go back under their exact bytes.
+    target = Buffer.from(entry.originalBytes, 'base64');
+    if (fs.existsSync(target)) throw new Error(`${textPath(entry.original)} already exists`);
+  } else {
+    target = await placeTarget(entry.original, opts.collision || 'fail', opts);
+    if (!target) return 0;
+  }
+  await fsp.mkdir(path.dirname(entry.original), { recursive: true });
+  if (entry.action === 'trash') {
+    await moveFile(entry.location, target);
+    if (entry.info) await safeUnlink(entry.info);
+  } else {
+    // The staged copy may still be in use, so a moved file comes back as a copy.
+    await copyFile(entry.location, target);
+  }
+  const restored = { id: entry.id, time: rfc3339(new Date()), action: 'restored' };
+  await fsp.appendFile(journalPath(), JSON.stringify(restored) + '\n');
+  process.stdout.write(textPath(Buffer.isBuffer(target) ? entry.original : target) + '\n');
+  return 0;
+}
+
+// runRestoreList prints the journal entries restore can still undo, oldest
+// first, so an ID can be picked without reading journal.jsonl.
+async function runRestoreList(opts) {
+  const entries = (await readJournal()).filter((entry) => entry.location && fs.existsSync(entry.location));
+  if (opts.json) {
+    const list = entries.map((entry) => ({
+      id: entry.id,
+      time: entry.time,
+      action: entry.action,
+      original: entry.original,
+      location: entry.location,
+      bytes: entry.size,
+    }));
+    process.stdout.write(JSON.stringify({ items: list, count: entries.length }) + '\n');
+    return 0;
+  }
+  for (const entry of entries) {
+    process.stdout.write(`${entry.id}  ${entry.time}  ${entry.action.padEnd(5)}  ${textPath(entry.original)}\n`);
+  }
+  return 0;
+}
+
+// discardFile puts a consumed file in the trash, or in the stash with
+// --stash, and records where it went.
+async function discardFile(candidate, opts) {
+  // Hashed first: a Recycle Bin entry has no path to read back.
+  const data = opts.audit ? await fsp.readFile(fsPathOf(candidate)).catch(() => null) : null;
+  if (opts.stash) {
+    const location = await stashFile(candidate, opts);
+    await audit(opts, 'stash', { original: candidate.path, location, size: candidate.size }, data);
+    return;
+  }
+  const location = await trashFile(fsPathOf(candidate));
+  await journal('trash', candidate, location);
+  await audit(opts, 'trash', { original: candidate.path, location: location.path, size: candidate.size }, data);
+}
+
+// audit appends one event to the --audit log: what happened to which
+// capture, when, and the SHA-256 of its bytes (content is a buffer or a
+// path to hash). The file is only appended to; nothing reads it back.
+async function audit(opts, event, fields, content) {
+  if (!opts.audit) return;
+  let data = content;
+  if (typeof content === 'string') data = await fsp.readFile(content).catch(() => null);
+  const entry = {
+    time: rfc3339(new Date()),
+    event,
+    ...fields,
+    ...(data ? { sha256: crypto.createHash('sha256').update(data).digest('hex') } : {}),
+    pid: process.pid,
+  };
+  try {
+    await fsp.mkdir(path.dirname(opts.audit), { recursive: true });
+    await fsp.appendFile(opts.audit, JSON.stringify(entry) + '\n', { mode: 0o600 });
+  } catch (err) {
+    process.stderr.write(`warning: cannot write audit log ${opts.audit}: ${err.message}\n`);
+  }
+}
+
+function stashDir() {
+  return path.join(stateDir(), 'stash');
+}
+
+function stashIndexPath() {
+  return path.join(stashDir(), 'index.json');
+}
+
+async function readStashIndex() {
+  try {
+    const index = JSON.parse(await fsp.readFile(stashIndexPath(), 'utf8'));
+    return Array.isArray(index.items) ? index.items : [];
+  } catch (err) {
+    if (err.code === 'ENOENT') return [];
+    throw new Error(`${stashIndexPath()}: ${err.message}`);
+  }
+}
+
+async function writeStashIndex(items) {
+  const indexPath = stashIndexPath();
+  const tmp = `${indexPath}.${process.pid}.tmp`;
+  await fsp.writeFile(tmp, JSON.stringify({ items }, null, 2) + '\n', { mode: 0o600 });
+  await fsp.rename(tmp, indexPath);
+}
+
+// stashFile is the --stash alternative to the trash, for systems where the
+// trash is missing or broken: the file moves to stash/ID/NAME in the state
+// directory and is listed in stash/index.json until it expires.
+async function stashFile(candidate, opts) {
+  const items = await pruneStash(await readStashIndex(), opts);
+  const id = crypto.randomBytes(4).toString('hex');
+  const dir = path.join(stashDir(), id);
+  await fsp.mkdir(dir, { recursive: true, mode: 0o700 });
+  const location = path.join(dir, path.basename(candidate.path));
+  await moveFile(fsPathOf(candidate), location);
+  const now = Date.now();
+  items.push({
+    id,
+    time: rfc3339(new Date(now)),
+    expires: rfc3339(new Date(now + opts.stashTtlMs)),
+    original: candidate.path,
+    ...(candidate.fsPath ? { originalBytes: candidate.fsPath.toString('base64') } : {}),
+    location,
+    size: candidate.size,
+  });
+  await writeStashIndex(items);
+  log(opts, `stashed ${candidate.path} as ${id}`);
+  return location;
+}
+
+// pruneStash deletes expired entries (and entries whose file is already
+// gone) and returns the rest.
+async function pruneStash(items, opts) {
+  const now = Date.now();
+  const kept = [];
+  for (const item of items) {
+    if (Date.parse(item.expires) > now && fs.existsSync(item.location)) {
+      kept.push(item);
+      continue;
+    }
+    if (fs.existsSync(item.location)) {
+      await audit(opts, 'delete', { original: item.original, location: item.location, size: item.size }, item.location);
+    }
+    await fsp.rm(path.dirname(item.location), { recursive: true, force: true }).catch(() => {});
+  }
+  if (kept.length !== items.length) await writeStashIndex(kept);
+  return kept;
+}
+
+async function runStashList(opts) {
+  const items = await pruneStash(await readStashIndex(), opts);
+  if (opts.json) {
+    const list = items.map((item) => ({
+      id: item.id,
+      time: item.time,
+      expires: item.expires,
+      original: item.original,
+      location: item.location,
+      bytes: item.size,
+    }));
+    process.stdout.write(JSON.stringify({ items: list, count: items.length }) + '\n');
+    return 0;
+  }
+  for (const item of items) {
+    process.stdout.write(`${item.id}  ${item.time}  expires ${item.expires}  ${textPath(item.original)}\n`);
+  }
+  return 0;
+}
+
+async function runStashRestore(opts) {
+  assertWritable(opts, 'stash restore');
+  const items = await pruneStash(await readStashIndex(), opts);
+  const item = opts.restoreId ? items.find((entry) => entry.id === opts.restoreId) : items[items.length - 1];
+  if (!item) {
+    throw new Error(opts.restoreId ? `no stashed file ${opts.restoreId}` : 'nothing stashed');
+  }
+  let target = item.original;
+  if (item.originalBytes) {
+    target = Buffer.from(item.originalBytes, 'base64');
+    if (fs.existsSync(target)) throw new Error(`${textPath(item.original)} already exists`);
+  } else {
+    target = await placeTarget(item.original, opts.collision || 'fail', opts);
+    if (!target) return 0;
+  }
+  await fsp.mkdir(path.dirname(item.original), { recursive: true });
+  await moveFile(item.location, target);
+  await fsp.rm(path.dirname(item.location), { recursive: true, force: true });
+  await writeStashIndex(items.filter((entry) => entry.id !== item.id));
+  process.stdout.write(textPath(Buffer.isBuffer(target) ? item.original : target) + '\n');
+  return 0;
+}
+
+const WATCH_POLL_MS = 2000;
+const WATCH_CLIPBOARD_MS = 1000;
+
+// runWatch stages every screenshot that appears after it starts: files via
+// fs.watch on Desktop and Downloads (each consumed per its own rules, with
+// a slow poll as backstop) and clipboard images by polling for new bytes,
+// as there is no portable clipboard notification. Each result is one line:
+// SOURCE<TAB>TEMP_PATH, a --format line, or with --json a schema event.
+async function runWatch(opts) {
+  const dirs = opts.clipboardOnly ? [] : await knownSources();
+  const seen = new Set();
+  for (const { label, dir } of dirs) {
+    for (const candidate of await listImages(dir, label, opts)) seen.add(slotKey(candidate));
+  }
+  let clipboardHash = await clipboardHashNow(opts);
+  let queue = Promise.resolve();
+  const serial = (fn) => {
+    queue = queue.then(fn).catch((err) => emitWatchError(err, opts));
+  };
+
+  const scanDirs = async () => {
+    for (const { label, dir } of dirs) {
+      const dirOpts = { ...opts, useDownloads: label === 'Downloads' };
+      for (const candidate of await withoutStaged(await listImages(dir, label, opts), opts)) {
+        const key = slotKey(candidate);
+        if (seen.has(key) || candidate.placeholder || (await stillWriting(candidate))) continue;
+        seen.add(key);
+        const action = evaluateRules(opts.rules, ruleFacts(candidate, Date.now()));
+        if (action === 'skip' || action === 'reject') {
+          log(opts, `rule ${action === 'skip' ? 'skipped' : 'rejected'} candidate: ${candidate.path}`);
+          continue;
+        }
+        candidate.timeMs = captureTime(candidate, opts.sort);
+        candidate.cloud = cloudProvider(dir);
+        const staged = await handleFileCandidate(candidate, dirOpts);
+        staged.modTimeMs = candidate.modTimeMs;
+        emitWatchResult(await finishResult(staged, dirOpts), opts);
+      }
+    }
+  };
+  const checkClipboard = async () => {
+    let candidate;
+    try {
+      candidate = filterClipboardCandidate(await readClipboardImage(opts), opts);
+    } catch (err) {
+      if (err.code !== ERR_NOT_FOUND && err.code !== ERR_UNSUPPORTED) throw err;
+      return;
+    } finally {
+      shutdownClipboard(opts);
+    }
+    if (!candidate || !candidate.data) return;
+    const hash = crypto.createHash('sha256').update(candidate.data).digest('hex');
+    if (hash === clipboardHash) return;
+    clipboardHash = hash;
+    emitWatchResult(await finishResult(await handleClipboardCandidate(candidate, opts), opts), opts);
+  };
+
+  const watchers = [];
+  for (const { dir } of dirs) {
+    try {
+      watchers.push(fs.watch(dir, () => serial(scanDirs)));
+    } catch (err) {
+      log(opts, `watch: cannot watch ${dir} (${err.code}); polling only`);
+    }
+  }
+  const timers = [setInterval(() => serial(checkClipboard), WATCH_CLIPBOARD_MS)];
+  if (dirs.length > 0) timers.push(setInterval(() => serial(scanDirs), WATCH_POLL_MS));
+  const watched = [...dirs.map(({ dir }) => dir), 'the clipboard'];
+  process.stderr.write(`watching ${watched.join(', ')}; Ctrl-C to stop\n`);
+  return new Promise((resolve) => {
+    const stop = () => {
+      for (const timer of timers) clearInterval(timer);
+      for (const watcher of watchers) watcher.close();
+      queue.then(() => resolve(0));
+    };
+    process.once('SIGINT', stop);
+    process.once('SIGTERM', stop);
+  });
+}
+
+async function clipboardHashNow(opts) {
+  try {
+    const candidate = await readClipboardImage(opts);
+    return crypto.createHash('sha256').update(candidate.data).digest('hex');
+  } catch (err) {
+    return '';
+  } finally {
+    shutdownClipboard(opts);
+  }
+}
+
+function emitWatchResult(result, opts) {
+  if (opts.json) {
+    const event = { schemaVersion: SCHEMA_VERSION, type: 'result', time: rfc3339(result.time) };
+    process.stdout.write(JSON.stringify({ ...event, result: resultJson(result) }) + '\n');
+  } else if (opts.format) {
+    writeResult(result, opts);
+  } else {
+    process.stdout.write(`${textPath(result.source)}\t${result.tempPath}\n`);
+  }
+}
+
+function emitWatchError(err, opts) {
+  const message = err && err.message ? err.message : String(err);
+  if (opts.json) {
+    const event = { schemaVersion: SCHEMA_VERSION, type: 'error', time: rfc3339(new Date()) };
+    const error = { ...(err && typeof err.code === 'string' ? { code: err.code } : {}), message };
+    process.stdout.write(JSON.stringify({ ...event, error }) + '\n');
+  } else {
+    process.stderr.write(`warning: ${message}\n`);
+  }
+}
+
+function replayDir() {
+  return path.join(stateDir(), 'replay');
+}
+
+async function runReplayStart(opts) {
+  const source = REPLAY_SOURCES.find((item) => item.platforms.includes(process.platform));
+  if (!source) {
+    throw unsupportedError('replay', REPLAY_SOURCES.flatMap((item) => item.platforms));
+  }
+  if (!source.available()) {
+    throw new Error(`replay needs ffmpeg${source.name === 'x11grab' ? ' and an X11 display' : ''}`);
+  }
+  const dir = replayDir();
+  await fsp.rm(dir, { recursive: true, force: true });
+  await fsp.mkdir(dir, { recursive: true, mode: 0o700 });
+  const wrap = Math.ceil(opts.replaySeconds / REPLAY_SEGMENT_SECONDS) + 2;
+  const args = [
+    '-hide_banner',
+    '-loglevel',
+    'error',
+    ...source.input(),
+    '-r',
+    '15',
+    '-c:v',
+    'libx264',
+    '-preset',
+    'ultrafast',
+    '-pix_fmt',
+    'yuv420p',
+    '-f',
+    'segment',
+    '-segment_time',
+    String(REPLAY_SEGMENT_SECONDS),
+    '-segment_wrap',
+    String(wrap),
+    '-reset_timestamps',
+    '1',
+    path.join(dir, 'segment-%03d.ts'),
+  ];
+  log(opts, `ffmpeg ${args.join(' ')}`);
+  process.stderr.write(`recording the last ~${opts.replaySeconds}s into ${dir}; Ctrl-C to stop\n`);
+  return new Promise((resolve, reject) => {
+    const child = spawn('ffmpeg', args, { stdio: ['ignore', 'ignore', 'inherit'] });
+    const stop = () => child.kill('SIGINT');
+    process.once('SIGINT', stop);
+    process.once('SIGTERM', stop);
+    child.on('error', reject);
+    child.on('exit', () => resolve(0));
+  });
+}
+
+async function runReplaySave(opts) {
+  if (!commandExists('ffmpeg')) {
+    throw new Error('replay save needs ffmpeg');
+  }
+  const dir = replayDir();
+  const entries = await fsp.readdir(dir).catch(() => []);
+  const segments = [];
+  for (const name of entries) {
+    if (!name.endsWith('.ts')) continue;
+    const info = await fsp.stat(path.join(dir, name)).catch(() => null);
+    if (info && info.size > 0) segments.push({ file: path.join(dir, name), modTimeMs: info.mtimeMs });
+  }
+  if (segments.length === 0) {
+    throw new Error('no replay buffer (run "replay start" first)');
+  }
+  segments.sort((a, b) => a.modTimeMs - b.modTimeMs);
+  const needed = Math.ceil(opts.replaySeconds / REPLAY_SEGMENT_SECONDS) + 1;
+  const recent = segments.slice(-needed).map((item) => item.file);
+  const out = await stagePath(opts.gif ? 'replay-*.gif' : 'replay-*.mp4', opts);
+  const encode = opts.gif
+    ? ['-vf', 'fps=10,scale=960:-2:flags=lanczos', '-loop', '0']
+    : ['-c:v', 'libx264', '-pix_fmt', 'yuv420p', '-movflags', '+faststart'];
+  execFileSync(
+    'ffmpeg',
+    ['-hide_banner', '-loglevel', 'error', '-y', '-sseof', `-${opts.replaySeconds}`, '-i', `concat:${recent.join('|')}`, ...encode, out],
+    { stdio: ['ignore', 'ignore', 'inherit'] },
+  );
+  const result = await finishResult({ source: 'replay', kind: 'replay', tempPath: path.resolve(out) }, opts);
+  writeResult(result, opts);
+  return 0;
+}
+
+const SOUND_EXTS = new Set(['.aiff', '.aif', '.wav', '.mp3', '.ogg', '.oga', '.flac', '.m4a', '.caf']);
+
+const SOUND_PLAYERS = [
+  { cmd: 'afplay', platforms: ['darwin'], fallback: '/System/Library/Sounds/Glass.aiff', args: (file) => [file] },
+  {
+    cmd: 'paplay',
+    platforms: UNIX_DESKTOPS,
+    fallback: '/usr/share/sounds/freedesktop/stereo/complete.oga',
+    args: (file) => [file],
+  },
+  {
+    cmd: 'pw-play',
+    platforms: UNIX_DESKTOPS,
+    fallback: '/usr/share/sounds/freedesktop/stereo/complete.oga',
+    args: (file) => [file],
+  },
+  { cmd: 'aplay', platforms: UNIX_DESKTOPS, fallback: '', args: (file) => ['-q', file] },
+  {
+    cmd: 'powershell',
+    platforms: ['win32'],
+    fallback: 'C:\\Windows\\Media\\Windows Notify System Generic.wav',
+    args: (file) => ['-NoProfile', '-Command', `(New-Object Media.SoundPlayer '${file.replace(/'/g, "''")}').PlaySync()`],
+  },
+];
+
+// playSound starts the player detached so a slow audio device never delays
+// the result on stdout.
+function playSound(file, opts) {
+  for (const player of SOUND_PLAYERS) {
+    if (!player.platforms.includes(process.platform) || !commandExists(player.cmd)) continue;
+    const target = file || player.fallback;
+    if (!target || !fs.existsSync(target)) continue;
+    try {
+      const child = spawn(player.cmd, player.args(target), { stdio: 'ignore', detached: true });
+      child.on('error', () => {});
+      child.unref();
+      log(opts, `playing ${target} via ${player.cmd}`);
+      return;
+    } catch (err) {
+      log(opts, `sound ${player.cmd}: ${err.message || String(err)}`);
+    }
+  }
+  log(opts, 'no sound player available');
+}
+
+function inspectClipboard(opts) {
+  const readType = (cmd, args) => {
+    try {
+      return execFileSync(cmd, args, { stdio: ['ignore', 'pipe', 'ignore'], maxBuffer: CLIPBOARD_MAX_BUFFER });
+    } catch (err) {
+      log(opts, `${cmd} ${args.join(' ')}: ${err.message}`);
+      return null;
+    }
+  };
+  const describe = (type, data) => ({
+    type,
+    size: data ? data.length : null,
+    preview: data ? previewClipboardData(type, data) : '(unreadable)',
+  });
+
+  if (process.platform === 'darwin' && commandExists('osascript')) {
+    const info = readType('osascript', ['-e', 'clipboard info']);
+    const formats = [];
+    const text = info ? info.toString('utf8').trim() : '';
+    const re = /((?:«class [^»]+»)|[A-Za-z ]+?), (\d+)(?:, |$)/g;
+    let match;
+    while ((match = re.exec(text)) !== null) {
+      const type = match[1].trim();
+      let preview = '';
+      if (type === 'string' || type === 'Unicode text' || type === '«class utf8»') {
+        const data = readType('osascript', ['-e', 'the clipboard as text']);
+        preview = data ? previewText(data.toString('utf8')) : '';
+      } else {
+        preview = osaTypeDescription(type);
+      }
+      formats.push({ type, size: Number(match[2]), preview });
+    }
+    return { backend: 'osascript', formats };
+  }
+
+  if (commandExists('wl-paste') && process.env.WAYLAND_DISPLAY) {
+    const list = readType('wl-paste', ['--list-types']);
+    const types = list ? splitLines(list.toString('utf8')) : [];
+    return {
+      backend: 'wl-paste',
+      formats: types.map((type) => describe(type, readType('wl-paste', ['--no-newline', '--type', type]))),
+    };
+  }
+
+  if (commandExists('xclip')) {
+    const list = readType('xclip', ['-selection', 'clipboard', '-t', 'TARGETS', '-o']);
+    const skip = new Set(['TARGETS', 'TIMESTAMP', 'MULTIPLE', 'SAVE_TARGETS', 'DELETE', 'INSERT_PROPERTY', 'INSERT_SELECTION']);
+    const types = (list ? splitLines(list.toString('utf8')) : []).filter((type) => !skip.has(type));
+    return {
+      backend: 'xclip',
+      formats: types.map((type) => describe(type, readType('xclip', ['-selection', 'clipboard', '-t', type, '-o']))),
+    };
+  }
+  return null;
+}
+
+function previewClipboardData(type, data) {
+  const kind = sniffImageType(data);
+  if (kind) return `${kind.toUpperCase()} image data`;
+  const lower = type.toLowerCase();
+  if (lower.startsWith('text/') || lower === 'string' || lower === 'utf8_string' || lower === 'compound_text') {
+    return previewText(data.toString('utf8'));
+  }
+  return `bytes ${data.subarray(0, 12).toString('hex')}${data.length > 12 ? '...' : ''}`;
+}
+
+function previewText(text) {
+  return JSON.stringify(text.length > 60 ? `${text.slice(0, 60)}...` : text);
+}
+
+function osaTypeDescription(type) {
+  const known = {
+    '«class PNGf»': 'PNG image data',
+    TIFF: 'TIFF image data',
+    'TIFF picture': 'TIFF image data',
+    '«class TIFF»': 'TIFF image data',
+    'JPEG picture': 'JPEG image data',
+    '«class JPEG»': 'JPEG image data',
+    '«class PDF »': 'PDF data',
+    '«class furl»': 'file URL',
+    '«class RTF »': 'rich text',
+    '«class HTML»': 'HTML',
+  };
+  return known[type] || '';
+}
+
+function sniffImageType(data) {
+  if (!data || data.length < 12) return '';
+  if (data[0] === 0x89 && data.toString('latin1', 1, 4) === 'PNG') return 'png';
+  if (data[0] === 0xff && data[1] === 0xd8 && data[2] === 0xff) return 'jpeg';
+  if (data.toString('latin1', 0, 4) === 'RIFF' && data.toString('latin1', 8, 12) === 'WEBP') return 'webp';
+  if (data.toString('latin1', 0, 4) === 'GIF8') return 'gif';
+  if (data.toString('latin1', 0, 2) === 'BM') return 'bmp';
+  const tiff = data.toString('latin1', 0, 4);
+  if (tiff === 'II*\0' || tiff === 'MM\0*') return 'tiff';
+  // HEIF containers (iPhone HEIC, AVIF) start with an ftyp box naming the brand.
+  if (data.toString('latin1', 4, 8) === 'ftyp') {
+    const brand = data.toString('latin1', 8, 12);
+    if (brand === 'avif' || brand === 'avis') return 'avif';
+    if (['heic', 'heix', 'heim', 'heis', 'hevc', 'hevx', 'mif1', 'msf1'].includes(brand)) return 'heic';
+  }
+  return '';
+}
+
+function splitLines(text) {
+  return text
+    .split('\n')
+    .map((line) => line.trim())
+    .filter(Boolean);
+}
+
+// writeDataToTemp names the file after what the bytes are, not what the
+// source claimed, since uploaders reject a JPEG called .png.
+async function writeDataToTemp(data, prefix, opts) {
+  const ext = imageTypeExt(sniffImageType(data)) || '.png';
+  const tempPath = await stagePath(`${prefix}-*${ext}`, opts);
+  await fsp.writeFile(tempPath, data);
+  return path.resolve(tempPath);
+}
+
+function imageTypeExt(type) {
+  if (!type) return '';
+  return type === 'jpeg' ? '.jpg' : `.${type}`;
+}
+
+async function stagedExt(src, opts) {
+  const original = path.extname(String(src)).toLowerCase();
+  if (opts.rasterize && isVectorExt(original)) return original;
+  if (opts.extFromContent || !IMAGE_EXTS.includes(original.slice(1))) {
+    const ext = imageTypeExt(sniffImageType(await readHead(src, 16)));
+    if (ext) return ext;
+  }
+  return normalizeExt(path.extname(String(src)));
+}
+
+async function readHead(file, length) {
+  const handle = await fsp.open(file, 'r');
+  try {
+    const { buffer, bytesRead } = await handle.read(Buffer.alloc(length), 0, length, 0);
+    return buffer.subarray(0, bytesRead);
+  } finally {
+    await handle.close();
+  }
+}
+
+function readStdin() {
+  return new Promise((resolve, reject) => {
+    const chunks = [];
+    process.stdin.on('data', (chunk) => chunks.push(chunk));
+    process.stdin.on('end', () => resolve(Buffer.concat(chunks)));
+    process.stdin.on('error', reject);
+  });
+}
+
+async function findFallbackImage(opts) {
+  injectFailure(opts, 'scan');
+  return latestImage(await searchDirs(opts), opts);
+}
+
+// searchDirs lists the directories a run picks files from: Desktop (or
+// Downloads with --downloads, or both with --all-sources), Pictures\Screenshots
+// on Windows, where Win+PrtScn and the Snipping Tool save, and every --dir.
+// With --dirs-only just the --dir ones. Missing directories are left out.
+// Files from the 'Screenshots' ones are copied, never consumed.
+async function searchDirs(opts) {
+  const dirs = [];
+  if (!opts.dirsOnly) {
+    const labels = opts.allSources ? ['Desktop', 'Downloads'] : [opts.useDownloads ? 'Downloads' : 'Desktop'];
+    for (const label of labels) {
+      const dir = await locateFallbackDir(label === 'Downloads').catch((err) => err);
+      if (!(dir instanceof Error)) {
+        dirs.push({ label, dir });
+      } else if (dir.code !== ERR_NOT_FOUND) {
+        throw dir;
+      }
+    }
+    for (const dir of labels.includes('Desktop') ? await locateScreenshots() : []) {
+      if (!dirs.some((item) => item.dir === dir)) dirs.push({ label: 'Screenshots', dir });
+    }
+  }
+  for (const value of opts.dirs) {
+    const dir = await realDir(expandHome(value));
+    if (!dir) {
+      log(opts, `--dir ${value}: not a directory; skipping`);
+      continue;
+    }
+    if (agentOwnedDir(dir)) {
+      log(opts, `--dir ${value}: screenshot-agent's own files; skipping`);
+      continue;
+    }
+    if (!dirs.some((item) => item.dir === dir)) dirs.push({ label: dir, dir });
+  }
+  if (dirs.length === 0) throw notFoundError();
+  return dirs;
+}
+
+function expandHome(value) {
+  if (value === '~' || value.startsWith('~/') || value.startsWith(`~${path.sep}`)) {
+    return path.join(os.homedir(), value.slice(1));
+  }
+  return path.resolve(value);
+}
+
+async function copyImageToTemp(src, opts) {
+  const ext = await stagedExt(src, opts);
+  const tempPath = await stagePath(`image-*${ext}`, opts);
+  await copyFile(src, tempPath);
+  return path.resolve(tempPath);
+}
+
+async function moveImageToTemp(src, opts) {
+  const ext = await stagedExt(src, opts);
+  const tempPath = await stagePath(`image-*${ext}`, opts);
+  try {
+    await moveFile(src, tempPath);
+  } catch (err) {
+    // A cross-device move copies first; don't leave that copy behind when
+    // removing the source failed.
+    await safeUnlink(tempPath);
+    throw err;
+  }
+  return path.resolve(tempPath);
+}
+
+// knownSources returns the standard directories that exist on this machine.
+async function knownSources() {
+  const sources = [];
+  for (const [label, locate] of [
+    ['Desktop', locateDesktop],
+    ['Downloads', locateDownloads],
+  ]) {
+    const dir = await locate().catch(() => '');
+    if (dir) sources.push({ label, dir });
+  }
+  for (const dir of await locateScreenshots().catch(() => [])) {
+    if (!sources.some((item) => item.dir === dir)) sources.push({ label: 'Screenshots', dir });
+  }
+  return sources;
+}
+
+async function backlogReport(opts) {
+  const report = [];
+  for (const source of await knownSources()) {
+    const images = await listImages(source.dir, source.label, opts).catch(() => []);
+    report.push({
+      dir: source.label,
+      path: source.dir,
+      images: images.length,
+      screenshots: images.filter((image) => image.tagged).length,
+      bytes: images.reduce((sum, image) => sum + image.size, 0),
+    });
+  }
+  return report;
+}
+
+async function locateFallbackDir(useDownloads) {
+  if (useDownloads) {
+    return locateDownloads();
+  }
+  return locateDesktop();
+}
+
+async function locateDesktop() {
+  const home = os.homedir();
+  if (process.platform === 'win32') {
+    const dir = await realDir(await windowsKnownFolder('Desktop'));
+    if (dir) {
+      return dir;
+    }
+  }
+  const defaultDesktop = await realDir(path.join(home, 'Desktop'));
+  if (defaultDesktop) {
+    return defaultDesktop;
+  }
+  if (UNIX_DESKTOPS.includes(process.platform)) {
+    const dir = await realDir(await xdgUserDir(home, 'DESKTOP'));
+    if (dir) {
+      return dir;
+    }
+  }
+  throw notFoundError();
+}
+
+async function locateDownloads() {
+  const home = os.homedir();
+  if (process.platform === 'win32') {
+    const dir = await realDir(await windowsKnownFolder(WINDOWS_DOWNLOADS));
+    if (dir) {
+      return dir;
+    }
+  }
+  const defaultDownloads = await realDir(path.join(home, 'Downloads'));
+  if (defaultDownloads) {
+    return defaultDownloads;
+  }
+  if (UNIX_DESKTOPS.includes(process.platform)) {
+    const dir = await realDir(await xdgUserDir(home, 'DOWNLOAD'));
+    if (dir) {
+      return dir;
+    }
+  }
+  throw notFoundError();
+}
+
+// locateScreenshots returns the existing directories the platform's own
+// capture tools save to: Pictures\Screenshots on Windows (created by the
+// first Win+PrtScn), and on Linux/BSD the gnome-screenshot and Spectacle
+// save locations plus Pictures/Screenshots, where GNOME Shell writes, in
+// both the XDG Pictures folder and ~/Pictures. Callers label them
+// 'Screenshots': they hold the user's kept captures, so files there are
+// copied and never consumed.
+async function locateScreenshots() {
+  const home = os.homedir();
+  let pictures = '';
+  let candidates = [];
+  if (process.platform === 'win32') {
+    pictures = (await windowsKnownFolder('My Pictures')) || path.join(home, 'Pictures');
+    candidates = [
+      await windowsKnownFolder(WINDOWS_SCREENSHOTS),
+      path.join(pictures, 'Screenshots'),
+      ...oneDriveRoots().map((root) => path.join(root, 'Pictures', 'Screenshots')),
+    ];
+  } else if (UNIX_DESKTOPS.includes(process.platform)) {
+    pictures = (await xdgUserDir(home, 'PICTURES')) || path.join(home, 'Pictures');
+    candidates = [
+      await gnomeScreenshotDir(),
+      await spectacleDir(home),
+      ...(await screenshotSubdirs(pictures)),
+      ...(await screenshotSubdirs(path.join(home, 'Pictures'))),
+    ];
+  }
+  // A tool set to save on the Desktop is already searched, and Pictures
+  // itself is too broad to treat as screenshots.
+  const skip = [await locateDesktop().catch(() => ''), await realDir(pictures)];
+  const dirs = [];
+  for (const candidate of candidates) {
+    const dir = await realDir(candidate);
+    if (dir && !dirs.includes(dir) && !skip.includes(dir)) dirs.push(dir);
+  }
+  return dirs;
+}
+
+// oneDriveRoots are the signed-in OneDrive folders. "Automatically save
+// screenshots I capture to OneDrive" writes PrtScn captures to
+// Pictures\Screenshots inside them, even when Pictures itself is not
+// backed up (so the known folder still points at the local one). Like
+// the other screenshot folders it is only copied from: trashing a synced
+// file there deletes it from the cloud too.
+function oneDriveRoots() {
+  const roots = ['OneDrive', 'OneDriveConsumer', 'OneDriveCommercial'].map((name) => process.env[name]).filter(Boolean);
+  return [...new Set(roots)];
+}
+
+// screenshotSubdirs lists the folders in pictures named like screenshots.
+// GNOME Shell saves to Pictures/Screenshots under the translated name
+// (Bildschirmfotos, Captures d’écran), so plurals are matched too. They
+// get the 'Screenshots' label like the untranslated folder, so they are
+// never consumed.
+async function screenshotSubdirs(pictures) {
+  let entries;
+  try {
+    entries = await fsp.readdir(pictures, { withFileTypes: true });
+  } catch (err) {
+    return [];
+  }
+  return entries
+    .filter((entry) => entry.isDirectory() || entry.isSymbolicLink())
+    .filter((entry) => isScreenshotName(entry.name.replace(/(\p{L})s\b/gu, '$1')))
+    .map((entry) => path.join(pictures, entry.name));
+}
+
+// gnomeScreenshotDir is gnome-screenshot's auto-save-directory, a file://
+// URI or plain path ('' when unset, which means Pictures).
+async function gnomeScreenshotDir() {
+  if (!commandExists('gsettings')) return '';
+  let out;
+  try {
+    const args = ['get', 'org.gnome.gnome-screenshot', 'auto-save-directory'];
+    out = (await runProcess('gsettings', args)).toString('utf8');
+  } catch (err) {
+    return '';
+  }
+  return localPathFromUri(out.trim().replace(/^'|'$/g, ''));
+}
+
+// spectacleDir reads KDE Spectacle's save location from spectaclerc. The
+// key moved between releases (defaultSaveLocation in [General] or [Save],
+// imageSaveLocation in [ImageSave]); any of them will do.
+async function spectacleDir(home) {
+  let data;
+  try {
+    data = await fsp.readFile(path.join(home, '.config', 'spectaclerc'), 'utf8');
+  } catch (err) {
+    return '';
+  }
+  const match = data.match(/^\s*(?:imageSaveLocation|defaultSaveLocation)\s*=\s*(.+?)\s*$/m);
+  return match ? localPathFromUri(match[1]) : '';
+}
+
+function localPathFromUri(value) {
+  if (!value) return '';
+  if (!value.startsWith('file://')) return path.isAbsolute(value) ? value : '';
+  try {
+    return decodeURIComponent(new URL(value).pathname);
+  } catch (err) {
+    return '';
+  }
+}
+
+const WINDOWS_DOWNLOADS = '{374DE290-123F-4565-9164-39C4925E467B}';
+const WINDOWS_SCREENSHOTS = '{B7BEDE81-DF94-4682-A7D8-57A52620B86F}';
+const WINDOWS_SHELL_FOLDERS = 'HKCU\\Software\\Microsoft\\Windows\\CurrentVersion\\Explorer\\User Shell Folders';
+
+// windowsKnownFolder reads a KNOWNFOLDERID location from User Shell Folders,
+// which is where OneDrive backup and "Move..." in folder properties record
+// a redirected Desktop, Downloads, or Pictures. Returns '' when unset.
+async function windowsKnownFolder(value) {
+  let out;
+  try {
+    out = (await runProcess('reg', ['query', WINDOWS_SHELL_FOLDERS, '/v', value])).toString('utf8');
+  } catch (err) {
+    return '';
+  }
+  const match = out.match(/\sREG_(?:EXPAND_)?SZ\s+(.+?)\s*$/m);
+  if (!match) return '';
+  return match[1].replace(/%([^%]+)%/g, (whole, name) => {
+    const key = Object.keys(process.env).find((item) => item.toLowerCase() === name.toLowerCase());
+    return key ? process.env[key] : whole;
+  });
+}
+
+// realDir resolves symlinks (dotfile managers and sync clients often link
+// ~/Desktop elsewhere) so scans, trash paths, and mount checks all see the
+// real directory. A dangling link counts as missing.
+async function realDir(dir) {
+  if (!dir) return '';
+  try {
+    const real = await fsp.realpath(dir);
+    return (await isDir(real)) ? real : '';
+  } catch (err) {
+    return '';
+  }
+}
+
+async function xdgUserDir(home, key) {
+  const configPath = path.join(home, '.config', 'user-dirs.dirs');
+  let data;
+  try {
+    data = await fsp.readFile(configPath, 'utf8');
+  } catch (err) {
+    return '';
+  }
+  const prefix = `XDG_${key}_DIR=`;
+  for (const rawLine of data.split('\n')) {
+    const line = rawLine.trim();
+    if (!line.startsWith(prefix)) continue;
+    let value = line.slice(prefix.length).trim();
+    value = value.replace(/^['"]|['"]$/g, '');
+    value = value.replace(/\$\{HOME\}/g, home).replace(/\$HOME/g, home);
+    if (value.startsWith('~')) {
+      value = path.join(home, value.slice(1));
+    }
+    if (!value) return '';
+    if (!path.isAbsolute(value)) {
+      value = path.join(home, value);
+    }
+    return path.normalize(value);
+  }
+  return '';
+}
+
+async function listImages(dir, label, opts = {}) {
+  let entries;
+  try {
+    entries = await fsp.readdir(dir, { withFileTypes: true, encoding: 'buffer' });
+  } catch (err) {
+    if (err && err.code === 'ENOENT') {
+      throw notFoundError();
+    }
+    throw err;
+  }
+
+  const candidates = [];
+  for (const entry of entries) {
+    if (!entry.isFile()) continue;
+    // Names that are not valid UTF-8 keep their raw bytes in fsPath for every
+    // filesystem call; path is the readable (lossy) form.
+    const name = entry.name.toString();
+    const stub = /^\.(.+)\.icloud$/.exec(name);
+    if (stub) {
+      const candidate = await icloudStubCandidate(dir, name, stub[1], label, opts);
+      if (candidate) candidates.push(candidate);
+      continue;
+    }
+    const byExt = hasImageExt(name, opts);
+    const ext = path.extname(name).toLowerCase();
+    const vector = ext === '.svg' || ext === '.pdf';
+    // Files with no extension, or a screenshot name whose "extension" is
+    // really part of the time (Screenshot 2024-05-01 at 10.12.33), are
+    // judged by their content below.
+    if (!byExt && !(ext === '' || isScreenshotName(name, opts))) continue;
+    const fullPath = path.join(dir, name);
+    const fsPath = Buffer.from(name).equals(entry.name)
+      ? null
+      : Buffer.concat([Buffer.from(path.join(dir, path.sep)), entry.name]);
+    let info;
+    try {
+      info = await fsp.stat(fsPath || fullPath);
+    } catch (err) {
+      continue;
+    }
+    if (!info.isFile()) continue;
+    // Sniff the header rather than trust the name, so a non-image called
+    // .png is skipped and an extensionless capture is found. Online-only
+    // placeholders are left alone, as reading them starts a download.
+    if (!vector && !isPlaceholder(info)) {
+      const type = await readHead(fsPath || fullPath, 16)
+        .then(sniffImageType)
+        .catch(() => '');
+      if (!type) {
+        if (byExt) log(opts, `skipping ${fullPath}: not an image`);
+        continue;
+      }
+      const wanted = opts.extensions || IMAGE_EXTS;
+      if (!byExt && !wanted.includes(type) && !(type === 'jpeg' && wanted.includes('jpg'))) continue;
+    } else if (!byExt) {
+      continue;
+    }
+    candidates.push({
+      path: fullPath,
+      modTimeMs: info.mtimeMs,
+      birthTimeMs: info.birthtimeMs,
+      size: info.size,
+      dir: label,
+      tagged: isScreenshotName(name, opts),
+      placeholder: isPlaceholder(info),
+      ...(fsPath ? { fsPath } : {}),
+    });
+  }
+  return candidates;
+}
+
+// icloudStubCandidate stands in for a file iCloud Drive evicted. Before
+// macOS 14 (and for Desktop & Documents synced to iCloud) the real file is
+// replaced by a hidden ".NAME.icloud" stub; the candidate is the real path,
+// marked as a placeholder so selection can download it first.
+async function icloudStubCandidate(dir, stubName, name, label, opts) {
+  if (!hasImageExt(name, opts)) return null;
+  const fullPath = path.join(dir, name);
+  if (fs.existsSync(fullPath)) return null;
+  let info;
+  try {
+    info = await fsp.stat(path.join(dir, stubName));
+  } catch (err) {
+    return null;
+  }
+  return {
+    path: fullPath,
+    modTimeMs: info.mtimeMs,
+    birthTimeMs: info.birthtimeMs,
+    size: 0,
+    dir: label,
+    tagged: isScreenshotName(name, opts),
+    placeholder: true,
+    icloudStub: path.join(dir, stubName),
+  };
+}
+
+// Online-only files from sync clients report their full size but occupy no
+// blocks until the content is downloaded.
+function isPlaceholder(info) {
+  return info.size > 0 && info.blocks === 0;
+}
+
+const CLOUD_PROVIDERS = [
+  { name: 'Dropbox', segment: /^Dropbox( \(.+\))?$|^Dropbox-/ },
+  { name: 'OneDrive', segment: /^OneDrive( - .+)?$|^OneDrive-/ },
+  { name: 'Google Drive', segment: /^(Google Drive|My Drive)$|^GoogleDrive-|^google-drive:/ },
+  { name: 'iCloud Drive', segment: /^com~apple~CloudDocs$/ },
+];
+
+// cloudProvider names the sync client that owns dir, judged by the folder
+// names each provider uses (~/Dropbox, ~/OneDrive - Org,
+// ~/Library/CloudStorage/GoogleDrive-user, GVFS google-drive mounts).
+function cloudProvider(dir) {
+  const segments = path.resolve(dir).split(path.sep);
+  for (const provider of CLOUD_PROVIDERS) {
+    if (segments.some((segment) => provider.segment.test(segment))) {
+      return provider.name;
+    }
+  }
+  return '';
+}
+
+// hydrate asks the provider to download a placeholder by reading it, then
+// waits up to waitMs for real blocks to appear. iCloud doesn't download on
+// read, so on macOS it is asked explicitly; an evicted file's stub stays
+// until the real file replaces it.
+async function hydrate(candidate, waitMs) {
+  const deadline = Date.now() + waitMs;
+  if (process.platform === 'darwin' && (candidate.icloudStub || candidate.cloud === 'iCloud Drive')) {
+    await downloadUbiquitous(candidate.path).catch(() => null);
+  } else {
+    await readHead(fsPathOf(candidate), 1).catch(() => null);
+  }
+  for (;;) {
+    const info = await fsp.stat(fsPathOf(candidate)).catch(() => null);
+    if (info && !isPlaceholder(info)) {
+      candidate.size = info.size;
+      candidate.modTimeMs = info.mtimeMs;
+      candidate.birthTimeMs = info.birthtimeMs;
+      candidate.placeholder = false;
+      delete candidate.icloudStub;
+      return true;
+    }
+    if ((!info && !candidate.icloudStub) || Date.now() >= deadline) return false;
+    await sleep(Math.min(250, Math.max(0, deadline - Date.now())));
+  }
+}
+
+// downloadUbiquitous starts an iCloud download with brctl, or through
+// NSFileManager where brctl is missing.
+async function downloadUbiquitous(file) {
+  if (commandExists('brctl')) {
+    await runProcess('brctl', ['download', file]);
+    return;
+  }
+  const script = [
+    'function run(argv) {',
+    "  ObjC.import('Foundation');",
+    '  const url = $.NSURL.fileURLWithPath(argv[0]);',
+    '  $.NSFileManager.defaultManager.startDownloadingUbiquitousItemAtURLError(url, null);',
+    '}',
+  ].join('\n');
+  await runProcess('osascript', ['-l', 'JavaScript', '-e', script, file]);
+}
+
+// stillSyncing reports a recently written file whose size or mtime moves
+// between two looks, which is when trashing it races the sync client.
+async function stillSyncing(candidate) {
+  if (Date.now() - candidate.modTimeMs > 2000) return false;
+  await sleep(250);
+  const info = await fsp.stat(fsPathOf(candidate)).catch(() => null);
+  return !info || info.size !== candidate.size || info.mtimeMs !== candidate.modTimeMs;
+}
+
+function fsPathOf(candidate) {
+  return candidate.fsPath || candidate.path;
+}
+
+function sleep(ms) {
+  return new Promise((resolve) => setTimeout(resolve, ms));
+}
+
+// latestImage picks the best file across dirs: screenshot-named files
+// first, then the newest, whichever directory it is in.
+async function latestImage(dirs, opts) {
+  const candidates = [];
+  for (const { dir, label } of dirs) {
+    let found = await listImages(dir, label, opts).catch((err) => err);
+    if (found instanceof Error) {
+      if (found.code === ERR_NOT_FOUND) continue;
+      throw found;
+    }
+    found = await withoutStaged(found, opts);
+    if (opts.learnNames) {
+      await tagLearnedNames(found, opts);
+    }
+    const cloud = cloudProvider(dir);
+    if (cloud) {
+      log(opts, `${label} is synced by ${cloud}`);
+    }
+    for (const candidate of found) {
+      candidate.timeMs = captureTime(candidate, opts.sort);
+      candidate.cloud = cloud;
+    }
+    candidates.push(...found);
+  }
+  candidates.sort((a, b) => {
+    if (a.tagged !== b.tagged) return a.tagged ? -1 : 1;
+    return b.timeMs - a.timeMs;
+  });
+
+  for (const candidate of candidates) {
+    const action = evaluateRules(opts.rules, ruleFacts(candidate, Date.now()));
+    if (action === 'skip') {
+      log(opts, `rule skipped candidate: ${candidate.path}`);
+      continue;
+    }
+    if (action === 'reject') {
+      log(opts, `rule rejected candidate: ${candidate.path}`);
+      break;
+    }
+    if (!(await usableCandidate(candidate, opts))) {
+      continue;
+    }
+    if (opts.groupBurst) {
+      candidate.burst = await burstMembers(candidate, candidates, opts);
+    }
+    return candidate;
+  }
+  throw notFoundError();
+}
+
+// usableCandidate skips files that can't be staged as one image: multi-page
+// PDFs, and online-only placeholders that can't be downloaded in time.
+async function usableCandidate(candidate, opts) {
+  if (path.extname(candidate.path).toLowerCase() === '.pdf' && (await pdfPageCount(fsPathOf(candidate))) > 1) {
+    log(opts, `skipping multi-page PDF: ${candidate.path}`);
+    return false;
+  }
+  if (candidate.placeholder) {
+    const download = opts.cloudWaitMs && !offlineBlocks(opts, `downloading ${candidate.path}`);
+    if (!download || !(await hydrate(candidate, opts.cloudWaitMs))) {
+      log(opts, `skipping online-only file: ${candidate.path}`);
+      return false;
+    }
+    log(opts, `hydrated online-only file: ${candidate.path}`);
+  }
+  return true;
+}
+
+// burstMembers walks back from the selected file and collects earlier files
+// taken within burstWindowMs of each other, oldest first. Members pass the
+// same checks as the selected file.
+async function burstMembers(selected, candidates, opts) {
+  const older = candidates
+    .filter((item) => item !== selected && item.tagged === selected.tagged && item.timeMs <= selected.timeMs)
+    .sort((a, b) => b.timeMs - a.timeMs);
+  const members = [];
+  let previous = selected.timeMs;
+  for (const item of older) {
+    if (previous - item.timeMs > opts.burstWindowMs) break;
+    const action = evaluateRules(opts.rules, ruleFacts(item, Date.now()));
+    if (action === 'skip' || action === 'reject') continue;
+    if (!(await usableCandidate(item, opts))) continue;
+    members.push(item);
+    previous = item.timeMs;
+  }
+  return members.reverse();
+}
+
+// captureTime is the timestamp used for ordering. Birth time survives renames
+// and tag edits that bump mtime, but not every filesystem records it.
+function captureTime(candidate, sort) {
+  if (sort === 'btime' && candidate.birthTimeMs > 0) {
+    return candidate.birthTimeMs;
+  }
+  return candidate.modTimeMs;
+}
+
+function filterClipboardCandidate(candidate, opts) {
+  const action = evaluateRules(opts.rules, ruleFacts({ source: 'clipboard', size: candidate.data.length }, Date.now()));
+  if (action === 'skip' || action === 'reject') {
+    log(opts, `rule ${action === 'skip' ? 'skipped' : 'rejected'} clipboard candidate`);
+    throw notFoundError();
+  }
+  return candidate;
+}
+
+function stateDir() {
+  if (process.platform === 'darwin') {
+    return path.join(os.homedir(), 'Library', 'Application Support', 'screenshot-agent');
+  }
+  const base = process.env.XDG_STATE_HOME || path.join(os.homedir(), '.local', 'state');
+  return path.join(base, 'screenshot-agent');
+}
+
+function historyPath() {
+  return path.join(stateDir(), 'history.jsonl');
+}
+
+async function appendHistory(result, data) {
+  const sha256 = crypto.createHash('sha256').update(data).digest('hex');
+  const entry = { time: rfc3339(result.time), ...resultJson(result), sha256 };
+  delete entry.schemaVersion;
+  delete entry.backlog;
+  await fsp.mkdir(stateDir(), { recursive: true, mode: 0o700 });
+  await fsp.appendFile(historyPath(), JSON.stringify(entry) + '\n', { mode: 0o600 });
+}
+
+async function readHistory() {
+  let data;
+  try {
+    data = await fsp.readFile(historyPath(), 'utf8');
+  } catch (err) {
+    if (err && err.code === 'ENOENT') return [];
+    throw err;
+  }
+  const entries = [];
+  for (const line of splitLines(data)) {
+    try {
+      entries.push(JSON.parse(line));
+    } catch (err) {
+      // skip torn lines
+    }
+  }
+  const backfilled = await readOcrIndex();
+  for (const entry of entries) {
+    const record = entry.ocrText === undefined ? backfilled.get(ocrKey(entry)) : null;
+    if (record && record.ocrText !== undefined) entry.ocrText = record.ocrText;
+  }
+  return entries;
+}
+
+function cacheDir() {
+  if (process.platform === 'darwin') {
+    return path.join(os.homedir(), 'Library', 'Caches', 'screenshot-agent');
+  }
+  const base = process.env.XDG_CACHE_HOME || path.join(os.homedir(), '.cache');
+  return path.join(base, 'screenshot-agent');
+}
+
+function cachePath() {
+  return path.join(cacheDir(), 'last-result.json');
+}
+
+async function selectionKey(selection) {
+  const data =
+    selection.type === 'clipboard' ? selection.candidate.data : await fsp.readFile(fsPathOf(selection.candidate));
+  return `sha256:${crypto.createHash('sha256').update(data).digest('hex')}`;
+}
+
+// lookupCache returns the previous result while it is fresh and either shows
+// the same bytes, or came from a file that has since been consumed and the
+// current candidate is older than it.
+async function lookupCache(selection, key, opts) {
+  let entry;
+  try {
+    entry = JSON.parse(await fsp.readFile(cachePath(), 'utf8'));
+  } catch (err) {
+    return null;
+  }
+  if (!entry || !entry.result || Date.now() - entry.storedAtMs > opts.cacheMs) return null;
+  if (!(await fileHasContent(entry.result.tempPath))) return null;
+  const olderFile =
+    entry.type === 'file' && selection.type === 'file' && selection.candidate.modTimeMs <= entry.modTimeMs;
+  if (key !== entry.key && !olderFile) return null;
+  log(opts, `cache hit: ${entry.result.tempPath}`);
+  return resultFromJson(entry.result);
+}
+
+async function storeCache(selection, key, result) {
+  const entry = {
+    key,
+    type: selection.type,
+    modTimeMs: selection.candidate.modTimeMs || 0,
+    storedAtMs: Date.now(),
+    result: resultJson(result),
+  };
+  await fsp.mkdir(cacheDir(), { recursive: true, mode: 0o700 });
+  await fsp.writeFile(cachePath(), JSON.stringify(entry) + '\n', { mode: 0o600 });
+}
+
+function groupMemberJson(item) {
+  return {
+    originalPath: item.source,
+    tempPath: item.tempPath,
+    ...(item.bytes !== undefined ? { bytes: item.bytes } : {}),
+    ...(item.image ? { image: item.image } : {}),
+  };
+}
+
+function resultFromJson(json) {
+  return {
+    kind: json.source,
+    source: json.originalPath || json.source,
+    tempPath: json.tempPath,
+    ...(json.mtime ? { modTimeMs: Date.parse(json.mtime) } : {}),
+    ...(json.bytes !== undefined ? { bytes: json.bytes } : {}),
+    ...(json.ocrText !== undefined ? { ocrText: json.ocrText } : {}),
+    ...(json.ocrLines ? { ocrLines: json.ocrLines } : {}),
+    ...(json.links ? { links: json.links } : {}),
+    ...(json.url ? { url: json.url } : {}),
+    ...(json.deliveries ? { deliveries: json.deliveries } : {}),
+    ...(json.tag ? { tag: json.tag } : {}),
+    ...(json.quality ? { quality: json.quality } : {}),
+    context: json.context || {},
+  };
+}
+
+function configFilePath(explicit) {
+  if (explicit) return explicit;
+  const base = process.env.XDG_CONFIG_HOME || path.join(os.homedir(), '.config');
+  return path.join(base, 'screenshot-agent', 'config.toml');
+}
+
+function loadConfig(explicit) {
+  const configPath = configFilePath(explicit);
+  let data;
+  try {
+    data = fs.readFileSync(configPath, 'utf8');
+  } catch (err) {
+    if (!explicit && err && err.code === 'ENOENT') return {};
+    throw new Error(`config: ${err.message || String(err)}`);
+  }
+  try {
+    return parseToml(data);
+  } catch (err) {
+    throw new Error(`config ${configPath}: ${err.message}`);
+  }
+}
+
+// runInit walks through the settings most setups change, offering what it
+// detects as the defaults, and writes them as a starter config. Prompts go
+// to stderr and answers are read line by line from stdin, so it can also be
+// scripted; at end of input the remaining defaults are taken. With
+// --dry-run the config is printed instead of written.
+async function runInit(opts) {
+  const configPath = configFilePath(opts.configPath);
+  const lines = readline.createInterface({ input: process.stdin, terminal: false })[Symbol.asyncIterator]();
+  const ask = async (question, fallback) => {
+    process.stderr.write(`${question} [${fallback}]: `);
+    const { value, done } = await lines.next();
+    if (done) process.stderr.write('\n');
+    const answer = done ? '' : value.trim();
+    return answer || fallback;
+  };
+  const askChoice = async (question, choices, fallback) => {
+    for (;;) {
+      const answer = (await ask(`${question} (${choices.join('/')})`, fallback)).toLowerCase();
+      if (choices.includes(answer)) return answer;
+      process.stderr.write(`  please answer one of: ${choices.join(', ')}\n`);
+    }
+  };
+  const askYes = async (question, fallback) => (await askChoice(question, ['y', 'n'], fallback ? 'y' : 'n')) === 'y';
+
+  const report = capabilities();
+  process.stderr.write(`platform: ${report.platform}/${report.arch}\n`);
+  for (const { label, dir } of await knownSources()) {
+    process.stderr.write(`${label}: ${dir}\n`);
+  }
+  const backends = report.capabilities.clipboard.backends;
+  const available = backends.filter((backend) => backend.available).map((backend) => backend.name);
+  const supported = backends.filter((backend) => backend.supported).map((backend) => backend.name);
+  process.stderr.write(`clipboard backends available: ${available.join(', ') || 'none'}\n\n`);
+
+  if (!opts.dryRun && fs.existsSync(configPath) && !(await askYes(`${configPath} exists; overwrite?`, false))) {
+    process.stderr.write('left the existing config unchanged\n');
+    return 1;
+  }
+  let clipboard = [];
+  for (;;) {
+    const answer = await ask('clipboard backends, in order', (available.length ? available : supported).join(','));
+    clipboard = answer.split(',').map((name) => name.trim()).filter(Boolean);
+    const unknown = clipboard.filter((name) => !CLIPBOARD_BACKENDS.some((backend) => backend.name === name));
+    if (unknown.length === 0) break;
+    const known = CLIPBOARD_BACKENDS.map((backend) => backend.name).join(', ');
+    process.stderr.write(`  unknown backend: ${unknown.join(', ')} (${known})\n`);
+  }
+  const consume = await askChoice(
+    'after staging a file: consume it, require consuming, or keep it',
+    CONSUME_POLICIES,
+    'auto',
+  );
+  const sort = await askChoice('order candidates by modification or creation time', ['mtime', 'btime'], 'mtime');
+  const readOnly = await askYes('read-only (never trash, move, or overwrite anything)?', false);
+  const history = await askYes('record results in the history log?', false);
+
+  const toml = [
+    `# Written by screenshot-agent init on ${rfc3339(new Date()).slice(0, 10)}.`,
+    '# See the README for every key; flags override these.',
+    `clipboard_backend = [${clipboard.map((name) => JSON.stringify(name)).join(', ')}]`,
+    `consume = ${JSON.stringify(consume)}`,
+    `sort = ${JSON.stringify(sort)}`,
+    `read_only = ${readOnly}`,
+    `history = ${history}`,
+    '',
+  ].join('\n');
+  if (opts.dryRun) {
+    process.stdout.write(toml);
+    return 0;
+  }
+  await fsp.mkdir(path.dirname(configPath), { recursive: true });
+  await fsp.writeFile(configPath, toml);
+  process.stderr.write(`wrote ${configPath}\n`);
+  return 0;
+}
+
+// CONFIG_KEYS are the keys applyConfig understands; anything else is
+// reported, since a misspelled key would otherwise be silently ignored.
+const CONFIG_KEYS = new Set([
+  'all_sources',
+  'assert',
+  'audit',
+  'bilevel',
+  'ca_cert',
+  'chmod',
+  'chown',
+  'classify',
+  'clipboard_backend',
+  'clipboard_only',
+  'cloud_wait',
+  'consume',
+  'copy_links',
+  'copy_url',
+  'deliver',
+  'dir_mode',
+  'dirs',
+  'dirs_only',
+  'document',
+  'downloads',
+  'ext_from_content',
+  'extensions',
+  'fast_decode',
+  'format',
+  'history',
+  'jobs',
+  'json',
+  'latency_budget',
+  'learn_names',
+  'new_only',
+  'offline',
+  'links',
+  'marker',
+  'max_clipboard_bytes',
+  'min_quality',
+  'ocr',
+  'ocr_engine',
+  'ocr_lang',
+  'output_version',
+  'prefer',
+  'quality',
+  'rasterize',
+  'rasterize_dpi',
+  'read_only',
+  'recency',
+  'rules',
+  'screenshot_patterns',
+  'sidecar',
+  'sort',
+  'stale_clipboard',
+  'stale_clipboard_after',
+  'stash',
+  'stash_ttl',
+  'targets',
+  'trim_terminal',
+  'upload',
+  'url_format',
+  'wait',
+]);
+
+// withProfile layers a [profiles.NAME] table over the top-level keys. The
+// name comes from --profile, else the config's own profile key; with
+// neither, the profiles are ignored.
+function withProfile(config, name) {
+  const { profiles = {}, profile = '', ...base } = config;
+  const selected = name || profile;
+  if (!selected) return base;
+  if (typeof profiles !== 'object' || Array.isArray(profiles) || !profiles[selected]) {
+    const known = typeof profiles === 'object' ? Object.keys(profiles) : [];
+    throw new Error(`config: no profile ${selected} (known: ${known.join(', ') || 'none'})`);
+  }
+  const table = profiles[selected];
+  if (typeof table !== 'object' || Array.isArray(table)) {
+    throw new Error(`config: profiles.${selected} must be a table`);
+  }
+  return { ...base, ...table };
+}
+
+function applyConfig(opts, config) {
+  for (const key of Object.keys(config)) {
+    if (!CONFIG_KEYS.has(key)) process.stderr.write(`warning: config: unknown key ${key}\n`);
+  }
+  if (config.read_only === true) {
+    opts.readOnly = true;
+  }
+  if (config.downloads === true) {
+    opts.useDownloads = true;
+  }
+  if (config.all_sources === true) {
+    opts.allSources = true;
+  }
+  if (config.learn_names === true) {
+    opts.learnNames = true;
+  }
+  if (config.new_only === true) {
+    opts.newOnly = true;
+  }
+  if (config.offline === true) {
+    opts.offline = true;
+  }
+  if (config.extensions !== undefined && !opts.extensionsSet) {
+    const list = Array.isArray(config.extensions) ? config.extensions.map(String) : splitList(config.extensions);
+    opts.extensions = parseExtensions(list);
+    if (!opts.extensions) throw new Error(`config: invalid extensions: ${list.join(',')}`);
+  }
+  if (config.clipboard_only === true) {
+    opts.clipboardOnly = true;
+  }
+  if (config.json === true) {
+    opts.json = true;
+  }
+  if (config.ocr === true) {
+    opts.ocr = true;
+  }
+  if (config.links === true || config.copy_links === true) {
+    opts.ocr = true;
+    opts.links = true;
+    opts.copyLinks = opts.copyLinks || config.copy_links === true;
+  }
+  if (config.upload !== undefined && !opts.upload) {
+    if (typeof config.upload !== 'string' || !config.upload) {
+      throw new Error(`config: invalid upload: ${config.upload}`);
+    }
+    opts.upload = config.upload;
+  }
+  if (config.url_format !== undefined && !opts.urlFormat) {
+    if (typeof config.url_format !== 'string') throw new Error(`config: invalid url_format: ${config.url_format}`);
+    opts.urlFormat = config.url_format;
+  }
+  if (config.copy_url === true) {
+    opts.copyUrl = true;
+  }
+  if (config.ca_cert !== undefined && !opts.caCert) {
+    if (typeof config.ca_cert !== 'string' || !config.ca_cert) {
+      throw new Error(`config: invalid ca_cert: ${config.ca_cert}`);
+    }
+    opts.caCert = expandHome(config.ca_cert);
+  }
+  if (config.targets !== undefined) {
+    if (typeof config.targets !== 'object' || Array.isArray(config.targets)) {
+      throw new Error('config: targets must be tables ([targets.NAME])');
+    }
+    for (const [name, spec] of Object.entries(config.targets)) {
+      opts.targets[name] = checkTarget(name, spec);
+    }
+  }
+  if (config.deliver !== undefined && !opts.deliverSet) {
+    opts.deliver = (Array.isArray(config.deliver) ? config.deliver : splitList(String(config.deliver))).map(String);
+  }
+  for (const name of opts.deliver) {
+    if (!opts.targets[name]) {
+      throw new Error(`unknown delivery target: ${name} (define [targets.${name}] in the config)`);
+    }
+  }
+  if (config.ocr_engine !== undefined && !opts.ocrEngine) {
+    opts.ocrEngine = checkOcrEngine(String(config.ocr_engine), 'config: ocr_engine');
+  }
+  if (config.ocr_lang !== undefined && opts.ocrLangs.length === 0) {
+    const value = Array.isArray(config.ocr_lang) ? config.ocr_lang.join('+') : String(config.ocr_lang);
+    opts.ocrLangs = parseOcrLangs(value, 'config: ocr_lang');
+  }
+  if (config.sidecar === true) {
+    opts.sidecar = true;
+  }
+  if (config.wait !== undefined && !opts.waitMs) {
+    opts.waitMs = parseDuration(String(config.wait));
+    if (!opts.waitMs) throw new Error(`config: invalid wait: ${config.wait}`);
+  }
+  if (config.sort !== undefined && !opts.sortSet) {
+    opts.sort = sortOrder(String(config.sort));
+  }
+  if (config.max_clipboard_bytes !== undefined && !opts.maxClipboardBytes) {
+    opts.maxClipboardBytes = parseSize(String(config.max_clipboard_bytes));
+    if (!opts.maxClipboardBytes) throw new Error(`config: invalid max_clipboard_bytes: ${config.max_clipboard_bytes}`);
+  }
+  if (config.ext_from_content === true) {
+    opts.extFromContent = true;
+  }
+  if (config.cloud_wait !== undefined && !opts.cloudWaitMs) {
+    opts.cloudWaitMs = parseDuration(String(config.cloud_wait));
+    if (opts.cloudWaitMs === null) throw new Error(`config: invalid cloud_wait: ${config.cloud_wait}`);
+  }
+  if (config.trim_terminal === true) {
+    opts.trimTerminal = true;
+  }
+  if (config.document === true) {
+    opts.document = true;
+  }
+  if (config.bilevel === true) {
+    opts.document = true;
+    opts.bilevel = true;
+  }
+  if (config.classify === true) {
+    opts.classify = true;
+  }
+  if (config.quality === true) {
+    opts.quality = true;
+  }
+  if (config.fast_decode === true) {
+    opts.fastDecode = true;
+  }
+  if (config.min_quality !== undefined && !opts.minQualitySet) {
+    if (typeof config.min_quality !== 'number') throw new Error(`config: invalid min_quality: ${config.min_quality}`);
+    opts.assertions.push(...parseAssertions(`quality>=${config.min_quality}`));
+  }
+  if (config.rasterize === true) {
+    opts.rasterize = true;
+  }
+  if (config.rasterize_dpi !== undefined && !opts.rasterizeDpiSet) {
+    opts.rasterizeDpi = Number(config.rasterize_dpi);
+    if (!Number.isFinite(opts.rasterizeDpi) || opts.rasterizeDpi <= 0) {
+      throw new Error(`config: invalid rasterize_dpi: ${config.rasterize_dpi}`);
+    }
+  }
+  if (config.jobs !== undefined && opts.jobs === null) {
+    if (!Number.isInteger(config.jobs) || config.jobs < 1) throw new Error(`config: invalid jobs: ${config.jobs}`);
+    opts.jobs = config.jobs;
+  }
+  if (config.chmod !== undefined && opts.fileMode === null) {
+    opts.fileMode = parseMode(config.chmod);
+    if (opts.fileMode === null) throw new Error(`config: invalid chmod: ${config.chmod}`);
+  }
+  if (config.dir_mode !== undefined && opts.dirMode === null) {
+    opts.dirMode = parseMode(config.dir_mode);
+    if (opts.dirMode === null) throw new Error(`config: invalid dir_mode: ${config.dir_mode}`);
+  }
+  if (config.chown !== undefined && !opts.chown) {
+    opts.chown = String(config.chown);
+  }
+  if (config.consume !== undefined && !opts.consumeSet) {
+    if (!CONSUME_POLICIES.includes(config.consume)) throw new Error(`config: invalid consume: ${config.consume}`);
+    opts.consume = config.consume;
+  }
+  if (config.prefer !== undefined && !opts.preferSet) {
+    if (!PREFER_POLICIES.includes(config.prefer)) throw new Error(`config: invalid prefer: ${config.prefer}`);
+    opts.prefer = config.prefer;
+  }
+  if (config.stale_clipboard !== undefined) {
+    if (config.stale_clipboard !== 'warn' && config.stale_clipboard !== 'refuse') {
+      throw new Error(`config: invalid stale_clipboard: ${config.stale_clipboard} (warn, refuse)`);
+    }
+    opts.staleClipboard = config.stale_clipboard;
+  }
+  if (config.stale_clipboard_after !== undefined) {
+    opts.staleClipboardMs = parseDuration(String(config.stale_clipboard_after));
+    if (!opts.staleClipboardMs) {
+      throw new Error(`config: invalid stale_clipboard_after: ${config.stale_clipboard_after}`);
+    }
+  }
+  if (config.recency !== undefined && !opts.recencySet) {
+    opts.recencyMs = parseDuration(String(config.recency));
+    if (opts.recencyMs === null) throw new Error(`config: invalid recency: ${config.recency}`);
+  }
+  if (config.latency_budget !== undefined && !opts.latencyBudgetMs) {
+    opts.latencyBudgetMs = parseDuration(String(config.latency_budget));
+    if (!opts.latencyBudgetMs) throw new Error(`config: invalid latency_budget: ${config.latency_budget}`);
+  }
+  if (config.history === true) {
+    opts.history = true;
+  }
+  if (config.dirs !== undefined && opts.dirs.length === 0) {
+    if (!Array.isArray(config.dirs)) throw new Error('config: dirs must be an array of paths');
+    opts.dirs = config.dirs.map(String);
+  }
+  if (config.dirs_only === true) {
+    opts.dirsOnly = true;
+  }
+  if (config.screenshot_patterns !== undefined && opts.screenshotPatterns.length === 0) {
+    if (!Array.isArray(config.screenshot_patterns)) {
+      throw new Error('config: screenshot_patterns must be an array of regular expressions');
+    }
+    opts.screenshotPatterns = config.screenshot_patterns.map((value) =>
+      parseNamePattern(String(value), 'config: screenshot_patterns'),
+    );
+  }
+  if (config.stash === true) {
+    opts.stash = true;
+  }
+  if (config.marker === false) {
+    opts.marker = false;
+  }
+  if (config.stash_ttl !== undefined && !opts.stashTtlSet) {
+    opts.stashTtlMs = parseDuration(String(config.stash_ttl));
+    if (!opts.stashTtlMs) throw new Error(`config: invalid stash_ttl: ${config.stash_ttl}`);
+  }
+  if (config.assert !== undefined && !opts.assertSet) {
+    try {
+      opts.assertions.push(...parseAssertions(String(config.assert)));
+    } catch (err) {
+      throw new Error(`config: ${err.message.replace('--assert', 'assert')}`);
+    }
+  }
+  if (config.audit !== undefined && !opts.audit) {
+    if (typeof config.audit !== 'string' || !config.audit) throw new Error(`config: invalid audit: ${config.audit}`);
+    opts.audit = expandHome(config.audit);
+  }
+  if (config.format !== undefined && !opts.format) {
+    try {
+      compileFormat(String(config.format));
+    } catch (err) {
+      throw new Error(`config: invalid format: ${err.message}`);
+    }
+    opts.format = String(config.format);
+  }
+  if (config.output_version !== undefined && !opts.outputVersion) {
+    opts.outputVersion = outputVersion(config.output_version);
+  }
+  if (config.clipboard_backend !== undefined && opts.clipboardBackends.length === 0) {
+    const names = Array.isArray(config.clipboard_backend) ? config.clipboard_backend : splitList(config.clipboard_backend);
+    opts.clipboardBackends = names.map(String);
+    clipboardBackendChain(opts.clipboardBackends);
+  }
+  if (config.rules !== undefined) {
+    if (!Array.isArray(config.rules)) {
+      throw new Error('config: rules must be an array of strings');
+    }
+    opts.rules = config.rules.map((text, index) => {
+      try {
+        return parseRule(String(text));
+      } catch (err) {
+        throw new Error(`config: rule ${index + 1}: ${err.message}`);
+      }
+    });
+  }
+}
+
+// parseToml understands the subset of TOML the config uses: tables, strings,
+// numbers, booleans, and (possibly multi-line) arrays of those.
+function parseToml(text) {
+  const root = {};
+  let table = root;
+  let pos = 0;
+  let line = 1;
+
+  const fail = (message) => {
+    throw new Error(`line ${line}: ${message}`);
+  };
+  const skipSpace = (newlines) => {
+    while (pos < text.length) {
+      const ch = text[pos];
+      if (ch === ' ' || ch === '\t' || ch === '\r') {
+        pos += 1;
+      } else if (ch === '#') {
+        while (pos < text.length && text[pos] !== '\n') pos += 1;
+      } else if (ch === '\n' && newlines) {
+        pos += 1;
+        line += 1;
+      } else {
+        break;
+      }
+    }
+  };
+  const readKey = () => {
+    skipSpace(false);
+    if (text[pos] === '"' || text[pos] === "'") return readString();
+    const match = /^[A-Za-z0-9_-]+/.exec(text.slice(pos));
+    if (!match) fail('expected key');
+    pos += match[0].length;
+    return match[0];
+  };
+  const readString = () => {
+    const quote = text[pos];
+    pos += 1;
+    let out = '';
+    while (pos < text.length && text[pos] !== quote) {
+      const ch = text[pos];
+      if (ch === '\n') fail('unterminated string');
+      if (ch === '\\' && quote === '"') {
+        const esc = text[pos + 1];
+        const map = { n: '\n', t: '\t', r: '\r', '"': '"', '\\': '\\' };
+        if (!(esc in map)) fail(`bad escape \\${esc}`);
+        out += map[esc];
+        pos += 2;
+        continue;
+      }
+      out += ch;
+      pos += 1;
+    }
+    if (text[pos] !== quote) fail('unterminated string');
+    pos += 1;
+    return out;
+  };
+  const readValue = () => {
+    skipSpace(false);
+    const ch = text[pos];
+    if (ch === '"' || ch === "'") return readString();
+    if (ch === '[') {
+      pos += 1;
+      const items = [];
+      for (;;) {
+        skipSpace(true);
+        if (text[pos] === ']') {
+          pos += 1;
+          return items;
+        }
+        items.push(readValue());
+        skipSpace(true);
+        if (text[pos] === ',') {
+          pos += 1;
+        } else if (text[pos] !== ']') {
+          fail('expected , or ] in array');
+        }
+      }
+    }
+    const match = /^[^\s,\]#]+/.exec(text.slice(pos));
+    if (!match) fail('expected value');
+    pos += match[0].length;
+    const raw = match[0];
+    if (raw === 'true') return true;
+    if (raw === 'false') return false;
+    if (/^[+-]?\d[\d_]*(\.\d+)?$/.test(raw)) return Number(raw.replace(/_/g, ''));
+    fail(`unsupported value: ${raw}`);
+    return undefined;
+  };
+
+  while (pos < text.length) {
+    skipSpace(true);
+    if (pos >= text.length) break;
+    if (text[pos] === '[') {
+      pos += 1;
+      table = root;
+      for (;;) {
+        const key = readKey();
+        if (table[key] === undefined) table[key] = {};
+        if (typeof table[key] !== 'object' || Array.isArray(table[key])) fail(`${key} is not a table`);
+        table = table[key];
+        skipSpace(false);
+        if (text[pos] === '.') {
+          pos += 1;
+          continue;
+        }
+        if (text[pos] !== ']') fail('expected ]');
+        pos += 1;
+        break;
+      }
+    } else {
+      const key = readKey();
+      skipSpace(false);
+      if (text[pos] !== '=') fail(`expected = after ${key}`);
+      pos += 1;
+      table[key] = readValue();
+    }
+    skipSpace(false);
+    if (pos < text.length && text[pos] !== '\n') fail('unexpected trailing characters');
+  }
+  return root;
+}
+
+// ASSERT_FIELDS maps each --assert field to how it reads from a result and
+// parses a comparison value; numeric fields allow every operator.
+const ASSERT_FIELDS = {
+  width: { numeric: true, get: (result) => result.image && result.image.width },
+  height: { numeric: true, get: (result) => result.image && result.image.height },
+  dpi: { numeric: true, get: (result) => result.image && result.image.dpi },
+  bytes: { numeric: true, parse: parseSize, get: (result) => result.bytes },
+  format: {
+    parse: (text) => (text.toLowerCase() === 'jpg' ? 'jpeg' : text.toLowerCase()),
+    get: (result) => result.format,
+  },
+  source: { get: (result) => resultJson(result).source },
+  tag: { get: (result) => result.tag },
+  quality: { numeric: true, get: (result) => result.quality && result.quality.score },
+};
+const ASSERT_OPS = ['>=', '<=', '==', '!=', '>', '<'];
+
+function parseAssertions(text) {
+  return text
+    .split(',')
+    .map((part) => part.trim())
+    .filter(Boolean)
+    .map((part) => {
+      const op = ASSERT_OPS.find((candidate) => part.includes(candidate));
+      if (!op) throw new Error(`invalid --assert: ${part} (want FIELD OP VALUE)`);
+      const [field, raw] = part.split(op).map((side) => side.trim());
+      const spec = ASSERT_FIELDS[field.toLowerCase()];
+      if (!spec) {
+        throw new Error(`invalid --assert: unknown field ${field} (${Object.keys(ASSERT_FIELDS).join(', ')})`);
+      }
+      if (!spec.numeric && op !== '==' && op !== '!=') {
+        throw new Error(`invalid --assert: ${field} only supports == and !=`);
+      }
+      const value = spec.parse ? spec.parse(raw) : spec.numeric ? Number(raw) : raw;
+      if (value === null || (spec.numeric && !Number.isFinite(value))) {
+        throw new Error(`invalid --assert: bad value in ${part}`);
+      }
+      return { text: part, field: field.toLowerCase(), op, value };
+    });
+}
+
+// failedAssertions describes each --assert the result does not satisfy; a
+// field the result lacks (e.g. dpi on most screenshots) fails.
+async function failedAssertions(assertions, result) {
+  if (assertions.length === 0) return [];
+  result.format = sniffImageType(await readHead(result.tempPath, 16)) || path.extname(result.tempPath).slice(1);
+  const failures = [];
+  for (const assertion of assertions) {
+    const actual = ASSERT_FIELDS[assertion.field].get(result);
+    const known = actual !== undefined && actual !== null;
+    if (!known || !compareAssert(actual, assertion.op, assertion.value)) {
+      failures.push(`${assertion.text} (${assertion.field} is ${known ? actual : 'unknown'})`);
+    }
+  }
+  return failures;
+}
+
+function compareAssert(actual, op, expected) {
+  switch (op) {
+    case '>=':
+      return actual >= expected;
+    case '<=':
+      return actual <= expected;
+    case '>':
+      return actual > expected;
+    case '<':
+      return actual < expected;
+    case '==':
+      return actual === expected;
+    default:
+      return actual !== expected;
+  }
+}
+
+// Rules look like: if dir == Downloads and name matches 'Invoice*' then skip
+// Fields: source, dir, name, ext, age, size, tagged. Actions: accept, skip
+// (ignore this candidate and keep looking), reject (stop looking in this source).
+const RULE_FIELDS = new Set(['source', 'dir', 'name', 'ext', 'age', 'size', 'tagged']);
+const RULE_ACTIONS = new Set(['accept', 'skip', 'reject']);
+const RULE_OPS = new Set(['==', '!=', '<', '<=', '>', '>=', 'matches', 'contains']);
+
+function parseRule(text) {
+  const tokens = tokenizeRule(text);
+  let pos = 0;
+  const peek = () => tokens[pos];
+  const next = () => tokens[pos++];
+  const expectWord = (word) => {
+    const tok = next();
+    if (!tok || tok.quoted || tok.text.toLowerCase() !== word) {
+      throw new Error(`expected "${word}"`);
+    }
+  };
+  const isWord = (tok, word) => tok && !tok.quoted && tok.text.toLowerCase() === word;
+
+  const parseOr = () => {
+    let left = parseAnd();
+    while (isWord(peek(), 'or')) {
+      next();
+      left = { type: 'or', left, right: parseAnd() };
+    }
+    return left;
+  };
+  const parseAnd = () => {
+    let left = parseNot();
+    while (isWord(peek(), 'and')) {
+      next();
+      left = { type: 'and', left, right: parseNot() };
+    }
+    return left;
+  };
+  const parseNot = () => {
+    if (isWord(peek(), 'not')) {
+      next();
+      return { type: 'not', expr: parseNot() };
+    }
+    if (peek() && !peek().quoted && peek().text === '(') {
+      next();
+      const expr = parseOr();
+      const close = next();
+      if (!close || close.quoted || close.text !== ')') throw new Error('expected )');
+      return expr;
+    }
+    const fieldTok = next();
+    if (!fieldTok || fieldTok.quoted || !RULE_FIELDS.has(fieldTok.text.toLowerCase())) {
+      throw new Error(`unknown field: ${fieldTok ? fieldTok.text : '(end)'}`);
+    }
+    const opTok = next();
+    if (!opTok || opTok.quoted || !RULE_OPS.has(opTok.text.toLowerCase())) {
+      throw new Error(`unknown operator: ${opTok ? opTok.text : '(end)'}`);
+    }
+    const valueTok = next();
+    if (!valueTok) throw new Error('missing value');
+    const field = fieldTok.text.toLowerCase();
+    const op = opTok.text.toLowerCase();
+    return { type: 'cmp', field, op, value: ruleValue(field, op, valueTok) };
+  };
+
+  expectWord('if');
+  const expr = parseOr();
+  expectWord('then');
+  const actionTok = next();
+  if (!actionTok || actionTok.quoted || !RULE_ACTIONS.has(actionTok.text.toLowerCase())) {
+    throw new Error(`unknown action: ${actionTok ? actionTok.text : '(end)'}`);
+  }
+  if (pos !== tokens.length) {
+    throw new Error(`unexpected "${tokens[pos].text}"`);
+  }
+  return { text, expr, action: actionTok.text.toLowerCase() };
+}
+
+function tokenizeRule(text) {
+  const tokens = [];
+  let i = 0;
+  while (i < text.length) {
+    const ch = text[i];
+    if (/\s/.test(ch)) {
+      i += 1;
+    } else if (ch === '"' || ch === "'") {
+      const end = text.indexOf(ch, i + 1);
+      if (end === -1) throw new Error('unterminated string');
+      tokens.push({ text: text.slice(i + 1, end), quoted: true });
+      i = end + 1;
+    } else if (ch === '(' || ch === ')') {
+      tokens.push({ text: ch, quoted: false });
+      i += 1;
+    } else if ('=!<>'.includes(ch)) {
+      const op = text[i + 1] === '=' ? text.slice(i, i + 2) : ch;
+      tokens.push({ text: op, quoted: false });
+      i += op.length;
+    } else {
+      let end = i;
+      while (end < text.length && !/[\s()=!<>"']/.test(text[end])) end += 1;
+      tokens.push({ text: text.slice(i, end), quoted: false });
+      i = end;
+    }
+  }
+  return tokens;
+}
+
+const RULE_NUMERIC_FIELDS = new Set(['age', 'size']);
+const RULE_ORDER_OPS = new Set(['<', '<=', '>', '>=']);
+
+function ruleValue(field, op, tok) {
+  if (RULE_ORDER_OPS.has(op) && !RULE_NUMERIC_FIELDS.has(field)) {
+    throw new Error(`operator ${op} not supported for ${field} (only for age and size)`);
+  }
+  if (op === 'matches') {
+    return globToRegExp(tok.text);
+  }
+  if (field === 'age') {
+    const ms = parseDuration(tok.text);
+    if (ms === null) throw new Error(`bad duration: ${tok.text}`);
+    return ms;
+  }
+  if (field === 'size') {
+    const bytes = parseSize(tok.text);
+    if (bytes === null) throw new Error(`bad size: ${tok.text}`);
+    return bytes;
+  }
+  if (field === 'tagged') {
+    const lower = tok.text.toLowerCase();
+    if (lower !== 'true' && lower !== 'false') throw new Error(`bad boolean: ${tok.text}`);
+    return lower === 'true';
+  }
+  return tok.text;
+}
+
+function ruleFacts(candidate, nowMs) {
+  const name = candidate.path ? path.basename(candidate.path) : '';
+  return {
+    source: candidate.source || 'file',
+    dir: candidate.dir || (candidate.source === 'clipboard' ? 'clipboard' : ''),
+    name,
+    ext: name ? path.extname(name).slice(1).toLowerCase() : candidate.ext || '',
+    age: candidate.timeMs || candidate.modTimeMs ? Math.max(0, nowMs - (candidate.timeMs || candidate.modTimeMs)) : undefined,
+    size: candidate.size,
+    tagged: Boolean(candidate.tagged),
+  };
+}
+
+function evaluateRules(rules, facts) {
+  for (const rule of rules || []) {
+    if (evaluateRuleExpr(rule.expr, facts)) {
+      return rule.action;
+    }
+  }
+  return '';
+}
+
+function evaluateRuleExpr(expr, facts) {
+  switch (expr.type) {
+    case 'or':
+      return evaluateRuleExpr(expr.left, facts) || evaluateRuleExpr(expr.right, facts);
+    case 'and':
+      return evaluateRuleExpr(expr.left, facts) && evaluateRuleExpr(expr.right, facts);
+    case 'not':
+      return !evaluateRuleExpr(expr.expr, facts);
+    default:
+      break;
+  }
+  const actual = facts[expr.field];
+  if (actual === undefined) return false;
+  const { op, value } = expr;
+  if (op === 'matches') return value.test(String(actual));
+  if (op === 'contains') return String(actual).toLowerCase().includes(String(value).toLowerCase());
+  if (typeof actual === 'number') {
+    switch (op) {
+      case '==':
+        return actual === value;
+      case '!=':
+        return actual !== value;
+      case '<':
+        return actual < value;
+      case '<=':
+        return actual <= value;
+      case '>':
+        return actual > value;
+      case '>=':
+        return actual >= value;
+      default:
+        return false;
+    }
+  }
+  const same = String(actual).toLowerCase() === String(value).toLowerCase();
+  if (op === '==') return same;
+  if (op === '!=') return !same;
+  throw new Error(`operator ${op} not supported for ${expr.field}`);
+}
+
+function globToRegExp(glob) {
+  let out = '';
+  for (let i = 0; i < glob.length; i += 1) {
+    const ch = glob[i];
+    if (ch === '*') {
+      out += '.*';
+    } else if (ch === '?') {
+      out += '.';
+    } else if (ch === '[') {
+      const end = glob.indexOf(']', i + 1);
+      if (end === -1) {
+        out += '\\[';
+      } else {
+        out += `[${glob.slice(i + 1, end).replace(/^!/, '^').replace(/\\/g, '\\\\')}]`;
+        i = end;
+      }
+    } else {
+      out += ch.replace(/[.+^${}()|\\]/g, '\\$&');
+    }
+  }
+  return new RegExp(`^${out}$`, 'i');
+}
+
+function parseDuration(text) {
+  const units = { ms: 1, s: 1000, m: 60 * 1000, h: 60 * 60 * 1000, d: 24 * 60 * 60 * 1000, w: 7 * 24 * 60 * 60 * 1000 };
+  const re = /(\d+(?:\.\d+)?)(ms|s|m|h|d|w)/g;
+  const trimmed = String(text).trim();
+  if (!trimmed) return null;
+  let total = 0;
+  let consumed = 0;
+  let match;
+  while ((match = re.exec(trimmed)) !== null) {
+    if (match.index !== consumed) return null;
+    total += Number(match[1]) * units[match[2]];
+    consumed = re.lastIndex;
+  }
+  if (consumed !== trimmed.length) return null;
+  return total;
+}
+
+// parseTime accepts an absolute date (RFC3339, YYYY-MM-DD, ...) or a
+// duration meaning that long ago.
+function parseTime(text) {
+  const ago = parseDuration(text);
+  if (ago !== null) return Date.now() - ago;
+  const ms = Date.parse(text);
+  return Number.isNaN(ms) ? null : ms;
+}
+
+function parseSize(text) {
+  const match = /^(\d+(?:\.\d+)?)\s*(b|k|kb|kib|m|mb|mib|g|gb|gib)?$/i.exec(String(text).trim());
+  if (!match) return null;
+  const unit = (match[2] || 'b').toLowerCase()[0];
+  const scale = { b: 1, k: 1024, m: 1024 * 1024, g: 1024 * 1024 * 1024 }[unit];
+  return Math.round(Number(match[1]) * scale);
+}
+
+function hasImageExt(name, opts) {
+  const ext = path.extname(name).toLowerCase();
+  if (ext === '.svg' || ext === '.pdf') return Boolean(opts.rasterize);
+  return (opts.extensions || IMAGE_EXTS).includes(ext.slice(1));
+}
+
+function isVectorExt(ext) {
+  return ext === '.svg' || ext === '.pdf';
+}
+
+// SCREENSHOT_NAMES are the words macOS, Windows and the Linux desktops
+// put in screenshot file names, in the languages they ship. Entries are
+// lowercase NFC; macOS stores names decomposed, so names are normalized
+// before matching.
+const SCREENSHOT_NAMES = [
+  'screenshot',
+  'screen shot',
+  'bildschirmfoto',
+  'bildschirmaufnahme',
+  "capture d'écran",
+  'capture d’écran',
+  'captura de pantalla',
+  'captura de tela',
+  'captura de ecrã',
+  'istantanea schermo',
+  'schermata',
+  'schermafbeelding',
+  'skärmavbild',
+  'skjermbilde',
+  'skærmbillede',
+  'näyttökuva',
+  'kuvakaappaus',
+  'zrzut ekranu',
+  'snímek obrazovky',
+  'snímka obrazovky',
+  'képernyőkép',
+  'képernyőfotó',
+  'captură de ecran',
+  'ekran görüntüsü',
+  'στιγμιότυπο οθόνης',
+  'снимок экрана',
+  'знімок екрана',
+  'צילום מסך',
+  'لقطة شاشة',
+  'ảnh màn hình',
+  'ภาพหน้าจอ',
+  'tangkapan layar',
+  'スクリーンショット',
+  '스크린샷',
+  '截屏',
+  '截图',
+  '屏幕截图',
+  '屏幕快照',
+  '螢幕截圖',
+  '螢幕快照',
+];
+
+// isScreenshotName matches the built-in words, then any
+// --screenshot-pattern (Flameshot, ShareX and capture scripts name files
+// their own way).
+function isScreenshotName(name, opts = {}) {
+  const normalized = name.normalize('NFC');
+  const lower = normalized.toLowerCase();
+  if (SCREENSHOT_NAMES.some((word) => lower.includes(word))) return true;
+  return (opts.screenshotPatterns || []).some((pattern) => pattern.test(normalized));
+}
+
+// parseNamePattern compiles a --screenshot-pattern; like the built-in
+// words it ignores case.
+function parseNamePattern(value, what) {
+  try {
+    return new RegExp(value, 'iu');
+  } catch (err) {
+    throw new Error(`${what}: invalid regular expression ${value}: ${err.message}`);
+  }
+}
 
-  const fileResult = await findFallbackImage(opts.useDownloads).catch((err) => err);
-  const now = Date.now();
+function formatBytes(bytes) {
+  const units = ['B', 'KB', 'MB', 'GB', 'TB'];
+  let value = bytes;
+  let unit = 0;
+  while (value >= 1024 && unit < units.length - 1) {
+    value /= 1024;
+    unit += 1;
+  }
+  return unit === 0 ? `${value} B` : `${value.toFixed(1)} ${units[unit]}`;
+}
 
-  if (clipboardResult && clipboardResult.data && fileResult && fileResult.path) {
-    if (preferFileCandidate(fileResult, now)) {
-      log(opts, `selected file candidate: ${fileResult.path}`);
-      return handleFileCandidate(fileResult, opts);
+function parsePercent(value) {
+  const text = String(value).trim();
+  const match = /^(\d+(?:\.\d+)?)(%?)$/.exec(text);
+  if (!match) return null;
+  const number = Number(match[1]);
+  const ratio = match[2] || number > 1 ? number / 100 : number;
+  return ratio <= 1 ? ratio : null;
+}
+
+// readImageAsPng returns PNG bytes for any image the platform can convert,
+// so the pure-JS codec below only has to understand PNG.
+async function readImageAsPng(file) {
+  const data = await fsp.readFile(file);
+  if (sniffImageType(data) === 'png') return data;
+  const out = await tempPath('convert-XXXXXX.png');
+  try {
+    if (process.platform === 'darwin' && commandExists('sips')) {
+      execFileSync('sips', ['-s', 'format', 'png', file, '--out', out], { stdio: 'ignore' });
+    } else if (commandExists('magick')) {
+      execFileSync('magick', [file, `png:${out}`], { stdio: 'ignore' });
+    } else if (commandExists('convert')) {
+      execFileSync('convert', [file, `png:${out}`], { stdio: 'ignore' });
+    } else {
+      throw new Error(`cannot decode ${file}: only PNG is built in (install ImageMagick to convert)`);
     }
-    log(opts, 'selected clipboard candidate');
-    return handleClipboardCandidate(clipboardResult);
+    return await fsp.readFile(out);
+  } finally {
+    await safeUnlink(out);
   }
+}
 
-  if (clipboardResult && clipboardResult.data) {
-    log(opts, 'selected clipboard candidate (file missing)');
-    return handleClipboardCandidate(clipboardResult);
+// applyOrientation bakes the EXIF orientation into the pixels of the staged
+// copy and drops the tag, since many consumers ignore it and show phone
+// shots sideways. PNG is handled natively, JPEG needs ImageMagick.
+async function applyOrientation(file, opts) {
+  const data = await fsp.readFile(file);
+  const orientation = exifOrientation(data);
+  if (orientation <= 1 || orientation > 8) return;
+  log(opts, `applying EXIF orientation ${orientation}`);
+  if (sniffImageType(data) === 'png') {
+    await fsp.writeFile(file, encodePng(orientImage(decodePng(data), orientation)));
+    return;
   }
-
-  if (fileResult && fileResult.path) {
-    log(opts, `selected file candidate (clipboard missing): ${fileResult.path}`);
-    return handleFileCandidate(fileResult, opts);
+  const tool = ['magick', 'convert'].find(commandExists);
+  if (!tool) {
+    process.stderr.write(`warning: cannot apply EXIF orientation ${orientation} without ImageMagick; leaving it tagged\n`);
+    return;
   }
+  execFileSync(tool, [file, '-auto-orient', file], { stdio: 'ignore' });
+}
 
-  if (fileResult && fileResult.code && fileResult.code !== ERR_NOT_FOUND) {
-    throw fileResult;
+const TRIM_MARGIN = 8;
+
+// trimTerminal crops a terminal screenshot to its text plus TRIM_MARGIN.
+// The background is the dominant color of the middle of the image; bands
+// along an edge where it covers under half the pixels (title bar, tab
+// strip, window shadow) within 15% of that edge are chrome, and rows or
+// columns that are all background after that are padding.
+async function trimTerminal(file, opts) {
+  let image;
+  try {
+    image = await decodeImage(file, opts);
+  } catch (err) {
+    process.stderr.write(`warning: cannot trim ${file}: ${err.message}\n`);
+    return;
   }
-  if (clipboardResult && clipboardResult.code && clipboardResult.code !== ERR_NOT_FOUND) {
-    throw clipboardResult;
+  const box = terminalBox(image);
+  if (!box) {
+    log(opts, '--trim-terminal: nothing to trim');
+    return;
   }
-  return null;
+  const { left, top, width, height } = box;
+  log(opts, `--trim-terminal: cropping to ${width}x${height}+${left}+${top}`);
+  const data = await fsp.readFile(file);
+  if (sniffImageType(data) === 'png') {
+    await fsp.writeFile(file, encodePng(cropImage(image, box)));
+    return;
+  }
+  const tool = ['magick', 'convert'].find(commandExists);
+  if (!tool) {
+    process.stderr.write(`warning: cannot trim ${file} without ImageMagick; leaving it as is\n`);
+    return;
+  }
+  execFileSync(tool, [file, '-crop', `${width}x${height}+${left}+${top}`, '+repage', file], { stdio: 'ignore' });
 }
 
-function log(opts, message) {
-  if (!opts.verbose) return;
-  process.stderr.write(message + '\n');
+function terminalBox(image) {
+  const middle = Math.floor(image.height / 4);
+  const background = samplePixels(image, middle, image.height - middle, 160).dominant;
+  const share = (x0, y0, x1, y1) => {
+    let matching = 0;
+    let total = 0;
+    for (let y = y0; y < y1; y += 1) {
+      for (let x = x0; x < x1; x += 1) {
+        const i = (y * image.width + x) * 4;
+        const rgb = [image.pixels[i], image.pixels[i + 1], image.pixels[i + 2]];
+        if (image.pixels[i + 3] === 255 && colorDistance(rgb, background) <= 24) matching += 1;
+        total += 1;
+      }
+    }
+    return total ? matching / total : 1;
+  };
+  let top = 0;
+  let bottom = image.height;
+  let left = 0;
+  let right = image.width;
+  const rowShare = (y) => share(left, y, right, y + 1);
+  const colShare = (x) => share(x, top, x + 1, bottom);
+  const inChrome = (matching, offset, size) => matching < 0.5 && offset < size * 0.15;
+  while (top < bottom - 1 && inChrome(rowShare(top), top, image.height)) top += 1;
+  while (bottom - 1 > top && inChrome(rowShare(bottom - 1), image.height - bottom, image.height)) bottom -= 1;
+  while (left < right - 1 && inChrome(colShare(left), left, image.width)) left += 1;
+  while (right - 1 > left && inChrome(colShare(right - 1), image.width - right, image.width)) right -= 1;
+  while (top < bottom - 1 && rowShare(top) === 1) top += 1;
+  while (bottom - 1 > top && rowShare(bottom - 1) === 1) bottom -= 1;
+  while (left < right - 1 && colShare(left) === 1) left += 1;
+  while (right - 1 > left && colShare(right - 1) === 1) right -= 1;
+  top = Math.max(0, top - TRIM_MARGIN);
+  left = Math.max(0, left - TRIM_MARGIN);
+  bottom = Math.min(image.height, bottom + TRIM_MARGIN);
+  right = Math.min(image.width, right + TRIM_MARGIN);
+  if (top === 0 && left === 0 && bottom === image.height && right === image.width) return null;
+  return { left, top, width: right - left, height: bottom - top };
 }
 
-function preferFileCandidate(candidate, nowMs) {
-  if (!candidate || !candidate.modTimeMs) return false;
-  if (candidate.modTimeMs > nowMs) return true;
-  return nowMs - candidate.modTimeMs <= 30 * 1000;
+function cropImage(image, box) {
+  const pixels = Buffer.alloc(box.width * box.height * 4);
+  for (let y = 0; y < box.height; y += 1) {
+    const start = ((box.top + y) * image.width + box.left) * 4;
+    image.pixels.copy(pixels, y * box.width * 4, start, start + box.width * 4);
+  }
+  return { width: box.width, height: box.height, pixels };
 }
 
-async function handleClipboardCandidate(candidate) {
-  const tempPath = await writeClipboardToTemp(candidate.data);
-  return { source: 'clipboard', tempPath };
+// applyDocument cleans up a photographed page in place: deskew, grayscale,
+// contrast stretch, and with --bilevel a black-and-white threshold.
+// ImageMagick does all of it in the file's own format; without it PNG gets
+// everything but the deskew natively.
+async function applyDocument(file, opts) {
+  const tool = ['magick', 'convert'].find(commandExists);
+  if (tool) {
+    const args = [file, '-deskew', '40%', '-colorspace', 'Gray', '-normalize'];
+    if (opts.bilevel) {
+      args.push('-threshold', '55%', '-type', 'bilevel');
+    }
+    log(opts, `${tool} ${args.join(' ')} ${file}`);
+    execFileSync(tool, [...args, file], { stdio: 'ignore' });
+    return;
+  }
+  const data = await fsp.readFile(file);
+  if (sniffImageType(data) !== 'png') {
+    process.stderr.write('warning: --document needs ImageMagick for non-PNG images; leaving the image as is\n');
+    return;
+  }
+  log(opts, '--document: no ImageMagick, skipping deskew');
+  const image = decodePng(data);
+  const gray = Buffer.alloc(image.width * image.height);
+  const histogram = new Array(256).fill(0);
+  for (let i = 0; i < gray.length; i += 1) {
+    const p = i * 4;
+    const alpha = image.pixels[p + 3] / 255;
+    const luma = 0.299 * image.pixels[p] + 0.587 * image.pixels[p + 1] + 0.114 * image.pixels[p + 2];
+    gray[i] = Math.round(luma * alpha + 255 * (1 - alpha));
+    histogram[gray[i]] += 1;
+  }
+  // Stretch so the darkest and lightest 1% map to black and white.
+  const clip = gray.length * 0.01;
+  let low = 0;
+  let high = 255;
+  for (let sum = 0; low < 255 && sum + histogram[low] <= clip; low += 1) sum += histogram[low];
+  for (let sum = 0; high > 0 && sum + histogram[high] <= clip; high -= 1) sum += histogram[high];
+  const range = Math.max(1, high - low);
+  for (let i = 0; i < gray.length; i += 1) {
+    gray[i] = Math.max(0, Math.min(255, Math.round(((gray[i] - low) * 255) / range)));
+  }
+  if (opts.bilevel) {
+    const threshold = otsuThreshold(gray);
+    for (let i = 0; i < gray.length; i += 1) gray[i] = gray[i] > threshold ? 255 : 0;
+  }
+  await fsp.writeFile(file, encodeGrayPng(image.width, image.height, gray, opts.bilevel ? 1 : 8));
 }
 
-async function handleFileCandidate(candidate, opts) {
-  const source = candidate.path;
-  if (opts.useDownloads) {
-    log(opts, `moving Downloads file to temp: ${candidate.path}`);
-    const tempPath = await moveImageToTemp(candidate.path);
-    return { source, tempPath };
+// otsuThreshold picks the gray level that best separates ink from paper.
+function otsuThreshold(gray) {
+  const histogram = new Array(256).fill(0);
+  for (const value of gray) histogram[value] += 1;
+  let total = 0;
+  for (let level = 0; level < 256; level += 1) total += level * histogram[level];
+  let below = 0;
+  let belowSum = 0;
+  let best = 127;
+  let bestVariance = -1;
+  for (let level = 0; level < 256; level += 1) {
+    below += histogram[level];
+    belowSum += level * histogram[level];
+    const above = gray.length - below;
+    if (below === 0 || above === 0) continue;
+    const diff = belowSum / below - (total - belowSum) / above;
+    const variance = below * above * diff * diff;
+    if (variance > bestVariance) {
+      bestVariance = variance;
+      best = level;
+    }
   }
-  log(opts, `copying Desktop file to temp and trashing: ${candidate.path}`);
-  const tempPath = await copyImageToTemp(candidate.path);
-  try {
-    await trashFile(candidate.path);
-  } catch (err) {
-    await safeUnlink(tempPath);
-    throw err;
+  return best;
+}
+
+// imageGeometry reads the pixel size and recorded density from PNG IHDR/pHYs
+// or JPEG SOF/JFIF headers; null for anything else (e.g. replay video).
+function imageGeometry(data) {
+  const type = sniffImageType(data);
+  if (type === 'png') {
+    const image = { width: data.readUInt32BE(16), height: data.readUInt32BE(20) };
+    let pos = 8;
+    while (pos + 8 <= data.length) {
+      const length = data.readUInt32BE(pos);
+      const chunk = data.toString('latin1', pos + 4, pos + 8);
+      if (chunk === 'pHYs' && length === 9 && data[pos + 16] === 1) {
+        image.dpi = Math.round(data.readUInt32BE(pos + 8) * 0.0254);
+      }
+      if (chunk === 'IDAT' || chunk === 'IEND') break;
+      pos += 12 + length;
+    }
+    return image;
   }
-  return { source, tempPath };
+  if (type === 'jpeg') {
+    let dpi = 0;
+    let pos = 2;
+    while (pos + 4 <= data.length && data[pos] === 0xff) {
+      const marker = data[pos + 1];
+      const length = data.readUInt16BE(pos + 2);
+      const body = data.subarray(pos + 4, pos + 2 + length);
+      if (marker === 0xe0 && body.toString('latin1', 0, 5) === 'JFIF\0' && body.length >= 12) {
+        const density = body.readUInt16BE(8);
+        if (body[7] === 1) dpi = density;
+        if (body[7] === 2) dpi = Math.round(density * 2.54);
+      }
+      if (marker >= 0xc0 && marker <= 0xcf && marker !== 0xc4 && marker !== 0xc8 && marker !== 0xcc) {
+        const image = { width: body.readUInt16BE(3), height: body.readUInt16BE(1) };
+        if (dpi) image.dpi = dpi;
+        return image;
+      }
+      if (marker === 0xda) break;
+      pos += 2 + length;
+    }
+  }
+  return null;
 }
 
-async function readClipboardImage() {
-  const tmp = await tempPath('clipboard-XXXXXX.png');
-  const cleanup = async () => safeUnlink(tmp);
+// matchDisplay names the connected display whose native pixel size equals
+// the image, i.e. the display a full-screen capture came from. Window and
+// region captures match nothing.
+function matchDisplay(image, opts) {
+  for (const display of listDisplays(opts)) {
+    if (display.width === image.width && display.height === image.height) {
+      return display;
+    }
+  }
+  return null;
+}
 
+function listDisplays(opts) {
   try {
-    if (commandExists('pngpaste')) {
-      try {
-        execFileSync('pngpaste', [tmp], { stdio: 'ignore' });
-        if (await fileHasContent(tmp)) {
-          const data = await fsp.readFile(tmp);
-          await cleanup();
-          return { data };
+    if (process.platform === 'darwin') {
+      const report = JSON.parse(
+        execFileSync('system_profiler', ['SPDisplaysDataType', '-json'], { stdio: ['ignore', 'pipe', 'ignore'] }).toString(),
+      );
+      const displays = [];
+      for (const gpu of report.SPDisplaysDataType || []) {
+        for (const screen of gpu.spdisplays_ndrvs || []) {
+          const pixels = /(\d+) x (\d+)/.exec(screen._spdisplays_pixels || '');
+          const points = /(\d+) x (\d+)/.exec(screen._spdisplays_resolution || '');
+          if (!pixels) continue;
+          const display = { name: screen._name, width: Number(pixels[1]), height: Number(pixels[2]) };
+          if (points) display.scale = Number(pixels[1]) / Number(points[1]);
+          displays.push(display);
         }
-      } catch (err) {
-        // fall through to other methods
       }
+      return displays;
     }
-
-    if (process.platform === 'darwin' && commandExists('osascript')) {
-      try {
-        const safeTmp = tmp.replace(/"/g, '\\"');
-        const script = [
-          'set theData to (the clipboard as «class PNGf»)',
-          `set theFile to POSIX file "${safeTmp}"`,
-          'set theFileRef to open for access theFile with write permission',
-          'set eof of theFileRef to 0',
-          'write theData to theFileRef',
-          'close access theFileRef',
-        ];
-        const args = [];
-        for (const line of script) {
-          args.push('-e', line);
-        }
-        execFileSync('osascript', args, { stdio: 'ignore' });
-        if (await fileHasContent(tmp)) {
-          const data = await fsp.readFile(tmp);
-          await cleanup();
-          return { data };
-        }
-      } catch (err) {
-        // fall through
+    if (process.env.DISPLAY && commandExists('xrandr')) {
+      const text = execFileSync('xrandr', ['--query'], { stdio: ['ignore', 'pipe', 'ignore'] }).toString();
+      const displays = [];
+      for (const match of text.matchAll(/^(\S+) connected (?:primary )?(\d+)x(\d+)\+/gm)) {
+        displays.push({ name: match[1], width: Number(match[2]), height: Number(match[3]) });
       }
+      return displays;
     }
+  } catch (err) {
+    log(opts, `display info unavailable: ${err.message}`);
+  }
+  return [];
+}
 
-    if (commandExists('wl-paste')) {
-      try {
-        const data = execFileSync('wl-paste', ['--type', 'image/png'], {
-          stdio: ['ignore', 'pipe', 'ignore'],
-          maxBuffer: CLIPBOARD_MAX_BUFFER,
-        });
-        if (data && data.length > 0) {
-          await cleanup();
-          return { data };
-        }
-      } catch (err) {
-        // fall through
+// exifOrientation returns the orientation tag (1-8) from a JPEG APP1 or PNG
+// eXIf chunk, or 0 when there is none.
+function exifOrientation(data) {
+  const type = sniffImageType(data);
+  if (type === 'png') {
+    let pos = 8;
+    while (pos + 8 <= data.length) {
+      const length = data.readUInt32BE(pos);
+      const chunk = data.toString('latin1', pos + 4, pos + 8);
+      if (chunk === 'eXIf') return tiffOrientation(data.subarray(pos + 8, pos + 8 + length));
+      if (chunk === 'IDAT' || chunk === 'IEND') break;
+      pos += 12 + length;
+    }
+    return 0;
+  }
+  if (type === 'jpeg') {
+    let pos = 2;
+    while (pos + 4 <= data.length && data[pos] === 0xff) {
+      const marker = data[pos + 1];
+      if (marker === 0xda || marker === 0xd9) break;
+      const length = data.readUInt16BE(pos + 2);
+      const body = data.subarray(pos + 4, pos + 2 + length);
+      if (marker === 0xe1 && body.toString('latin1', 0, 6) === 'Exif\0\0') {
+        return tiffOrientation(body.subarray(6));
       }
+      pos += 2 + length;
     }
+  }
+  return 0;
+}
 
-    if (commandExists('xclip')) {
-      try {
-        const data = execFileSync('xclip', ['-selection', 'clipboard', '-t', 'image/png', '-o'], {
-          stdio: ['ignore', 'pipe', 'ignore'],
-          maxBuffer: CLIPBOARD_MAX_BUFFER,
-        });
-        if (data && data.length > 0) {
-          await cleanup();
-          return { data };
-        }
-      } catch (err) {
-        // fall through
+function tiffOrientation(tiff) {
+  if (tiff.length < 8) return 0;
+  const little = tiff.toString('latin1', 0, 2) === 'II';
+  const u16 = (at) => (little ? tiff.readUInt16LE(at) : tiff.readUInt16BE(at));
+  const u32 = (at) => (little ? tiff.readUInt32LE(at) : tiff.readUInt32BE(at));
+  const ifd = u32(4);
+  if (ifd + 2 > tiff.length) return 0;
+  const count = u16(ifd);
+  for (let i = 0; i < count; i += 1) {
+    const entry = ifd + 2 + i * 12;
+    if (entry + 12 > tiff.length) break;
+    if (u16(entry) === 0x0112) return u16(entry + 8);
+  }
+  return 0;
+}
+
+// orientImage maps every pixel to where EXIF orientation 2-8 says it is
+// displayed; 5-8 swap width and height.
+function orientImage(image, orientation) {
+  const { width: w, height: h, pixels } = image;
+  const swap = orientation >= 5;
+  const outWidth = swap ? h : w;
+  const out = Buffer.alloc(pixels.length);
+  const place = {
+    2: (x, y) => [w - 1 - x, y],
+    3: (x, y) => [w - 1 - x, h - 1 - y],
+    4: (x, y) => [x, h - 1 - y],
+    5: (x, y) => [y, x],
+    6: (x, y) => [h - 1 - y, x],
+    7: (x, y) => [h - 1 - y, w - 1 - x],
+    8: (x, y) => [y, w - 1 - x],
+  }[orientation];
+  for (let y = 0; y < h; y += 1) {
+    for (let x = 0; x < w; x += 1) {
+      const [dx, dy] = place(x, y);
+      pixels.copy(out, (dy * outWidth + dx) * 4, (y * w + x) * 4, (y * w + x) * 4 + 4);
+    }
+  }
+  return { width: outWidth, height: swap ? w : h, pixels: out };
+}
+
+// decodePng decodes a non-interlaced PNG into 8-bit RGBA.
+function decodePng(data) {
+  if (sniffImageType(data) !== 'png') {
+    throw new Error('not a PNG image');
+  }
+  let pos = 8;
+  let header = null;
+  let palette = null;
+  let transparency = null;
+  const idat = [];
+  while (pos + 8 <= data.length) {
+    const length = data.readUInt32BE(pos);
+    const type = data.toString('latin1', pos + 4, pos + 8);
+    const body = data.subarray(pos + 8, pos + 8 + length);
+    pos += 12 + length;
+    if (type === 'IHDR') {
+      header = {
+        width: body.readUInt32BE(0),
+        height: body.readUInt32BE(4),
+        bitDepth: body[8],
+        colorType: body[9],
+        interlace: body[12],
+      };
+    } else if (type === 'PLTE') {
+      palette = body;
+    } else if (type === 'tRNS') {
+      transparency = body;
+    } else if (type === 'IDAT') {
+      idat.push(body);
+    } else if (type === 'IEND') {
+      break;
+    }
+  }
+  if (!header) throw new Error('PNG missing IHDR');
+  if (header.interlace) throw new Error('interlaced PNG is not supported');
+  const { width, height, bitDepth, colorType } = header;
+  const channels = { 0: 1, 2: 3, 3: 1, 4: 2, 6: 4 }[colorType];
+  if (!channels) throw new Error(`unsupported PNG color type ${colorType}`);
+  const bitsPerPixel = channels * bitDepth;
+  const stride = Math.ceil((width * bitsPerPixel) / 8);
+  const bpp = Math.max(1, bitsPerPixel >> 3);
+  const raw = zlib.inflateSync(Buffer.concat(idat));
+  const pixels = Buffer.alloc(width * height * 4);
+  let prev = Buffer.alloc(stride);
+  for (let y = 0; y < height; y += 1) {
+    const filter = raw[y * (stride + 1)];
+    const line = Buffer.from(raw.subarray(y * (stride + 1) + 1, (y + 1) * (stride + 1)));
+    unfilterPngLine(filter, line, prev, bpp);
+    for (let x = 0; x < width; x += 1) {
+      const sample = (index) => {
+        if (bitDepth === 8) return line[x * channels + index];
+        if (bitDepth === 16) return line[(x * channels + index) * 2];
+        const bit = (x * channels + index) * bitDepth;
+        const value = (line[bit >> 3] >> (8 - bitDepth - (bit & 7))) & ((1 << bitDepth) - 1);
+        return colorType === 3 ? value : Math.round((value * 255) / ((1 << bitDepth) - 1));
+      };
+      const out = (y * width + x) * 4;
+      if (colorType === 3) {
+        const index = sample(0);
+        pixels[out] = palette ? palette[index * 3] : 0;
+        pixels[out + 1] = palette ? palette[index * 3 + 1] : 0;
+        pixels[out + 2] = palette ? palette[index * 3 + 2] : 0;
+        pixels[out + 3] = transparency && index < transparency.length ? transparency[index] : 255;
+      } else if (colorType === 0 || colorType === 4) {
+        const gray = sample(0);
+        pixels[out] = gray;
+        pixels[out + 1] = gray;
+        pixels[out + 2] = gray;
+        pixels[out + 3] = colorType === 4 ? sample(1) : 255;
+      } else {
+        pixels[out] = sample(0);
+        pixels[out + 1] = sample(1);
+        pixels[out + 2] = sample(2);
+        pixels[out + 3] = colorType === 6 ? sample(3) : 255;
       }
     }
-  } finally {
-    await cleanup();
+    prev = line;
   }
+  return { width, height, pixels };
+}
 
-  const err = new Error(ERR_NOT_FOUND);
-  err.code = ERR_NOT_FOUND;
-  throw err;
+function unfilterPngLine(filter, line, prev, bpp) {
+  for (let i = 0; i < line.length; i += 1) {
+    const left = i >= bpp ? line[i - bpp] : 0;
+    const up = prev[i];
+    const upLeft = i >= bpp ? prev[i - bpp] : 0;
+    switch (filter) {
+      case 0:
+        break;
+      case 1:
+        line[i] = (line[i] + left) & 0xff;
+        break;
+      case 2:
+        line[i] = (line[i] + up) & 0xff;
+        break;
+      case 3:
+        line[i] = (line[i] + ((left + up) >> 1)) & 0xff;
+        break;
+      case 4: {
+        const p = left + up - upLeft;
+        const pa = Math.abs(p - left);
+        const pb = Math.abs(p - up);
+        const pc = Math.abs(p - upLeft);
+        const predictor = pa <= pb && pa <= pc ? left : pb <= pc ? up : upLeft;
+        line[i] = (line[i] + predictor) & 0xff;
+        break;
+      }
+      default:
+        throw new Error(`bad PNG filter ${filter}`);
+    }
+  }
 }
 
-async function writeClipboardToTemp(data) {
-  const tempPath = await tempMovePath('clipboard-*.png');
-  await fsp.writeFile(tempPath, data);
-  return path.resolve(tempPath);
+function encodePng(image) {
+  const { width, height, pixels } = image;
+  const stride = width * 4;
+  const raw = Buffer.alloc((stride + 1) * height);
+  for (let y = 0; y < height; y += 1) {
+    raw[y * (stride + 1)] = 0;
+    pixels.copy(raw, y * (stride + 1) + 1, y * stride, (y + 1) * stride);
+  }
+  const ihdr = Buffer.alloc(13);
+  ihdr.writeUInt32BE(width, 0);
+  ihdr.writeUInt32BE(height, 4);
+  ihdr[8] = 8;
+  ihdr[9] = 6;
+  return Buffer.concat([
+    Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]),
+    pngChunk('IHDR', ihdr),
+    pngChunk('IDAT', zlib.deflateSync(raw)),
+    pngChunk('IEND', Buffer.alloc(0)),
+  ]);
 }
 
-async function findFallbackImage(useDownloads) {
-  const fallbackDir = await locateFallbackDir(useDownloads);
-  return latestImage(fallbackDir);
+// encodeGrayPng writes 8-bit grayscale, or 1-bit when gray holds only 0 and 255.
+function encodeGrayPng(width, height, gray, bitDepth) {
+  const stride = bitDepth === 1 ? Math.ceil(width / 8) : width;
+  const raw = Buffer.alloc((stride + 1) * height);
+  for (let y = 0; y < height; y += 1) {
+    const row = y * (stride + 1) + 1;
+    for (let x = 0; x < width; x += 1) {
+      const value = gray[y * width + x];
+      if (bitDepth === 1) {
+        if (value) raw[row + (x >> 3)] |= 0x80 >> (x & 7);
+      } else {
+        raw[row + x] = value;
+      }
+    }
+  }
+  const ihdr = Buffer.alloc(13);
+  ihdr.writeUInt32BE(width, 0);
+  ihdr.writeUInt32BE(height, 4);
+  ihdr[8] = bitDepth;
+  ihdr[9] = 0;
+  return Buffer.concat([
+    Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]),
+    pngChunk('IHDR', ihdr),
+    pngChunk('IDAT', zlib.deflateSync(raw)),
+    pngChunk('IEND', Buffer.alloc(0)),
+  ]);
 }
 
-async function copyImageToTemp(src) {
-  const ext = normalizeExt(path.extname(src));
-  const tempPath = await tempMovePath(`image-*${ext}`);
-  await copyFile(src, tempPath);
-  return path.resolve(tempPath);
+function pngChunk(type, body) {
+  const head = Buffer.alloc(8);
+  head.writeUInt32BE(body.length, 0);
+  head.write(type, 4, 'latin1');
+  const crc = Buffer.alloc(4);
+  crc.writeUInt32BE(crc32(Buffer.concat([head.subarray(4), body])), 0);
+  return Buffer.concat([head, body, crc]);
 }
 
-async function moveImageToTemp(src) {
-  const ext = normalizeExt(path.extname(src));
-  const tempPath = await tempMovePath(`image-*${ext}`);
-  await moveFile(src, tempPath);
-  return path.resolve(tempPath);
+let crcTable = null;
+
+function crc32(data) {
+  if (!crcTable) {
+    crcTable = new Uint32Array(256);
+    for (let n = 0; n < 256; n += 1) {
+      let c = n;
+      for (let k = 0; k < 8; k += 1) {
+        c = c & 1 ? 0xedb88320 ^ (c >>> 1) : c >>> 1;
+      }
+      crcTable[n] = c >>> 0;
+    }
+  }
+  let crc = 0xffffffff;
+  for (let i = 0; i < data.length; i += 1) {
+    crc = crcTable[(crc ^ data[i]) & 0xff] ^ (crc >>> 8);
+  }
+  return (crc ^ 0xffffffff) >>> 0;
 }
 
-async function locateFallbackDir(useDownloads) {
-  if (useDownloads) {
-    return locateDownloads();
+// diffImages marks differing pixels red over a faded copy of the baseline.
+// Images of different sizes are compared over their overlap and every pixel
+// outside it counts as different.
+function diffImages(baseline, actual, fuzz) {
+  const width = Math.max(baseline.width, actual.width);
+  const height = Math.max(baseline.height, actual.height);
+  const pixels = Buffer.alloc(width * height * 4);
+  let different = 0;
+  for (let y = 0; y < height; y += 1) {
+    for (let x = 0; x < width; x += 1) {
+      const out = (y * width + x) * 4;
+      const inBase = x < baseline.width && y < baseline.height;
+      const inActual = x < actual.width && y < actual.height;
+      let differs = !inBase || !inActual;
+      let gray = 255;
+      if (inBase && inActual) {
+        const a = (y * baseline.width + x) * 4;
+        const b = (y * actual.width + x) * 4;
+        for (let c = 0; c < 4; c += 1) {
+          if (Math.abs(baseline.pixels[a + c] - actual.pixels[b + c]) > fuzz) {
+            differs = true;
+            break;
+          }
+        }
+        const luma = (baseline.pixels[a] * 3 + baseline.pixels[a + 1] * 6 + baseline.pixels[a + 2]) / 10;
+        gray = Math.round(191 + luma / 4);
+      }
+      if (differs) {
+        different += 1;
+        pixels[out] = 255;
+        pixels[out + 1] = 0;
+        pixels[out + 2] = 0;
+      } else {
+        pixels[out] = gray;
+        pixels[out + 1] = gray;
+        pixels[out + 2] = gray;
+      }
+      pixels[out + 3] = 255;
+    }
   }
-  return locateDesktop();
+  return {
+    image: { width, height, pixels },
+    different,
+    total: width * height,
+    sameSize: baseline.width === actual.width && baseline.height === actual.height,
+  };
 }
 
-async function locateDesktop() {
-  const home = os.homedir();
-  const defaultDesktop = path.join(home, 'Desktop');
-  if (await isDir(defaultDesktop)) {
-    return defaultDesktop;
+// stagePath picks where a result is written: the caller's --out path, or a
+// fresh temp file matching pattern. Vector sources still go through temp so
+// only the rasterized PNG lands at --out.
+async function stagePath(pattern, opts) {
+  if (!opts.out || (opts.rasterize && isVectorExt(path.extname(pattern)))) {
+    return tempMovePath(pattern);
   }
-  if (process.platform === 'linux') {
-    const dir = await xdgUserDir(home, 'DESKTOP');
-    if (dir && (await isDir(dir))) {
-      return dir;
-    }
+  return outputPath(opts);
+}
+
+async function outputPath(opts) {
+  const out = path.resolve(opts.out);
+  await makeDirs(path.dirname(out), opts);
+  return placeTarget(out, opts.collision || 'fail', opts);
+}
+
+// makeDirs creates dir and any missing parents, giving each one it created
+// the --dir-mode and --chown settings.
+async function makeDirs(dir, opts) {
+  const first = await fsp.mkdir(dir, { recursive: true });
+  if (!first) return;
+  for (let current = dir; ; current = path.dirname(current)) {
+    await applyPermissions(current, opts, true);
+    if (current === first || path.dirname(current) === current) break;
   }
-  throw notFoundError();
 }
 
-async function locateDownloads() {
-  const home = os.homedir();
-  const defaultDownloads = path.join(home, 'Downloads');
-  if (await isDir(defaultDownloads)) {
-    return defaultDownloads;
+// applyPermissions sets --chmod/--dir-mode and --chown on an archive or
+// output path. Changing ownership usually needs root or group membership,
+// so a refusal is a warning rather than a failure.
+async function applyPermissions(target, opts, isDir) {
+  const mode = isDir ? opts.dirMode : opts.fileMode;
+  if (mode !== null) {
+    await fsp.chmod(target, mode);
   }
-  if (process.platform === 'linux') {
-    const dir = await xdgUserDir(home, 'DOWNLOAD');
-    if (dir && (await isDir(dir))) {
-      return dir;
+  if (opts.chown) {
+    const { uid, gid } = resolveOwner(opts.chown);
+    try {
+      await fsp.chown(target, uid, gid);
+    } catch (err) {
+      if (!err || (err.code !== 'EPERM' && err.code !== 'EINVAL')) throw err;
+      process.stderr.write(`warning: cannot chown ${target} to ${opts.chown}: ${err.code}\n`);
     }
   }
-  throw notFoundError();
 }
 
-async function xdgUserDir(home, key) {
-  const configPath = path.join(home, '.config', 'user-dirs.dirs');
-  let data;
+function parseMode(value) {
+  if (!/^[0-7]{3,4}$/.test(String(value))) return null;
+  return parseInt(String(value), 8);
+}
+
+// resolveOwner turns USER[:GROUP] (names or numeric ids) into ids; -1 leaves
+// that half unchanged.
+function resolveOwner(spec) {
+  const [user, group = ''] = String(spec).split(':');
+  const uid = !user ? -1 : /^\d+$/.test(user) ? Number(user) : lookupUser(user);
+  const gid = !group ? -1 : /^\d+$/.test(group) ? Number(group) : lookupGroup(group);
+  return { uid, gid };
+}
+
+function lookupUser(name) {
   try {
-    data = await fsp.readFile(configPath, 'utf8');
+    return Number(execFileSync('id', ['-u', name], { stdio: ['ignore', 'pipe', 'ignore'] }).toString().trim());
   } catch (err) {
-    return '';
-  }
-  const prefix = `XDG_${key}_DIR=`;
-  for (const rawLine of data.split('\n')) {
-    const line = rawLine.trim();
-    if (!line.startsWith(prefix)) continue;
-    let value = line.slice(prefix.length).trim();
-    value = value.replace(/^['"]|['"]$/g, '');
-    value = value.replace(/\$\{HOME\}/g, home).replace(/\$HOME/g, home);
-    if (value.startsWith('~')) {
-      value = path.join(home, value.slice(1));
-    }
-    if (!value) return '';
-    if (!path.isAbsolute(value)) {
-      value = path.join(home, value);
-    }
-    return path.normalize(value);
+    throw new Error(`--chown: unknown user ${name}`);
   }
-  return '';
 }
 
-async function latestImage(dir) {
-  let entries;
+function lookupGroup(name) {
+  let text = '';
   try {
-    entries = await fsp.readdir(dir, { withFileTypes: true });
+    text = fs.readFileSync('/etc/group', 'utf8');
   } catch (err) {
-    if (err && err.code === 'ENOENT') {
-      throw notFoundError();
-    }
-    throw err;
+    // Fall through to the error below.
   }
-
-  let latestTagged = null;
-  let latestTaggedTime = 0;
-  let latestAny = null;
-  let latestAnyTime = 0;
-  for (const entry of entries) {
-    if (!entry.isFile()) continue;
-    const name = entry.name;
-    if (!hasImageExt(name)) continue;
-    const fullPath = path.join(dir, name);
-    let info;
+  for (const line of text.split('\n')) {
+    const fields = line.split(':');
+    if (fields[0] === name && /^\d+$/.test(fields[2] || '')) return Number(fields[2]);
+  }
+  if (process.platform === 'darwin' && commandExists('dscl')) {
     try {
-      info = await fsp.stat(fullPath);
+      const out = execFileSync('dscl', ['.', '-read', `/Groups/${name}`, 'PrimaryGroupID'], {
+        stdio: ['ignore', 'pipe', 'ignore'],
+      }).toString();
+      const match = /PrimaryGroupID:\s*(\d+)/.exec(out);
+      if (match) return Number(match[1]);
     } catch (err) {
-      continue;
-    }
-    if (!info.isFile()) continue;
-    const modTimeMs = info.mtimeMs;
-    const candidate = { path: fullPath, modTimeMs };
-    if (isScreenshotName(name)) {
-      if (!latestTagged || modTimeMs > latestTaggedTime) {
-        latestTagged = candidate;
-        latestTaggedTime = modTimeMs;
-      }
-      continue;
-    }
-    if (!latestAny || modTimeMs > latestAnyTime) {
-      latestAny = candidate;
-      latestAnyTime = modTimeMs;
+      // Fall through to the error below.
     }
   }
+  throw new Error(`--chown: unknown group ${name}`);
+}
 
-  if (latestTagged) return latestTagged;
-  if (latestAny) return latestAny;
-  throw notFoundError();
+// CONSUME_POLICIES govern what happens to a file source after staging: auto
+// trashes Desktop files and moves Downloads files but falls back to copying
+// when the source can't be changed, strict fails instead, keep never
+// touches the source.
+const CONSUME_POLICIES = ['auto', 'strict', 'keep'];
+
+const COLLISION_POLICIES = ['rename', 'overwrite', 'fail', 'skip'];
+
+// PREFER_POLICIES settle a clipboard image against a file: auto takes the
+// file only if it is within --recency, clipboard and file always take that
+// source, and newest compares the file's time with when runs first saw the
+// clipboard bytes.
+const PREFER_POLICIES = ['auto', 'clipboard', 'file', 'newest'];
+
+// placeTarget applies a --collision policy to a destination: the path to
+// write (target itself, or the next free NAME.N.ext for rename), or null to
+// skip it.
+// placeTarget resolves a write to target under the collision policy. A batch
+// that picks every target before writing any passes reserved, the NFC names
+// it has picked so far in that directory, and they count as taken; the
+// chosen name is added to it.
+async function placeTarget(target, policy, opts, reserved = null) {
+  const chosen = await chooseTarget(target, policy, opts, reserved);
+  if (chosen && reserved) reserved.add(path.basename(chosen).normalize('NFC'));
+  return chosen;
 }
 
-function hasImageExt(name) {
-  switch (path.extname(name).toLowerCase()) {
-    case '.png':
-    case '.jpg':
-    case '.jpeg':
-      return true;
+async function chooseTarget(target, policy, opts, reserved) {
+  const dir = path.dirname(target);
+  const claimed = reserved && reserved.has(path.basename(target).normalize('NFC'));
+  const current = (await existingTarget(target)) || (claimed ? target : '');
+  if (!current) return target;
+  // Overwriting replaces what was there before the run, never a file the
+  // same run is about to write.
+  switch (claimed && policy === 'overwrite' ? 'rename' : policy) {
+    case 'rename':
+      return path.join(dir, await uniqueName(path.basename(target), dir, '', reserved));
+    case 'overwrite':
+      if (opts.readOnly) throw new Error(`${current} exists and read-only mode never overwrites`);
+      return current;
+    case 'skip':
+      return null;
     default:
-      return false;
+      throw new Error(`${current} already exists (see --collision)`);
   }
 }
 
-function isScreenshotName(name) {
-  const lower = name.toLowerCase();
-  return lower.includes('screenshot') || lower.includes('screen shot');
-}
-
 async function tempMovePath(pattern) {
   return uniqueTempPath(pattern);
 }
@@ -418,102 +7980,233 @@ async function copyAndRemove(src, dst) {
   await fsp.unlink(src);
 }
 
+const TRASH_IMPLEMENTATIONS = {
+  darwin: (absPath) => trashDarwin(absPath),
+  linux: (absPath) => trashLinux(absPath),
+  freebsd: (absPath) => trashLinux(absPath),
+  openbsd: (absPath) => trashLinux(absPath),
+  netbsd: (absPath) => trashLinux(absPath),
+  win32: (absPath) => trashWindows(absPath),
+};
+
 async function trashFile(filePath) {
-  const absPath = path.resolve(filePath);
-  if (process.platform === 'darwin') {
-    return trashDarwin(absPath);
+  const absPath = Buffer.isBuffer(filePath) ? filePath : path.resolve(filePath);
+  const trash = TRASH_IMPLEMENTATIONS[process.platform];
+  if (!trash) {
+    throw unsupportedError('trash', Object.keys(TRASH_IMPLEMENTATIONS));
   }
-  if (process.platform === 'linux') {
-    return trashLinux(absPath);
-  }
-  throw new Error(`trash unsupported on ${process.platform}`);
+  return trash(absPath);
+}
+
+// trashWindows sends the file to the Recycle Bin through the VisualBasic
+// FileSystem helper, which wraps SHFileOperation with FOF_ALLOWUNDO. The
+// Recycle Bin picks its own name for the entry, so there is no location to
+// journal; restore points the user at the Recycle Bin instead.
+async function trashWindows(absPath) {
+  const target = absPath.toString().replace(/'/g, "''");
+  const script = [
+    'Add-Type -AssemblyName Microsoft.VisualBasic',
+    `[Microsoft.VisualBasic.FileIO.FileSystem]::DeleteFile('${target}', 'OnlyErrorDialogs', 'SendToRecycleBin')`,
+  ].join('\n');
+  await runProcess('powershell', ['-NoProfile', '-NonInteractive', '-Command', script]);
+  return { path: '' };
 }
 
 async function trashDarwin(absPath) {
   const home = os.homedir();
   const trashDir = path.join(home, '.Trash');
   await fsp.mkdir(trashDir, { recursive: true, mode: 0o700 });
-  const name = await uniqueTrashName(path.basename(absPath), trashDir, '');
+  const name = await uniqueName(splitRawPath(absPath).base.toString(), trashDir, '');
   const dest = path.join(trashDir, name);
   await moveFile(absPath, dest);
+  return { path: dest };
 }
 
 async function trashLinux(absPath) {
-  const home = os.homedir();
-  const trashRoot = path.join(home, '.local', 'share', 'Trash');
+  const { dir, base } = splitRawPath(absPath);
+  const realDir = await fsp.realpath(dir);
+  const realPath = Buffer.concat([Buffer.from(path.join(realDir, path.sep)), base]);
+  const { trashRoot, topdir } = await linuxTrashRoot(realDir, realPath);
   const filesDir = path.join(trashRoot, 'files');
   const infoDir = path.join(trashRoot, 'info');
   await fsp.mkdir(filesDir, { recursive: true, mode: 0o700 });
   await fsp.mkdir(infoDir, { recursive: true, mode: 0o700 });
 
-  const name = await uniqueTrashName(path.basename(absPath), filesDir, infoDir);
+  // The trash copy gets a valid UTF-8 name; Path= keeps the original bytes
+  // so a restore puts back exactly what was there.
+  const name = await uniqueName(base.toString(), filesDir, infoDir);
   const dest = path.join(filesDir, name);
-  await moveFile(absPath, dest);
+  await moveFile(realPath, dest);
 
+  // Per the FreeDesktop spec, trashes under a mount's topdir record paths
+  // relative to that topdir; the home trash records absolute paths.
   const infoPath = path.join(infoDir, `${name}.trashinfo`);
-  const info = trashInfoContent(absPath, new Date());
+  const relDir = topdir ? path.relative(topdir, realDir) : '';
+  const recorded = topdir ? Buffer.concat([Buffer.from(relDir ? relDir + path.sep : ''), base]) : realPath;
+  const info = trashInfoContent(recorded, new Date());
   try {
     await fsp.writeFile(infoPath, info, { mode: 0o600 });
   } catch (err) {
-    await moveFile(dest, absPath).catch(() => {});
+    await moveFile(dest, realPath).catch(() => {});
     throw err;
   }
+  return { path: dest, info: infoPath };
 }
 
-async function uniqueTrashName(base, filesDir, infoDir) {
-  if (!base) {
-    throw new Error('empty trash name');
+// linuxTrashRoot picks the home trash when the file lives on the same device,
+// or else $topdir/.Trash/$uid (if an admin set up a sticky, non-symlinked
+// .Trash) or $topdir/.Trash-$uid, so trashing never copies across mounts.
+async function linuxTrashRoot(realDir, realPath) {
+  const homeTrash = { trashRoot: path.join(os.homedir(), '.local', 'share', 'Trash'), topdir: '' };
+  const fileInfo = await fsp.stat(realPath);
+  const homeInfo = await fsp.stat(os.homedir()).catch(() => null);
+  if (!homeInfo || homeInfo.dev === fileInfo.dev) {
+    return homeTrash;
+  }
+  const topdir = await mountTopdir(realDir, fileInfo.dev);
+  const uid = process.getuid ? process.getuid() : 0;
+  const shared = path.join(topdir, '.Trash');
+  try {
+    const info = await fsp.lstat(shared);
+    if (info.isDirectory() && !info.isSymbolicLink() && info.mode & 0o1000) {
+      const root = path.join(shared, String(uid));
+      await fsp.mkdir(root, { recursive: true, mode: 0o700 });
+      return { trashRoot: root, topdir };
+    }
+  } catch (err) {
+    // No shared trash on this mount.
   }
-  if (!(await trashNameExists(base, filesDir, infoDir))) {
-    return base;
+  const own = path.join(topdir, `.Trash-${uid}`);
+  try {
+    await fsp.mkdir(own, { recursive: true, mode: 0o700 });
+    return { trashRoot: own, topdir };
+  } catch (err) {
+    return homeTrash;
+  }
+}
+
+async function mountTopdir(start, dev) {
+  let dir = start;
+  for (;;) {
+    const parent = path.dirname(dir);
+    if (parent === dir) return dir;
+    const info = await fsp.stat(parent).catch(() => null);
+    if (!info || info.dev !== dev) return dir;
+    dir = parent;
+  }
+}
+
+const NAME_MAX = 255;
+
+async function uniqueName(base, filesDir, infoDir, reserved = null) {
+  if (!base) {
+    throw new Error('empty file name');
   }
+  // Leave room for the .trashinfo twin and the .N suffix so long names
+  // never hit ENAMETOOLONG.
+  const limit = NAME_MAX - (infoDir ? '.trashinfo'.length : 0);
   const ext = path.extname(base);
-  const stem = base.slice(0, -ext.length);
+  const stem = base.slice(0, base.length - ext.length);
+  const fit = (suffix) => truncateBytes(stem, limit - Buffer.byteLength(suffix + ext)) + suffix + ext;
+  const taken = await takenNames(filesDir, infoDir);
+  for (const name of reserved || []) taken.set(name, name);
+  if (!taken.has(fit('').normalize('NFC'))) {
+    return fit('');
+  }
   for (let i = 1; i < 10000; i += 1) {
-    const name = `${stem}.${i}${ext}`;
-    if (!(await trashNameExists(name, filesDir, infoDir))) {
+    const name = fit(`.${i}`);
+    if (!taken.has(name.normalize('NFC'))) {
       return name;
     }
   }
-  throw new Error('unable to find unique trash name');
+  throw new Error(`unable to find unique name for ${base}`);
 }
 
-async function trashNameExists(name, filesDir, infoDir) {
-  if (await exists(path.join(filesDir, name))) {
-    return true;
-  }
-  if (!infoDir) return false;
-  return exists(path.join(infoDir, `${name}.trashinfo`));
+function truncateBytes(text, maxBytes) {
+  if (Buffer.byteLength(text) <= maxBytes) return text;
+  const chars = Array.from(text);
+  while (chars.length > 0 && Buffer.byteLength(chars.join('')) > maxBytes) chars.pop();
+  return chars.join('');
 }
 
-async function exists(checkPath) {
-  try {
-    await fsp.stat(checkPath);
-    return true;
-  } catch (err) {
-    return err && err.code !== 'ENOENT';
+// takenNames maps the NFC form of every name used in filesDir (and, for a
+// trash, every info entry) to the name on disk. macOS treats NFC and NFD
+// spellings of a name as the same file, and a Linux copy of such a folder
+// can hold both, so collisions are decided on the normalized form.
+async function takenNames(filesDir, infoDir) {
+  const names = new Map();
+  for (const name of await fsp.readdir(filesDir).catch(() => [])) {
+    names.set(name.normalize('NFC'), name);
   }
+  if (infoDir) {
+    for (const name of await fsp.readdir(infoDir).catch(() => [])) {
+      if (name.endsWith('.trashinfo')) {
+        const base = name.slice(0, -'.trashinfo'.length);
+        names.set(base.normalize('NFC'), base);
+      }
+    }
+  }
+  return names;
+}
+
+// existingTarget returns the path of the file a write to target would
+// collide with (possibly a differently normalized spelling), or ''.
+async function existingTarget(target) {
+  const dir = path.dirname(target);
+  const name = (await takenNames(dir, '')).get(path.basename(target).normalize('NFC'));
+  return name ? path.join(dir, name) : '';
 }
 
 function trashInfoContent(absPath, deletedAt) {
   return `[Trash Info]\nPath=${trashEscapePath(absPath)}\nDeletionDate=${formatTrashDate(deletedAt)}\n`;
 }
 
+// trashEscapePath percent-encodes the raw bytes with encodeURI's safe set, so
+// names that are not valid UTF-8 survive the round trip.
 function trashEscapePath(filePath) {
-  return encodeURI(filePath).replace(/%2F/gi, '/');
+  const bytes = Buffer.isBuffer(filePath) ? filePath : Buffer.from(filePath);
+  let out = '';
+  for (const byte of bytes) {
+    const ch = String.fromCharCode(byte);
+    out += byte < 0x80 && /[A-Za-z0-9;,/?:@&=+$\-_.!~*'()#]/.test(ch)
+      ? ch
+      : `%${byte.toString(16).toUpperCase().padStart(2, '0')}`;
+  }
+  return out;
+}
+
+// splitRawPath splits a path that may be a Buffer (a name that is not valid
+// UTF-8) into its directory string and the name's exact bytes.
+function splitRawPath(filePath) {
+  if (!Buffer.isBuffer(filePath)) {
+    return { dir: path.dirname(filePath), base: Buffer.from(path.basename(filePath)) };
+  }
+  const slash = filePath.lastIndexOf(path.sep.charCodeAt(0));
+  return { dir: filePath.subarray(0, slash).toString() || path.sep, base: filePath.subarray(slash + 1) };
 }
 
+// The trash spec wants DeletionDate in local time without a zone.
 function formatTrashDate(date) {
-  const pad = (value) => String(value).padStart(2, '0');
-  return `${date.getFullYear()}-${pad(date.getMonth() + 1)}-${pad(date.getDate())}T${pad(date.getHours())}:${pad(
-    date.getMinutes(),
-  )}:${pad(date.getSeconds())}`;
+  return rfc3339(date).slice(0, 19);
+}
+
+// rfc3339 formats times for state files and JSON: local wall-clock time
+// with its UTC offset (2024-05-01T10:12:33.000+02:00), so an archive
+// moved between machines keeps the local context and still parses (and
+// sorts, via Date.parse) as the same instant.
+function rfc3339(date) {
+  const pad = (value, width = 2) => String(value).padStart(width, '0');
+  const offset = -date.getTimezoneOffset();
+  const zone = `${offset >= 0 ? '+' : '-'}${pad(Math.floor(Math.abs(offset) / 60))}:${pad(Math.abs(offset) % 60)}`;
+  const day = `${date.getFullYear()}-${pad(date.getMonth() + 1)}-${pad(date.getDate())}`;
+  const time = `${pad(date.getHours())}:${pad(date.getMinutes())}:${pad(date.getSeconds())}`;
+  return `${day}T${time}.${pad(date.getMilliseconds(), 3)}${zone}`;
 }
 
 function normalizeExt(ext) {
   if (!ext) return '.png';
   const lower = ext.toLowerCase();
-  if (lower === '.png' || lower === '.jpg' || lower === '.jpeg') return lower;
+  if (IMAGE_EXTS.includes(lower.slice(1))) return lower;
   return '.png';
 }
 
@@ -573,6 +8266,13 @@ async function safeUnlink(filePath) {
   }
 }
 
+function unsupportedError(capability, platforms) {
+  const supported = [...new Set(platforms)].join(', ');
+  const err = new Error(`${capability} unsupported on ${process.platform} (supported: ${supported})`);
+  err.code = ERR_UNSUPPORTED;
+  return err;
+}
+
 function notFoundError() {
   const err = new Error(ERR_NOT_FOUND);
   err.code = ERR_NOT_FOUND;
@@ -607,4 +8307,36 @@ function randomToken() {
   return `${Date.now().toString(36)}${Math.random().toString(36).slice(2, 10)}`;
 }
 
-main();
+if (require.main === module) {
+  main();
+} else {
+  module.exports = {
+    compareAssert,
+    crc32,
+    decodePng,
+    diffImages,
+    encodePng,
+    evaluateRules,
+    existingTarget,
+    exifOrientation,
+    failedAssertions,
+    globToRegExp,
+    orientImage,
+    parseAssertions,
+    parseDuration,
+    parseRule,
+    parseSize,
+    parseToml,
+    placeTarget,
+    pngChunk,
+    ruleFacts,
+    s3Escape,
+    signS3,
+    splitRawPath,
+    textPath,
+    trashEscapePath,
+    trashInfoContent,
+    truncateBytes,
+    uniqueName,
+  };
+}
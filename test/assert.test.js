@@ -0,0 +1,56 @@
+'use strict';
+
+const test = require('node:test');
+const assert = require('node:assert/strict');
+const fs = require('node:fs');
+const os = require('node:os');
+const path = require('node:path');
+
+const {
+  compareAssert,
+  encodePng,
+  failedAssertions,
+  parseAssertions,
+} = require('../skills/use-screenshot/scripts/screenshot-agent.js');
+
+test('parseAssertions splits a comma list into checks', () => {
+  assert.deepEqual(parseAssertions(' width>=800, format == JPG,,bytes<2k '), [
+    { text: 'width>=800', field: 'width', op: '>=', value: 800 },
+    { text: 'format == JPG', field: 'format', op: '==', value: 'jpeg' },
+    { text: 'bytes<2k', field: 'bytes', op: '<', value: 2048 },
+  ]);
+  assert.deepEqual(parseAssertions('Tag!=draft'), [{ text: 'Tag!=draft', field: 'tag', op: '!=', value: 'draft' }]);
+  assert.deepEqual(parseAssertions(''), []);
+});
+
+test('parseAssertions rejects malformed checks', () => {
+  assert.throws(() => parseAssertions('width=800'), /invalid --assert: width=800 \(want FIELD OP VALUE\)/);
+  assert.throws(() => parseAssertions('colour==red'), /unknown field colour \(width, height/);
+  assert.throws(() => parseAssertions('format>png'), /format only supports == and !=/);
+  assert.throws(() => parseAssertions('width>=wide'), /bad value in width>=wide/);
+  assert.throws(() => parseAssertions('bytes<lots'), /bad value in bytes<lots/);
+});
+
+test('compareAssert applies each operator', () => {
+  assert.ok(compareAssert(800, '>=', 800));
+  assert.ok(!compareAssert(799, '>=', 800));
+  assert.ok(compareAssert(10, '<=', 10));
+  assert.ok(compareAssert(11, '>', 10));
+  assert.ok(!compareAssert(10, '<', 10));
+  assert.ok(compareAssert('png', '==', 'png'));
+  assert.ok(compareAssert('png', '!=', 'jpeg'));
+});
+
+test('failedAssertions reports failed and unknown fields', async (t) => {
+  const dir = fs.mkdtempSync(path.join(os.tmpdir(), 'use-screenshot-test-'));
+  t.after(() => fs.rmSync(dir, { recursive: true, force: true }));
+  const tempPath = path.join(dir, 'shot.png');
+  fs.writeFileSync(tempPath, encodePng({ width: 1, height: 1, pixels: Buffer.alloc(4) }));
+  const result = { tempPath, image: { width: 640, height: 480 }, bytes: 100 };
+  assert.deepEqual(await failedAssertions(parseAssertions('width>=640,format==png,bytes<1k'), result), []);
+  assert.deepEqual(await failedAssertions(parseAssertions('height>=600,dpi>=144,format==jpg'), result), [
+    'height>=600 (height is 480)',
+    'dpi>=144 (dpi is unknown)',
+    'format==jpg (format is png)',
+  ]);
+});
@@ -0,0 +1,90 @@
+'use strict';
+
+const test = require('node:test');
+const assert = require('node:assert/strict');
+
+const {
+  parseDuration,
+  parseSize,
+  parseToml,
+} = require('../skills/use-screenshot/scripts/screenshot-agent.js');
+
+test('parseToml reads keys, strings, numbers, and booleans', () => {
+  const got = parseToml([
+    '# comment',
+    'dir = "~/Pictures" # trailing comment',
+    "literal = 'C:\\shots'",
+    'count = 1_000',
+    'ratio = -0.5',
+    'enabled = true',
+    '"quoted key" = false',
+    '',
+  ].join('\n'));
+  assert.deepEqual(got, {
+    dir: '~/Pictures',
+    literal: 'C:\\shots',
+    count: 1000,
+    ratio: -0.5,
+    enabled: true,
+    'quoted key': false,
+  });
+});
+
+test('parseToml reads escapes, tables, and multi-line arrays', () => {
+  const got = parseToml([
+    'name = "a\\tb\\n\\"c\\""',
+    '[delivery.s3]',
+    'bucket = "shots"',
+    '[delivery]',
+    'targets = [',
+    '  "s3", # first',
+    "  'http',",
+    ']',
+    'empty = []',
+  ].join('\r\n'));
+  assert.deepEqual(got, {
+    name: 'a\tb\n"c"',
+    delivery: { s3: { bucket: 'shots' }, targets: ['s3', 'http'], empty: [] },
+  });
+});
+
+test('parseToml reports the failing line', () => {
+  assert.throws(() => parseToml('a = 1\nb 2'), /line 2: expected = after b/);
+  assert.throws(() => parseToml('a = "open'), /line 1: unterminated string/);
+  assert.throws(() => parseToml('a = "\\q"'), /bad escape \\q/);
+  assert.throws(() => parseToml('a = 1979-05-27'), /unsupported value: 1979-05-27/);
+  assert.throws(() => parseToml('a = [1 2]'), /expected , or \] in array/);
+  assert.throws(() => parseToml('a = 1 b = 2'), /unexpected trailing characters/);
+  assert.throws(() => parseToml('a = 1\n[a]'), /line 2: a is not a table/);
+  assert.throws(() => parseToml('[a'), /expected \]/);
+});
+
+test('parseDuration sums unit parts', () => {
+  assert.equal(parseDuration('500ms'), 500);
+  assert.equal(parseDuration('90s'), 90 * 1000);
+  assert.equal(parseDuration('1h30m'), 90 * 60 * 1000);
+  assert.equal(parseDuration(' 1.5d '), 36 * 60 * 60 * 1000);
+  assert.equal(parseDuration('2w'), 14 * 24 * 60 * 60 * 1000);
+});
+
+test('parseDuration rejects bare numbers and junk', () => {
+  for (const text of ['', '10', 'h', '1 h', '1h junk', '1y']) {
+    assert.equal(parseDuration(text), null, text);
+  }
+});
+
+test('parseSize accepts binary units', () => {
+  assert.equal(parseSize('512'), 512);
+  assert.equal(parseSize('10b'), 10);
+  assert.equal(parseSize('2k'), 2048);
+  assert.equal(parseSize('1.5 MB'), 1.5 * 1024 * 1024);
+  assert.equal(parseSize('1MiB'), 1024 * 1024);
+  assert.equal(parseSize('1g'), 1024 * 1024 * 1024);
+  assert.equal(parseSize('0.1k'), 102);
+});
+
+test('parseSize rejects unknown units', () => {
+  for (const text of ['', 'big', '1tb', '-1k', 'k']) {
+    assert.equal(parseSize(text), null, text);
+  }
+});
@@ -0,0 +1,45 @@
+'use strict';
+
+const test = require('node:test');
+const assert = require('node:assert/strict');
+const { execFileSync } = require('node:child_process');
+const fs = require('node:fs');
+const os = require('node:os');
+const path = require('node:path');
+
+const { encodePng } = require('../skills/use-screenshot/scripts/screenshot-agent.js');
+
+const SCRIPT = path.join(__dirname, '..', 'skills', 'use-screenshot', 'scripts', 'screenshot-agent.js');
+
+test('export keeps both of two same-named screenshots', (t) => {
+  const home = fs.mkdtempSync(path.join(os.tmpdir(), 'use-screenshot-test-'));
+  t.after(() => fs.rmSync(home, { recursive: true, force: true }));
+  const shots = {
+    Desktop: encodePng({ width: 2, height: 1, pixels: Buffer.alloc(8, 1) }),
+    Downloads: encodePng({ width: 1, height: 2, pixels: Buffer.alloc(8, 2) }),
+  };
+  for (const [dir, data] of Object.entries(shots)) {
+    fs.mkdirSync(path.join(home, dir));
+    fs.writeFileSync(path.join(home, dir, 'Screenshot 1.png'), data);
+  }
+  const dest = path.join(home, 'out');
+  const env = {
+    PATH: process.env.PATH,
+    HOME: home,
+    XDG_CONFIG_HOME: path.join(home, '.config'),
+    XDG_STATE_HOME: path.join(home, '.state'),
+    XDG_CACHE_HOME: path.join(home, '.cache'),
+  };
+  const out = execFileSync(process.execPath, [SCRIPT, 'export', '--from', '1h', '--dest', dest, '--jobs', '2'], {
+    env,
+    encoding: 'utf8',
+    stdio: ['ignore', 'pipe', 'ignore'],
+  });
+  const targets = out.trim().split('\n');
+  assert.equal(new Set(targets).size, 2);
+  assert.deepEqual(fs.readdirSync(dest).sort(), ['Screenshot 1.1.png', 'Screenshot 1.png']);
+  const written = fs.readdirSync(dest).map((name) => fs.readFileSync(path.join(dest, name)));
+  for (const data of Object.values(shots)) {
+    assert.ok(written.some((item) => item.equals(data)));
+  }
+});
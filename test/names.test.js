@@ -0,0 +1,105 @@
+'use strict';
+
+const test = require('node:test');
+const assert = require('node:assert/strict');
+const fs = require('node:fs');
+const os = require('node:os');
+const path = require('node:path');
+
+const {
+  existingTarget,
+  placeTarget,
+  uniqueName,
+} = require('../skills/use-screenshot/scripts/screenshot-agent.js');
+
+function tempDirs(t) {
+  const root = fs.mkdtempSync(path.join(os.tmpdir(), 'use-screenshot-test-'));
+  t.after(() => fs.rmSync(root, { recursive: true, force: true }));
+  const files = path.join(root, 'files');
+  const info = path.join(root, 'info');
+  fs.mkdirSync(files);
+  fs.mkdirSync(info);
+  return { files, info };
+}
+
+test('uniqueName keeps a free name', async (t) => {
+  const { files, info } = tempDirs(t);
+  assert.equal(await uniqueName('shot.png', files, info), 'shot.png');
+});
+
+test('uniqueName numbers the stem until the name is free', async (t) => {
+  const { files } = tempDirs(t);
+  fs.writeFileSync(path.join(files, 'shot.png'), '');
+  fs.writeFileSync(path.join(files, 'shot.1.png'), '');
+  assert.equal(await uniqueName('shot.png', files, ''), 'shot.2.png');
+});
+
+test('uniqueName treats a leftover trashinfo as taken', async (t) => {
+  const { files, info } = tempDirs(t);
+  fs.writeFileSync(path.join(info, 'shot.png.trashinfo'), '');
+  assert.equal(await uniqueName('shot.png', files, info), 'shot.1.png');
+  assert.equal(await uniqueName('shot.png', files, ''), 'shot.png');
+});
+
+test('uniqueName rejects an empty name', async (t) => {
+  const { files } = tempDirs(t);
+  await assert.rejects(uniqueName('', files, ''), /empty file name/);
+});
+
+test('uniqueName numbers a name without an extension', async (t) => {
+  const { files } = tempDirs(t);
+  fs.writeFileSync(path.join(files, 'shot'), '');
+  assert.equal(await uniqueName('shot', files, ''), 'shot.1');
+});
+
+test('uniqueName shortens long names to fit with the suffix', async (t) => {
+  const { files, info } = tempDirs(t);
+  const long = `${'é'.repeat(200)}.png`;
+  const first = await uniqueName(long, files, info);
+  assert.ok(Buffer.byteLength(`${first}.trashinfo`) <= 255);
+  assert.ok(first.endsWith('é.png'));
+  fs.writeFileSync(path.join(files, first), '');
+  const second = await uniqueName(long, files, info);
+  assert.ok(second.endsWith('.1.png'));
+  assert.ok(Buffer.byteLength(`${second}.trashinfo`) <= 255);
+  assert.equal(await uniqueName(long, files, ''), long.slice(0, 125) + '.png');
+});
+
+test('uniqueName treats NFC and NFD spellings as the same name', async (t) => {
+  const { files, info } = tempDirs(t);
+  const nfd = 'Cafe\u0301.png';
+  fs.writeFileSync(path.join(files, nfd), '');
+  assert.equal(await uniqueName('Caf\u00e9.png', files, info), 'Caf\u00e9.1.png');
+  fs.writeFileSync(path.join(info, 'Re\u0301sume\u0301.png.trashinfo'), '');
+  assert.equal(await uniqueName('R\u00e9sum\u00e9.png', files, info), 'R\u00e9sum\u00e9.1.png');
+});
+
+test('existingTarget returns the spelling on disk', async (t) => {
+  const { files } = tempDirs(t);
+  const nfd = 'Cafe\u0301.png';
+  fs.writeFileSync(path.join(files, nfd), '');
+  assert.equal(await existingTarget(path.join(files, 'Caf\u00e9.png')), path.join(files, nfd));
+  assert.equal(await existingTarget(path.join(files, 'other.png')), '');
+  assert.equal(await existingTarget(path.join(files, 'missing', 'a.png')), '');
+});
+
+test('placeTarget treats names reserved by the run as taken', async (t) => {
+  const { files } = tempDirs(t);
+  fs.writeFileSync(path.join(files, 'shot.png'), '');
+  const reserved = new Set();
+  const target = path.join(files, 'shot.png');
+  assert.equal(await placeTarget(target, 'rename', {}, reserved), path.join(files, 'shot.1.png'));
+  assert.equal(await placeTarget(target, 'rename', {}, reserved), path.join(files, 'shot.2.png'));
+  assert.deepEqual([...reserved], ['shot.1.png', 'shot.2.png']);
+});
+
+test('placeTarget never overwrites a target the run reserved', async (t) => {
+  const { files } = tempDirs(t);
+  const reserved = new Set();
+  const target = path.join(files, 'Caf\u00e9.png');
+  assert.equal(await placeTarget(target, 'overwrite', {}, reserved), target);
+  const nfd = path.join(files, 'Cafe\u0301.png');
+  assert.equal(await placeTarget(nfd, 'overwrite', {}, reserved), path.join(files, 'Cafe\u0301.1.png'));
+  assert.equal(await placeTarget(target, 'skip', {}, reserved), null);
+  await assert.rejects(placeTarget(target, 'fail', {}, reserved), /already exists/);
+});
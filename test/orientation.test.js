@@ -0,0 +1,85 @@
+'use strict';
+
+const test = require('node:test');
+const assert = require('node:assert/strict');
+
+const {
+  encodePng,
+  exifOrientation,
+  orientImage,
+  pngChunk,
+} = require('../skills/use-screenshot/scripts/screenshot-agent.js');
+
+// tiff builds a one-entry IFD holding the orientation tag.
+function tiff(orientation, little) {
+  const buf = Buffer.alloc(8 + 2 + 12 + 4);
+  const u16 = (value, at) => (little ? buf.writeUInt16LE(value, at) : buf.writeUInt16BE(value, at));
+  const u32 = (value, at) => (little ? buf.writeUInt32LE(value, at) : buf.writeUInt32BE(value, at));
+  buf.write(little ? 'II' : 'MM', 0, 'latin1');
+  u16(42, 2);
+  u32(8, 4);
+  u16(1, 8);
+  u16(0x0112, 10);
+  u16(3, 12);
+  u32(1, 14);
+  u16(orientation, 18);
+  return buf;
+}
+
+function jpeg(orientation, little) {
+  const body = Buffer.concat([Buffer.from('Exif\0\0', 'latin1'), tiff(orientation, little)]);
+  const app0 = Buffer.from([0xff, 0xe0, 0x00, 0x06, 0x4a, 0x46, 0x49, 0x46]);
+  const app1 = Buffer.alloc(4);
+  app1.writeUInt16BE(0xffe1, 0);
+  app1.writeUInt16BE(body.length + 2, 2);
+  return Buffer.concat([Buffer.from([0xff, 0xd8]), app0, app1, body, Buffer.from([0xff, 0xda, 0, 2, 0xff, 0xd9])]);
+}
+
+function pngWithExif(orientation) {
+  const png = encodePng({ width: 1, height: 1, pixels: Buffer.alloc(4) });
+  const ihdrEnd = 8 + 12 + 13;
+  return Buffer.concat([png.subarray(0, ihdrEnd), pngChunk('eXIf', tiff(orientation, false)), png.subarray(ihdrEnd)]);
+}
+
+// labelled holds a 3x2 image whose pixels carry their own index, so a moved
+// pixel can be told apart from every other.
+const labelled = () => ({
+  width: 3,
+  height: 2,
+  pixels: Buffer.concat([0, 1, 2, 3, 4, 5].map((i) => Buffer.from([i, 0, 0, 255]))),
+});
+
+const labels = (image) => Array.from({ length: image.width * image.height }, (_, i) => image.pixels[i * 4]);
+
+test('exifOrientation reads JPEG APP1 in either byte order', () => {
+  assert.equal(exifOrientation(jpeg(6, false)), 6);
+  assert.equal(exifOrientation(jpeg(8, true)), 8);
+});
+
+test('exifOrientation reads a PNG eXIf chunk', () => {
+  assert.equal(exifOrientation(pngWithExif(3)), 3);
+});
+
+test('exifOrientation is 0 without a tag', () => {
+  assert.equal(exifOrientation(encodePng({ width: 1, height: 1, pixels: Buffer.alloc(4) })), 0);
+  assert.equal(exifOrientation(Buffer.from([0xff, 0xd8, 0xff, 0xda, 0, 2, 0, 0, 0, 0, 0, 0])), 0);
+  assert.equal(exifOrientation(Buffer.from('not an image')), 0);
+});
+
+test('orientImage flips and rotates to the displayed layout', () => {
+  const cases = {
+    2: [3, 2, [2, 1, 0, 5, 4, 3]],
+    3: [3, 2, [5, 4, 3, 2, 1, 0]],
+    4: [3, 2, [3, 4, 5, 0, 1, 2]],
+    5: [2, 3, [0, 3, 1, 4, 2, 5]],
+    6: [2, 3, [3, 0, 4, 1, 5, 2]],
+    7: [2, 3, [5, 2, 4, 1, 3, 0]],
+    8: [2, 3, [2, 5, 1, 4, 0, 3]],
+  };
+  for (const [orientation, [width, height, expected]] of Object.entries(cases)) {
+    const got = orientImage(labelled(), Number(orientation));
+    assert.equal(got.width, width, `orientation ${orientation} width`);
+    assert.equal(got.height, height, `orientation ${orientation} height`);
+    assert.deepEqual(labels(got), expected, `orientation ${orientation}`);
+  }
+});
@@ -0,0 +1,103 @@
+'use strict';
+
+const test = require('node:test');
+const assert = require('node:assert/strict');
+const zlib = require('node:zlib');
+
+const {
+  crc32,
+  decodePng,
+  diffImages,
+  encodePng,
+  pngChunk,
+} = require('../skills/use-screenshot/scripts/screenshot-agent.js');
+
+const SIGNATURE = Buffer.from([0x89, 0x50, 0x4e, 0x47, 0x0d, 0x0a, 0x1a, 0x0a]);
+
+// buildPng wraps already-filtered scanlines (each starting with its filter
+// byte) in a minimal PNG, plus any extra chunks before IDAT.
+function buildPng({ width, height, bitDepth, colorType }, rows, extra = []) {
+  const ihdr = Buffer.alloc(13);
+  ihdr.writeUInt32BE(width, 0);
+  ihdr.writeUInt32BE(height, 4);
+  ihdr[8] = bitDepth;
+  ihdr[9] = colorType;
+  return Buffer.concat([
+    SIGNATURE,
+    pngChunk('IHDR', ihdr),
+    ...extra,
+    pngChunk('IDAT', zlib.deflateSync(Buffer.concat(rows.map((row) => Buffer.from(row))))),
+    pngChunk('IEND', Buffer.alloc(0)),
+  ]);
+}
+
+const solid = (width, height, rgba) => ({
+  width,
+  height,
+  pixels: Buffer.concat(Array.from({ length: width * height }, () => Buffer.from(rgba))),
+});
+
+const grays = (image) => Array.from({ length: image.width * image.height }, (_, i) => image.pixels[i * 4]);
+
+test('crc32 matches the standard check value', () => {
+  assert.equal(crc32(Buffer.from('123456789')), 0xcbf43926);
+  assert.equal(crc32(Buffer.alloc(0)), 0);
+});
+
+test('encodePng output decodes back to the same pixels', () => {
+  const image = { width: 3, height: 2, pixels: Buffer.from(Array.from({ length: 24 }, (_, i) => i * 10)) };
+  const png = encodePng(image);
+  assert.deepEqual(png.subarray(0, 8), SIGNATURE);
+  assert.deepEqual(decodePng(png), image);
+});
+
+test('decodePng undoes every scanline filter', () => {
+  const png = buildPng({ width: 3, height: 4, bitDepth: 8, colorType: 0 }, [
+    [1, 10, 5, 5],
+    [2, 1, 1, 1],
+    [3, 0, 0, 0],
+    [4, 0, 0, 0],
+  ]);
+  assert.deepEqual(grays(decodePng(png)), [10, 15, 20, 11, 16, 21, 5, 10, 15, 5, 10, 15]);
+});
+
+test('decodePng expands palette and transparency', () => {
+  const plte = pngChunk('PLTE', Buffer.from([255, 0, 0, 0, 255, 0, 0, 0, 255]));
+  const trns = pngChunk('tRNS', Buffer.from([128]));
+  const png = buildPng({ width: 3, height: 1, bitDepth: 2, colorType: 3 }, [[0, 0b00011000]], [plte, trns]);
+  assert.deepEqual([...decodePng(png).pixels], [255, 0, 0, 128, 0, 255, 0, 255, 0, 0, 255, 255]);
+});
+
+test('decodePng scales low and high bit depths', () => {
+  const oneBit = buildPng({ width: 2, height: 1, bitDepth: 1, colorType: 0 }, [[0, 0b10000000]]);
+  assert.deepEqual(grays(decodePng(oneBit)), [255, 0]);
+  const sixteen = buildPng({ width: 1, height: 1, bitDepth: 16, colorType: 4 }, [[0, 0x12, 0x34, 0x80, 0x00]]);
+  assert.deepEqual([...decodePng(sixteen).pixels], [0x12, 0x12, 0x12, 0x80]);
+});
+
+test('decodePng rejects what it cannot read', () => {
+  assert.throws(() => decodePng(Buffer.from('GIF89a......')), /not a PNG image/);
+  assert.throws(() => decodePng(Buffer.concat([SIGNATURE, pngChunk('IEND', Buffer.alloc(0))])), /missing IHDR/);
+  const bad = buildPng({ width: 1, height: 1, bitDepth: 8, colorType: 0 }, [[9, 0]]);
+  assert.throws(() => decodePng(bad), /bad PNG filter 9/);
+  const odd = buildPng({ width: 1, height: 1, bitDepth: 8, colorType: 5 }, [[0, 0]]);
+  assert.throws(() => decodePng(odd), /unsupported PNG color type 5/);
+});
+
+test('diffImages counts pixels beyond the fuzz', () => {
+  const base = solid(2, 2, [100, 100, 100, 255]);
+  const near = solid(2, 2, [104, 100, 100, 255]);
+  assert.equal(diffImages(base, near, 4).different, 0);
+  const result = diffImages(base, near, 3);
+  assert.equal(result.different, 4);
+  assert.equal(result.total, 4);
+  assert.ok(result.sameSize);
+  assert.deepEqual([...result.image.pixels.subarray(0, 4)], [255, 0, 0, 255]);
+});
+
+test('diffImages counts pixels outside the overlap as different', () => {
+  const result = diffImages(solid(2, 1, [0, 0, 0, 255]), solid(1, 2, [0, 0, 0, 255]), 0);
+  assert.equal(result.total, 4);
+  assert.equal(result.different, 3);
+  assert.equal(result.sameSize, false);
+});
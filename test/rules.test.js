@@ -0,0 +1,116 @@
+'use strict';
+
+const test = require('node:test');
+const assert = require('node:assert/strict');
+
+const {
+  evaluateRules,
+  globToRegExp,
+  parseRule,
+  ruleFacts,
+} = require('../skills/use-screenshot/scripts/screenshot-agent.js');
+
+const facts = (overrides) => ({
+  source: 'file',
+  dir: 'Downloads',
+  name: 'Invoice 2024.png',
+  ext: 'png',
+  age: 5 * 60 * 1000,
+  size: 2048,
+  tagged: false,
+  ...overrides,
+});
+
+test('parseRule reads fields, operators, and actions', () => {
+  const rule = parseRule("if dir == Downloads and name matches 'Invoice*' then skip");
+  assert.equal(rule.action, 'skip');
+  assert.equal(rule.expr.type, 'and');
+  assert.equal(rule.expr.left.field, 'dir');
+  assert.equal(rule.expr.right.op, 'matches');
+});
+
+test('parseRule converts durations, sizes, and booleans', () => {
+  assert.equal(parseRule('if age > 1h then reject').expr.value, 60 * 60 * 1000);
+  assert.equal(parseRule('if size >= 2mb then skip').expr.value, 2 * 1024 * 1024);
+  assert.equal(parseRule('if tagged == true then accept').expr.value, true);
+});
+
+test('parseRule rejects malformed rules', () => {
+  assert.throws(() => parseRule('dir == Downloads then skip'), /expected "if"/);
+  assert.throws(() => parseRule('if colour == red then skip'), /unknown field: colour/);
+  assert.throws(() => parseRule('if dir ~ Downloads then skip'), /unknown operator/);
+  assert.throws(() => parseRule('if dir == Downloads then delete'), /unknown action: delete/);
+  assert.throws(() => parseRule('if dir == Downloads then skip now'), /unexpected "now"/);
+  assert.throws(() => parseRule('if age > soon then skip'), /bad duration: soon/);
+  assert.throws(() => parseRule('if size > huge then skip'), /bad size: huge/);
+  assert.throws(() => parseRule('if tagged == maybe then skip'), /bad boolean: maybe/);
+  assert.throws(() => parseRule("if name == 'open then skip"), /unterminated string/);
+  assert.throws(() => parseRule('if (dir == Downloads then skip'), /expected \)/);
+});
+
+test('parseRule allows ordering operators only on age and size', () => {
+  for (const field of ['source', 'dir', 'name', 'ext', 'tagged']) {
+    assert.throws(
+      () => parseRule(`if ${field} > x then skip`),
+      new RegExp(`operator > not supported for ${field} \\(only for age and size\\)`),
+    );
+  }
+  assert.throws(() => parseRule('if name <= b then skip'), /operator <= not supported for name/);
+  assert.equal(parseRule('if size < 1k then skip').expr.op, '<');
+  assert.equal(parseRule('if name != x then skip').expr.op, '!=');
+});
+
+test('evaluateRules returns the first matching action', () => {
+  const rules = [
+    parseRule('if dir == desktop then reject'),
+    parseRule("if name matches 'invoice*' then skip"),
+    parseRule('if size > 1k then accept'),
+  ];
+  assert.equal(evaluateRules(rules, facts()), 'skip');
+  assert.equal(evaluateRules(rules, facts({ name: 'shot.png' })), 'accept');
+  assert.equal(evaluateRules(rules, facts({ dir: 'Desktop' })), 'reject');
+  assert.equal(evaluateRules(rules, facts({ name: 'a.png', size: 10 })), '');
+  assert.equal(evaluateRules(undefined, facts()), '');
+});
+
+test('evaluateRules honors not, or, and parentheses', () => {
+  const rule = parseRule("if not (ext == jpg or name contains 'draft') and source == file then accept");
+  assert.equal(evaluateRules([rule], facts()), 'accept');
+  assert.equal(evaluateRules([rule], facts({ ext: 'jpg' })), '');
+  assert.equal(evaluateRules([rule], facts({ name: 'Draft.png' })), '');
+  assert.equal(evaluateRules([rule], facts({ source: 'clipboard' })), '');
+});
+
+test('comparisons against missing facts never match', () => {
+  const rule = parseRule('if age < 1h then accept');
+  assert.equal(evaluateRules([rule], facts({ age: undefined })), '');
+});
+
+test('ruleFacts derives facts from a candidate', () => {
+  const now = 1_000_000;
+  const got = ruleFacts({ path: '/tmp/Shot.PNG', dir: 'Desktop', modTimeMs: now - 500, size: 42 }, now);
+  assert.deepEqual(got, {
+    source: 'file',
+    dir: 'Desktop',
+    name: 'Shot.PNG',
+    ext: 'png',
+    age: 500,
+    size: 42,
+    tagged: false,
+  });
+  const clip = ruleFacts({ source: 'clipboard', ext: 'png' }, now);
+  assert.equal(clip.dir, 'clipboard');
+  assert.equal(clip.ext, 'png');
+  assert.equal(clip.age, undefined);
+});
+
+test('globToRegExp matches case-insensitively and escapes specials', () => {
+  assert.ok(globToRegExp('Screenshot*.png').test('screenshot 2024.PNG'));
+  assert.ok(globToRegExp('shot-?.png').test('shot-1.png'));
+  assert.ok(!globToRegExp('shot-?.png').test('shot-12.png'));
+  assert.ok(globToRegExp('shot[0-9].png').test('shot7.png'));
+  assert.ok(!globToRegExp('shot[!0-9].png').test('shot7.png'));
+  assert.ok(!globToRegExp('a.png').test('abpng'));
+  assert.ok(globToRegExp('a(1)+.png').test('a(1)+.png'));
+  assert.ok(globToRegExp('[unclosed').test('[unclosed'));
+});
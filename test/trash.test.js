@@ -0,0 +1,54 @@
+'use strict';
+
+const test = require('node:test');
+const assert = require('node:assert/strict');
+
+const {
+  splitRawPath,
+  textPath,
+  trashEscapePath,
+  trashInfoContent,
+  truncateBytes,
+} = require('../skills/use-screenshot/scripts/screenshot-agent.js');
+
+test('trashEscapePath keeps the encodeURI safe set', () => {
+  assert.equal(trashEscapePath('/home/me/Shot_1-(a).png'), '/home/me/Shot_1-(a).png');
+  assert.equal(trashEscapePath('/tmp/a b%c.png'), '/tmp/a%20b%25c.png');
+  assert.equal(trashEscapePath('/tmp/é.png'), '/tmp/%C3%A9.png');
+});
+
+test('trashEscapePath encodes raw bytes that are not UTF-8', () => {
+  const raw = Buffer.concat([Buffer.from('/tmp/'), Buffer.from([0xff, 0x0a]), Buffer.from('.png')]);
+  assert.equal(trashEscapePath(raw), '/tmp/%FF%0A.png');
+  assert.deepEqual(Buffer.from(decodeURIComponent(trashEscapePath('/tmp/é.png'))), Buffer.from('/tmp/é.png'));
+});
+
+test('trashInfoContent writes the spec layout in local time', () => {
+  const when = new Date(2024, 0, 2, 3, 4, 5);
+  assert.equal(
+    trashInfoContent('/tmp/a b.png', when),
+    '[Trash Info]\nPath=/tmp/a%20b.png\nDeletionDate=2024-01-02T03:04:05\n',
+  );
+});
+
+test('truncateBytes cuts on character boundaries', () => {
+  assert.equal(truncateBytes('short', 10), 'short');
+  assert.equal(truncateBytes('abcdef', 3), 'abc');
+  assert.equal(truncateBytes('ééé', 5), 'éé');
+  assert.equal(truncateBytes('a😀b', 4), 'a');
+});
+
+test('splitRawPath keeps the exact bytes of the name', () => {
+  const raw = Buffer.concat([Buffer.from('/tmp/dir/'), Buffer.from([0xfe, 0x41])]);
+  const split = splitRawPath(raw);
+  assert.equal(split.dir, '/tmp/dir');
+  assert.deepEqual(split.base, Buffer.from([0xfe, 0x41]));
+  assert.equal(splitRawPath(Buffer.from('/x')).dir, '/');
+  assert.deepEqual(splitRawPath('/tmp/a.png'), { dir: '/tmp', base: Buffer.from('a.png') });
+});
+
+test('textPath quotes paths with control characters', () => {
+  assert.equal(textPath('/tmp/plain name.png'), '/tmp/plain name.png');
+  assert.equal(textPath('/tmp/two\nlines.png'), '"/tmp/two\\nlines.png"');
+  assert.equal(textPath('/tmp/tab\t.png'), '"/tmp/tab\\t.png"');
+});